@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/FarmRadioHangar/fessboxconfig/asterisk"
+	"github.com/FarmRadioHangar/fessboxconfig/audit"
+	"github.com/FarmRadioHangar/fessboxconfig/device"
+	"github.com/gorilla/mux"
+)
+
+// errNoModem is returned when a modem to adopt is not plugged in.
+var errNoModem = errors.New("no modem with this imei is plugged in")
+
+// adoptRequest is the optional body of an adopt request, the fields override
+// the settings.
+type adoptRequest struct {
+	Name    string `json:"name"`
+	Context string `json:"context"`
+	Group   string `json:"group"`
+}
+
+// adoption is the outcome of adopting a modem.
+type adoption struct {
+	Section string           `json:"section"`
+	Report  *asterisk.Report `json:"report"`
+
+	before, after []byte
+}
+
+// adopt adds a section for the modem to dongle.conf and applies it with r and
+// v. The section is not written if the modem already has one. The
+// configuration lock is held from reading dongle.conf to the end of the apply,
+// so two adoptions can not pick the same section name and no other write is
+// lost.
+func adopt(cfg *Config, m device.Modem, req adoptRequest, r asterisk.Reloader, v asterisk.Verifier) (*adoption, error) {
+	defer asterisk.Lock(cfg.AsteriskConfig)()
+	before, err := ioutil.ReadFile(filepath.Join(cfg.AsteriskConfig, asterisk.DongleConf))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	after, name, err := asterisk.Adopt(before, adoptionFor(cfg, m, req))
+	res := &adoption{Section: name, before: before, after: after}
+	if err != nil {
+		return res, err
+	}
+	c := asterisk.NewChangeset(cfg.AsteriskConfig)
+	err = c.StageRaw(asterisk.DongleConf, after)
+	if err != nil {
+		return res, err
+	}
+	res.Report, err = c.Apply(r, v)
+	return res, err
+}
+
+// adoptionFor describes the section for the modem from the settings and the
+// request.
+func adoptionFor(cfg *Config, m device.Modem, req adoptRequest) asterisk.Adoption {
+	a := asterisk.Adoption{
+		IMEI:    m.IMEI,
+		IMSI:    m.IMSI,
+		Name:    req.Name,
+		Pattern: cfg.AdoptPattern,
+		Context: cfg.AdoptContext,
+		Group:   cfg.AdoptGroup,
+	}
+	if req.Context != "" {
+		a.Context = req.Context
+	}
+	if req.Group != "" {
+		a.Group = req.Group
+	}
+	return a
+}
+
+// plugged returns the modems that are plugged in. Without a device manager the
+// modems are found from their symlinks in /dev.
+func plugged(manager *device.Manager) []device.Modem {
+	if manager != nil {
+		return manager.Modems()
+	}
+	return device.LinkedModems()
+}
+
+// findModem returns the plugged in modem with the imei.
+func findModem(manager *device.Manager, imei string) (device.Modem, bool) {
+	for _, m := range plugged(manager) {
+		if m.IMEI == imei {
+			return m, true
+		}
+	}
+	return device.Modem{}, false
+}
+
+// AdoptModem creates a dongle.conf section for the modem with the imei in the
+// url, the optional json body sets the name, context and group of the section.
+func (ww *web) AdoptModem(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	if _, err := ww.writable(r, asterisk.DongleConf); err != nil {
+		writeFileError(w, err)
+		return
+	}
+	reloader, err := ww.reloader(r, []string{asterisk.DongleConf})
+	if err != nil {
+		writeFileError(w, err)
+		return
+	}
+	var req adoptRequest
+	if r.ContentLength != 0 {
+		err = json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = enc.Encode(&errMSG{Message: "trouble loading request body"})
+			return
+		}
+	}
+	m, ok := findModem(ww.manager, mux.Vars(r)["imei"])
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		_ = enc.Encode(&errMSG{errNoModem.Error()})
+		return
+	}
+	res, err := adopt(ww.cfg, m, req, reloader, ww.verifier())
+	switch {
+	case err == asterisk.ErrAdopted:
+		w.WriteHeader(http.StatusConflict)
+		_ = enc.Encode(map[string]interface{}{"error": err.Error(), "section": res.Section})
+		return
+	case res == nil:
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		_ = enc.Encode(&errMSG{"trouble opening dongle configuration"})
+		return
+	case res.after == nil:
+		w.WriteHeader(http.StatusBadRequest)
+		_ = enc.Encode(&errMSG{err.Error()})
+		return
+	}
+	ww.record(r, audit.ConfigWrite, asterisk.DongleConf, res.before, res.after, err)
+	if err != nil {
+		writeApplyResult(w, res.Report, err)
+		return
+	}
+	_ = enc.Encode(res)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/FarmRadioHangar/fessboxconfig/asterisk"
+	"github.com/FarmRadioHangar/fessboxconfig/device"
+)
+
+func TestAdopt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fconf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	err = copyFiles(dir, "sample")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := defaultConfig()
+	cfg.AsteriskConfig = dir
+	cfg.AdoptPattern = "sim{n}"
+	cfg.AdoptContext = "from-trunk"
+	m := device.Modem{IMEI: "356789012345678", IMSI: "640050123456789"}
+
+	res, err := adopt(cfg, m, adoptRequest{Group: "2"}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Section != "sim1" {
+		t.Errorf("expected sim1 got %s", res.Section)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, asterisk.DongleConf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := "[sim1]\nimei=356789012345678\nimsi=640050123456789\ncontext=from-trunk\ngroup=2\n"
+	if !strings.Contains(string(b), expect) {
+		t.Errorf("expected %q in\n%s", expect, b)
+	}
+	if _, err := adopt(cfg, m, adoptRequest{}, nil, nil); err != asterisk.ErrAdopted {
+		t.Errorf("expected the modem to be adopted already got %v", err)
+	}
+}
+
+func TestApplyActions(t *testing.T) {
+	ww := &web{cfg: defaultConfig()}
+	src := []byte("[general]\ninterval=15\n\n[airtel1]\nimei=354369047238739\n")
+	rec, err := asterisk.Reconcile(src, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, _, err := ww.applyActions(rec, src, []reconcileAction{{Action: asterisk.ActionStop, Section: "airtel1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(out), "initstate=stop") {
+		t.Errorf("expected airtel1 to be stopped got\n%s", out)
+	}
+	if _, _, err := ww.applyActions(rec, src, []reconcileAction{{Action: "remove"}}); err == nil {
+		t.Error("expected an unknown action to fail")
+	}
+	if _, _, err := ww.applyActions(rec, src, []reconcileAction{{Action: asterisk.ActionStop, Section: "general"}}); err == nil {
+		t.Error("expected a section missing from the reconciliation to fail")
+	}
+	rec, err = asterisk.Reconcile(src, []asterisk.Identity{{IMEI: "354369047238739"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := ww.applyActions(rec, src, []reconcileAction{{Action: asterisk.ActionStop, Section: "airtel1"}}); err == nil {
+		t.Error("expected a matched device not to be stopped")
+	}
+	if _, _, err := ww.applyActions(rec, src, []reconcileAction{{Action: asterisk.ActionRebind, Section: "airtel1"}}); err == nil {
+		t.Error("expected a device that did not move not to be rebound")
+	}
+}
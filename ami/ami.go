@@ -0,0 +1,411 @@
+// Package ami is a client for the Asterisk Manager Interface.
+//
+// Only the parts used by fconf are implemented: logging in, sending actions,
+// running CLI commands and receiving events. chan_dongle adds its own actions
+// on top, DongleReload is used to apply changes to dongle.conf.
+package ami
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultTimeout is how long to wait for the response to an action when the
+// client has no timeout set.
+const DefaultTimeout = 10 * time.Second
+
+// When values accepted by DongleReload.
+const (
+	Now            = "now"
+	Gracefully     = "gracefully"
+	WhenConvenient = "when convenient"
+)
+
+// endCommand ends the output of a Command action on asterisk older than 14.
+const endCommand = "--END COMMAND--"
+
+// Errors returned by the client.
+var (
+	ErrClosed  = errors.New("ami: connection closed")
+	ErrTimeout = errors.New("ami: timed out waiting for a response")
+)
+
+// Message is an action, a response or an event. Keys that appear more than
+// once, like the Output of a command, have their values joined by newlines.
+type Message map[string]string
+
+// Error is returned when asterisk responds to an action with an error.
+type Error struct {
+	Action  string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("ami: %s failed: %s", e.Action, e.Message)
+}
+
+// Client is a connection to the manager interface of asterisk.
+//
+// It is safe to use in multiple goroutines.
+type Client struct {
+	// Timeout is how long to wait for the response to an action, it defaults
+	// to DefaultTimeout.
+	Timeout time.Duration
+
+	conn    net.Conn
+	wmu     sync.Mutex
+	mu      sync.Mutex
+	id      int
+	pending map[string]*waiter
+	subs    map[chan Message]bool
+	err     error
+	done    chan struct{}
+}
+
+// Dial connects to the manager interface listening on addr, a host:port pair.
+func Dial(addr string, timeout time.Duration) (*Client, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return newClient(conn, timeout)
+}
+
+func newClient(conn net.Conn, timeout time.Duration) (*Client, error) {
+	c := &Client{
+		Timeout: timeout,
+		conn:    conn,
+		pending: make(map[string]*waiter),
+		subs:    make(map[chan Message]bool),
+		done:    make(chan struct{}),
+	}
+	r := bufio.NewReader(conn)
+	_ = conn.SetReadDeadline(time.Now().Add(c.timeout()))
+	banner, err := r.ReadString('\n')
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	if !strings.HasPrefix(banner, "Asterisk Call Manager") {
+		_ = conn.Close()
+		return nil, fmt.Errorf("ami: unexpected banner %q", strings.TrimSpace(banner))
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+	go c.readLoop(r)
+	return c, nil
+}
+
+func (c *Client) timeout() time.Duration {
+	if c.Timeout > 0 {
+		return c.Timeout
+	}
+	return DefaultTimeout
+}
+
+// Login authenticates with the username and secret of a manager user from
+// manager.conf.
+func (c *Client) Login(username, secret string) error {
+	_, err := c.Action(Message{"Action": "Login", "Username": username, "Secret": secret})
+	return err
+}
+
+// Action sends the action and returns its response. An *Error is returned if
+// asterisk responds with an error.
+func (c *Client) Action(m Message) (Message, error) {
+	id, w := c.register()
+	defer c.unregister(id)
+	err := c.send(id, m)
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.next(w, time.After(c.timeout()))
+	if err != nil {
+		return nil, err
+	}
+	if strings.EqualFold(res["Response"], "Error") {
+		return res, &Error{Action: m["Action"], Message: res["Message"]}
+	}
+	return res, nil
+}
+
+// ActionList sends an action whose results are sent back as events, like
+// DongleShowDevices, and returns the events up to the one named complete.
+func (c *Client) ActionList(m Message, complete string) ([]Message, error) {
+	id, w := c.register()
+	defer c.unregister(id)
+	err := c.send(id, m)
+	if err != nil {
+		return nil, err
+	}
+	var list []Message
+	timeout := time.After(c.timeout())
+	for {
+		res, err := c.next(w, timeout)
+		if err != nil {
+			return nil, err
+		}
+		if strings.EqualFold(res["Response"], "Error") {
+			return nil, &Error{Action: m["Action"], Message: res["Message"]}
+		}
+		switch res["Event"] {
+		case "":
+		case complete:
+			return list, nil
+		default:
+			list = append(list, res)
+		}
+	}
+}
+
+// next returns the next message for the action of w. The messages read before
+// the connection closed are returned before the error.
+func (c *Client) next(w *waiter, timeout <-chan time.Time) (Message, error) {
+	for {
+		if m, ok := w.pop(); ok {
+			return m, nil
+		}
+		select {
+		case <-w.ready:
+		case <-c.done:
+			if m, ok := w.pop(); ok {
+				return m, nil
+			}
+			return nil, c.closeErr()
+		case <-timeout:
+			return nil, ErrTimeout
+		}
+	}
+}
+
+// Command runs a CLI command, like "dongle show devices", and returns its
+// output.
+func (c *Client) Command(cmd string) (string, error) {
+	res, err := c.Action(Message{"Action": "Command", "Command": cmd})
+	if err != nil {
+		return "", err
+	}
+	return res["Output"], nil
+}
+
+// DongleReload asks chan_dongle to read dongle.conf again. when is one of Now,
+// Gracefully and WhenConvenient, the last two wait for the calls in progress
+// to end before restarting a device.
+func (c *Client) DongleReload(when string) error {
+	if when == "" {
+		when = WhenConvenient
+	}
+	_, err := c.Action(Message{"Action": "DongleReload", "When": when})
+	return err
+}
+
+// Subscribe returns a channel receiving the events sent by asterisk and a
+// function to stop receiving them. Events are dropped when the channel is not
+// drained fast enough. The channel is closed when the connection is.
+func (c *Client) Subscribe() (<-chan Message, func()) {
+	ch := make(chan Message, 64)
+	c.mu.Lock()
+	if c.subs == nil {
+		close(ch)
+	} else {
+		c.subs[ch] = true
+	}
+	c.mu.Unlock()
+	return ch, func() {
+		c.mu.Lock()
+		if c.subs[ch] {
+			delete(c.subs, ch)
+			close(ch)
+		}
+		c.mu.Unlock()
+	}
+}
+
+// Close logs off and closes the connection.
+func (c *Client) Close() error {
+	select {
+	case <-c.done:
+		return nil
+	default:
+	}
+	_, _ = c.Action(Message{"Action": "Logoff"})
+	err := c.conn.Close()
+	<-c.done
+	return err
+}
+
+// waiter holds the messages for an action until its caller takes them, so
+// the reader never waits for a slow caller.
+type waiter struct {
+	mu    sync.Mutex
+	queue []Message
+	ready chan struct{}
+}
+
+func (w *waiter) push(m Message) {
+	w.mu.Lock()
+	w.queue = append(w.queue, m)
+	w.mu.Unlock()
+	select {
+	case w.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (w *waiter) pop() (Message, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.queue) == 0 {
+		return nil, false
+	}
+	m := w.queue[0]
+	w.queue = w.queue[1:]
+	return m, true
+}
+
+func (c *Client) register() (string, *waiter) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.id++
+	id := "fconf-" + strconv.Itoa(c.id)
+	w := &waiter{ready: make(chan struct{}, 1)}
+	c.pending[id] = w
+	return id, w
+}
+
+func (c *Client) unregister(id string) {
+	c.mu.Lock()
+	delete(c.pending, id)
+	c.mu.Unlock()
+}
+
+func (c *Client) send(id string, m Message) error {
+	b := &bytes.Buffer{}
+	// the action goes first, asterisk ignores the message otherwise
+	fmt.Fprintf(b, "Action: %s\r\n", m["Action"])
+	for k, v := range m {
+		if k == "Action" || k == "ActionID" {
+			continue
+		}
+		fmt.Fprintf(b, "%s: %s\r\n", k, v)
+	}
+	fmt.Fprintf(b, "ActionID: %s\r\n\r\n", id)
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	_ = c.conn.SetWriteDeadline(time.Now().Add(c.timeout()))
+	_, err := c.conn.Write(b.Bytes())
+	return err
+}
+
+func (c *Client) closeErr() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return c.err
+	}
+	return ErrClosed
+}
+
+func (c *Client) readLoop(r *bufio.Reader) {
+	var err error
+	for {
+		var m Message
+		m, err = readMessage(r)
+		if err != nil {
+			break
+		}
+		c.dispatch(m)
+	}
+	c.mu.Lock()
+	c.err = err
+	for ch := range c.subs {
+		close(ch)
+	}
+	c.subs = nil
+	c.mu.Unlock()
+	close(c.done)
+}
+
+// dispatch hands m to the action it answers, or to the subscribers when it is
+// an event. It never blocks, the reader would hold up every action otherwise.
+func (c *Client) dispatch(m Message) {
+	c.mu.Lock()
+	w, ok := c.pending[m["ActionID"]]
+	c.mu.Unlock()
+	if ok {
+		// events carrying an ActionID are the results of a list action
+		w.push(m)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := m["Event"]; ok {
+		for ch := range c.subs {
+			select {
+			case ch <- m:
+			default:
+			}
+		}
+		return
+	}
+}
+
+// readMessage reads the lines of a single message up to the blank line that
+// ends it.
+func readMessage(r *bufio.Reader) (Message, error) {
+	m := make(Message)
+	follows := false
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if follows {
+			// the raw output of Command on asterisk older than 14
+			if strings.HasSuffix(line, endCommand) {
+				if rest := strings.TrimSuffix(line, endCommand); rest != "" {
+					add(m, "Output", rest)
+				}
+				follows = false
+				continue
+			}
+			if i := strings.Index(line, ": "); i > 0 && !strings.ContainsAny(line[:i], " \t") && m["Output"] == "" {
+				add(m, line[:i], line[i+2:])
+				continue
+			}
+			add(m, "Output", line)
+			continue
+		}
+		if line == "" {
+			if len(m) == 0 {
+				continue
+			}
+			return m, nil
+		}
+		i := strings.Index(line, ":")
+		if i == -1 {
+			add(m, "Output", line)
+			continue
+		}
+		key, value := line[:i], strings.TrimSpace(line[i+1:])
+		add(m, key, value)
+		if key == "Response" && value == "Follows" {
+			follows = true
+		}
+	}
+}
+
+func add(m Message, key, value string) {
+	if v, ok := m[key]; ok {
+		m[key] = v + "\n" + value
+		return
+	}
+	m[key] = value
+}
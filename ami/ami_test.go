@@ -0,0 +1,264 @@
+package ami
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeServer is a manager interface that answers actions with canned
+// responses.
+type fakeServer struct {
+	l net.Listener
+
+	mu      sync.Mutex
+	actions []Message
+	events  []string
+}
+
+func newFakeServer(t *testing.T) *fakeServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeServer{l: l}
+	go s.serve()
+	return s
+}
+
+func (s *fakeServer) addr() string { return s.l.Addr().String() }
+
+func (s *fakeServer) close() { _ = s.l.Close() }
+
+func (s *fakeServer) received() []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Message(nil), s.actions...)
+}
+
+func (s *fakeServer) serve() {
+	for {
+		conn, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *fakeServer) handle(conn net.Conn) {
+	defer func() { _ = conn.Close() }()
+	fmt.Fprint(conn, "Asterisk Call Manager/2.10.3\r\n")
+	r := bufio.NewReader(conn)
+	loggedIn := false
+	for {
+		m, err := readMessage(r)
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.actions = append(s.actions, m)
+		events := s.events
+		s.mu.Unlock()
+		id := m["ActionID"]
+		switch m["Action"] {
+		case "Login":
+			if m["Username"] != "fconf" || m["Secret"] != "secret" {
+				fmt.Fprintf(conn, "Response: Error\r\nActionID: %s\r\nMessage: Authentication failed\r\n\r\n", id)
+				return
+			}
+			loggedIn = true
+			fmt.Fprintf(conn, "Response: Success\r\nActionID: %s\r\nMessage: Authentication accepted\r\n\r\n", id)
+			fmt.Fprint(conn, "Event: FullyBooted\r\nStatus: Fully Booted\r\n\r\n")
+			for _, e := range events {
+				fmt.Fprint(conn, e)
+			}
+		case "Logoff":
+			fmt.Fprintf(conn, "Response: Goodbye\r\nActionID: %s\r\n\r\n", id)
+			return
+		case "Command":
+			if m["Command"] == "core show version" {
+				// the format used before asterisk 14
+				fmt.Fprintf(conn, "Response: Follows\r\nPrivilege: Command\r\nActionID: %s\r\nAsterisk 11.7.0\r\n\r\nbuilt by root\r\n--END COMMAND--\r\n\r\n", id)
+				continue
+			}
+			fmt.Fprintf(conn, "Response: Success\r\nActionID: %s\r\nOutput: line one\r\nOutput: line two\r\n\r\n", id)
+		case "DongleShowDevices":
+			fmt.Fprintf(conn, "Response: Success\r\nActionID: %s\r\nEventList: start\r\nMessage: Device status list will follow\r\n\r\n", id)
+			fmt.Fprint(conn, "Event: DongleStatus\r\nDevice: tigo1\r\nStatus: Free\r\n\r\n")
+			fmt.Fprintf(conn, "Event: DongleDeviceEntry\r\nActionID: %s\r\nDevice: airtel1\r\nGroup: 0\r\nState: Free\r\nRSSI: 18, -77 dBm\r\nProviderName: Airtel TZ\r\nIMEIState: 356789012345678\r\nIMSIState: 640050123456789\r\nActive: 1\r\n\r\n", id)
+			fmt.Fprintf(conn, "Event: DongleDeviceEntry\r\nActionID: %s\r\nDevice: tigo1\r\nState: Not connected\r\nIMEISetting: 356789012345679\r\n\r\n", id)
+			fmt.Fprintf(conn, "Event: DongleShowDevicesComplete\r\nActionID: %s\r\nEventList: Complete\r\nListItems: 2\r\n\r\n", id)
+		case "DongleReload":
+			if !loggedIn {
+				fmt.Fprintf(conn, "Response: Error\r\nActionID: %s\r\nMessage: Permission denied\r\n\r\n", id)
+				continue
+			}
+			switch m["When"] {
+			case Now, Gracefully, WhenConvenient:
+				fmt.Fprintf(conn, "Response: Success\r\nActionID: %s\r\nMessage: Reload scheduled\r\n\r\n", id)
+			default:
+				fmt.Fprintf(conn, "Response: Error\r\nActionID: %s\r\nMessage: Invalid value of When\r\n\r\n", id)
+			}
+		default:
+			fmt.Fprintf(conn, "Response: Error\r\nActionID: %s\r\nMessage: Invalid/unknown command\r\n\r\n", id)
+		}
+	}
+}
+
+func TestClient(t *testing.T) {
+	s := newFakeServer(t)
+	defer s.close()
+	cfg := Config{Addr: s.addr(), Username: "fconf", Secret: "wrong", Timeout: time.Second}
+	_, err := cfg.Connect()
+	if err == nil || !strings.Contains(err.Error(), "Authentication failed") {
+		t.Errorf("expected the login to fail got %v", err)
+	}
+
+	cfg.Secret = "secret"
+	c, err := cfg.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = c.Close() }()
+	out, err := c.Command("dongle show devices")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "line one\nline two" {
+		t.Errorf("unexpected output %q", out)
+	}
+	out, err = c.Command("core show version")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "Asterisk 11.7.0\n\nbuilt by root" {
+		t.Errorf("unexpected legacy output %q", out)
+	}
+	err = c.DongleReload("tomorrow")
+	if _, ok := err.(*Error); !ok {
+		t.Errorf("expected an *Error got %v", err)
+	}
+	err = c.DongleReload(Now)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	s := newFakeServer(t)
+	defer s.close()
+	s.events = []string{"Event: DongleStatus\r\nDevice: airtel1\r\nStatus: Free\r\n\r\n"}
+	c, err := Dial(s.addr(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, stop := c.Subscribe()
+	defer stop()
+	err = c.Login("fconf", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	timeout := time.After(time.Second)
+	for len(got) < 2 {
+		select {
+		case e := <-events:
+			got = append(got, e["Event"])
+		case <-timeout:
+			t.Fatalf("expected two events got %v", got)
+		}
+	}
+	if got[0] != "FullyBooted" || got[1] != "DongleStatus" {
+		t.Errorf("unexpected events %v", got)
+	}
+	_ = c.Close()
+	select {
+	case _, ok := <-events:
+		for ok {
+			_, ok = <-events
+		}
+	case <-time.After(time.Second):
+		t.Error("expected the events channel to be closed")
+	}
+}
+
+func TestDispatch(t *testing.T) {
+	c := &Client{Timeout: time.Hour, pending: make(map[string]*waiter), subs: make(map[chan Message]bool)}
+	id, w := c.register()
+	events, stop := c.Subscribe()
+	defer stop()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			c.dispatch(Message{"ActionID": id, "Event": "DongleDeviceEntry"})
+			c.dispatch(Message{"Event": "DongleStatus"})
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected the messages nobody reads yet not to block the reader")
+	}
+	n := 0
+	for _, ok := w.pop(); ok; _, ok = w.pop() {
+		n++
+	}
+	if n != 100 || len(events) != cap(events) {
+		t.Errorf("expected the list kept and the events dropped got %d %d", n, len(events))
+	}
+}
+
+func TestReloader(t *testing.T) {
+	s := newFakeServer(t)
+	defer s.close()
+	r := &Reloader{
+		Config:   Config{Addr: s.addr(), Username: "fconf", Secret: "secret", Timeout: time.Second},
+		When:     Gracefully,
+		Dialplan: true,
+	}
+	err := r.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var actions []string
+	for _, m := range s.received() {
+		actions = append(actions, m["Action"]+" "+m["When"]+m["Command"])
+	}
+	expect := "Login |DongleReload gracefully|Command dialplan reload|Logoff "
+	if strings.Join(actions, "|") != expect {
+		t.Errorf("expected %s got %s", expect, strings.Join(actions, "|"))
+	}
+}
+
+func TestDongleDevices(t *testing.T) {
+	s := newFakeServer(t)
+	defer s.close()
+	c, err := Config{Addr: s.addr(), Username: "fconf", Secret: "secret", Timeout: time.Second}.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = c.Close() }()
+	devices, err := c.DongleDevices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 2 {
+		t.Fatalf("expected 2 devices got %d", len(devices))
+	}
+	d := devices[0]
+	if d.IMEI != "356789012345678" || d.RSSI != 18 || d.Calls != 1 {
+		t.Errorf("unexpected device %+v", d)
+	}
+	if d.String() != "airtel1: Free, RSSI 18, Airtel TZ" {
+		t.Errorf("unexpected summary %s", d)
+	}
+	if devices[1].IMEI != "356789012345679" {
+		t.Errorf("expected the configured imei got %s", devices[1].IMEI)
+	}
+}
@@ -0,0 +1,95 @@
+package ami
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// DongleDevice is the state of a device as chan_dongle sees it, the same
+// information printed by the dongle show devices CLI command.
+type DongleDevice struct {
+	Device   string `json:"device"`
+	Group    int    `json:"group"`
+	State    string `json:"state"`
+	RSSI     int    `json:"rssi"`
+	Mode     string `json:"mode"`
+	Submode  string `json:"submode"`
+	Provider string `json:"provider"`
+	Model    string `json:"model"`
+	Firmware string `json:"firmware"`
+	IMEI     string `json:"imei"`
+	IMSI     string `json:"imsi"`
+	Number   string `json:"number"`
+
+	// Registration is the GSM registration status, for instance
+	// "Registered, home network".
+	Registration string `json:"registration"`
+
+	// Calls is the number of calls in progress on the device.
+	Calls int `json:"calls"`
+}
+
+// String summarises the device, for instance "airtel1: Free, RSSI 18, Airtel".
+func (d DongleDevice) String() string {
+	s := fmt.Sprintf("%s: %s, RSSI %d", d.Device, d.State, d.RSSI)
+	if d.Provider != "" {
+		s += ", " + d.Provider
+	}
+	return s
+}
+
+// DongleDevices returns the devices configured in chan_dongle.
+func (c *Client) DongleDevices() ([]DongleDevice, error) {
+	list, err := c.ActionList(Message{"Action": "DongleShowDevices"}, "DongleShowDevicesComplete")
+	if err != nil {
+		return nil, err
+	}
+	var devices []DongleDevice
+	for _, m := range list {
+		if m["Event"] != "DongleDeviceEntry" {
+			continue
+		}
+		devices = append(devices, dongleDevice(m))
+	}
+	return devices, nil
+}
+
+func dongleDevice(m Message) DongleDevice {
+	d := DongleDevice{
+		Device:       m["Device"],
+		Group:        leadingInt(m["Group"]),
+		State:        m["State"],
+		RSSI:         leadingInt(m["RSSI"]),
+		Mode:         m["Mode"],
+		Submode:      m["Submode"],
+		Provider:     m["ProviderName"],
+		Model:        m["Model"],
+		Firmware:     m["Firmware"],
+		IMEI:         m["IMEIState"],
+		IMSI:         m["IMSIState"],
+		Number:       m["SubscriberNumber"],
+		Registration: m["GSMRegistrationStatus"],
+		Calls:        leadingInt(m["Active"]),
+	}
+	// the configured values are used until the device reports its own
+	if d.IMEI == "" {
+		d.IMEI = m["IMEISetting"]
+	}
+	if d.IMSI == "" {
+		d.IMSI = m["IMSISetting"]
+	}
+	return d
+}
+
+// leadingInt parses the number at the start of s, values like "18, -77 dBm"
+// give 18. It is 0 when s does not start with a number.
+func leadingInt(s string) int {
+	s = strings.TrimSpace(s)
+	end := 0
+	for end < len(s) && (s[end] >= '0' && s[end] <= '9' || end == 0 && s[end] == '-') {
+		end++
+	}
+	n, _ := strconv.Atoi(s[:end])
+	return n
+}
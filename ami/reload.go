@@ -0,0 +1,59 @@
+package ami
+
+import "time"
+
+// Config is how to reach and log into the manager interface.
+type Config struct {
+	Addr     string
+	Username string
+	Secret   string
+	Timeout  time.Duration
+}
+
+// Connect dials the manager interface and logs in.
+func (c Config) Connect() (*Client, error) {
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	client, err := Dial(c.Addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	err = client.Login(c.Username, c.Secret)
+	if err != nil {
+		_ = client.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+// Reloader applies configuration changes by reloading chan_dongle over the
+// manager interface. It satisfies asterisk.Reloader.
+type Reloader struct {
+	Config
+
+	// When is passed to DongleReload, it defaults to WhenConvenient.
+	When string
+
+	// Dialplan is set when extensions.conf changed too, the dialplan is then
+	// reloaded after chan_dongle.
+	Dialplan bool
+}
+
+// Reload connects to asterisk, reloads chan_dongle and logs off.
+func (r *Reloader) Reload() error {
+	c, err := r.Connect()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = c.Close() }()
+	err = c.DongleReload(r.When)
+	if err != nil {
+		return err
+	}
+	if r.Dialplan {
+		_, err = c.Command("dialplan reload")
+	}
+	return err
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/FarmRadioHangar/fessboxconfig/asterisk"
+	"github.com/FarmRadioHangar/fessboxconfig/audit"
+	"github.com/FarmRadioHangar/fessboxconfig/auth"
+	"github.com/FarmRadioHangar/fessboxconfig/balance"
+	"github.com/FarmRadioHangar/fessboxconfig/device"
+	"github.com/FarmRadioHangar/fessboxconfig/history"
+	"github.com/FarmRadioHangar/fessboxconfig/systemd"
+)
+
+// shutdownTimeout is how long in flight requests are given to finish when the
+// server is stopped.
+const shutdownTimeout = 10 * time.Second
+
+// app holds the running parts of fconf so that they can be restarted when the
+// configuration file is reloaded.
+//
+// The methods are not safe to use concurrently, they are meant to be called
+// from the main goroutine which handles the signals.
+type app struct {
+	loader   *configLoader
+	devDir   string
+	users    *auth.Store
+	audit    *audit.Log
+	history  *history.Store
+	balances *balances
+	cfg      *Config
+	manager  *device.Manager
+	srv      *http.Server
+	stats    *stats
+
+	// stopBalances stops the balance checks of the running configuration.
+	stopBalances chan struct{}
+
+	// cfgMu guards cfg for the hooks of the device manager which run in its
+	// own goroutine.
+	cfgMu sync.Mutex
+
+	// errs receives the errors of the http servers.
+	errs chan error
+}
+
+func newApp(loader *configLoader, devDir string, users *auth.Store, auditLog *audit.Log, hist *history.Store, bal *balance.Store) *app {
+	return &app{
+		loader:   loader,
+		devDir:   devDir,
+		users:    users,
+		audit:    auditLog,
+		history:  hist,
+		balances: newBalances(bal),
+		stats:    newStats(),
+		errs:     make(chan error, 4),
+	}
+}
+
+// start starts the device manager if autodetect is on, and serves the api on
+// the listeners in cfg. In dev mode the manager always runs with virtual
+// modems, which are kept across reloads. The balance checks of cfg run with
+// the manager.
+func (a *app) start(cfg *Config) error {
+	switch {
+	case a.devDir != "" && a.manager == nil:
+		a.manager = a.newManager(cfg)
+		a.manager.InitVirtual(virtualModems(cfg))
+	case a.devDir != "":
+	case cfg.Autodetect && a.manager == nil:
+		a.manager = a.newManager(cfg)
+		a.manager.Init()
+	case !cfg.Autodetect && a.manager != nil:
+		a.manager.Close()
+		a.manager = nil
+	}
+	a.stats.setManager(a.manager)
+	a.balanceChecks(cfg)
+	err := ensureCert(cfg)
+	if err != nil {
+		return err
+	}
+	ls, err := listeners(cfg)
+	if err != nil {
+		return err
+	}
+	s := newServer(cfg, a.users, a.audit, a.history, a.balances, a.manager, a.stats)
+	srv := &http.Server{Handler: s}
+	a.cfgMu.Lock()
+	a.cfg, a.srv = cfg, srv
+	a.cfgMu.Unlock()
+	for _, l := range ls {
+		go func(cfg *Config, l net.Listener) {
+			err := serveListener(cfg, srv, l)
+			if err != nil && err != http.ErrServerClosed {
+				a.errs <- err
+			}
+		}(cfg, l)
+	}
+	return nil
+}
+
+// deviceActions are the audit actions of the changes reported by the device
+// manager.
+var deviceActions = map[string]string{
+	"add":    audit.DeviceAdd,
+	"remove": audit.DeviceRemove,
+}
+
+// newManager returns a device manager which records the devices that come and
+// go in the audit log and refreshes the modems as often as cfg says, keeping
+// each refresh in the history.
+//
+// When systemd has the watchdog enabled the manager's udev goroutine feeds it,
+// so a stuck monitor gets fconf restarted.
+func (a *app) newManager(cfg *Config) *device.Manager {
+	m := device.New()
+	m.RefreshInterval = time.Duration(cfg.ModemRefresh) * time.Second
+	if d, ok := systemd.WatchdogInterval(); ok {
+		m.HeartbeatInterval = d
+		m.Heartbeat = func() { notify(systemd.Watchdog) }
+	}
+	m.OnRefresh = a.sample
+	m.OnChange = func(action, target, summary string) {
+		err := a.audit.Record(audit.Entry{
+			User:   "system",
+			Source: "udev",
+			Action: deviceActions[action],
+			Target: target,
+			After:  summary,
+		})
+		if err != nil {
+			log.Println(err)
+		}
+		// the modems found while the manager starts are not adopted, the
+		// config is only set once the server is up.
+		if cfg := a.config(); action == "add" && cfg != nil && cfg.AutoAdopt {
+			go a.autoAdopt(cfg, m, target)
+		}
+	}
+	return m
+}
+
+// sample records the state of a modem that was just refreshed in the history.
+func (a *app) sample(mod device.Modem) {
+	if a.history == nil {
+		return
+	}
+	err := a.history.Record(history.Sample{
+		Time:             mod.Updated,
+		IMEI:             mod.IMEI,
+		Signal:           mod.Signal,
+		DBM:              mod.DBM,
+		Registration:     mod.Registration,
+		GPRSRegistration: mod.GPRSRegistration,
+	})
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// balanceChecks stops the balance checks that are running and starts the ones
+// of cfg.
+func (a *app) balanceChecks(cfg *Config) {
+	if a.stopBalances != nil {
+		close(a.stopBalances)
+		a.stopBalances = nil
+	}
+	if a.manager == nil || len(cfg.BalanceChecks) == 0 {
+		return
+	}
+	a.stopBalances = make(chan struct{})
+	go a.balances.loop(a.manager, cfg, a.stopBalances)
+}
+
+// config returns the configuration the app is running with.
+func (a *app) config() *Config {
+	a.cfgMu.Lock()
+	defer a.cfgMu.Unlock()
+	return a.cfg
+}
+
+// autoAdopt adds a dongle.conf section for a modem that was just plugged in if
+// it has none yet.
+func (a *app) autoAdopt(cfg *Config, m *device.Manager, imei string) {
+	mod, ok := findModem(m, imei)
+	if !ok {
+		return
+	}
+	r := reloaderFor(cfg, cfg.ReloadWhen, []string{asterisk.DongleConf})
+	res, err := adopt(cfg, mod, adoptRequest{}, r, verifierFor(cfg))
+	if err == asterisk.ErrAdopted {
+		return
+	}
+	if err != nil {
+		log.Printf("adopting %s: %v\n", imei, err)
+	}
+	if res != nil && res.after != nil {
+		recordAdoptionTo(a.audit, "system", "udev", res, err)
+	}
+}
+
+// reload builds the configuration again, reads the users again and restarts
+// the server with them. The device manager is kept running unless autodetect
+// was switched off. If the new configuration can not be started the old one
+// is restored.
+func (a *app) reload() error {
+	cfg, _, err := a.loader.load()
+	if err != nil {
+		return err
+	}
+	err = a.users.Reload(cfg.UsersFile)
+	if err != nil {
+		return err
+	}
+	if a.devDir != "" {
+		devConfig(cfg, a.devDir)
+	}
+	old := a.cfg
+	a.stopServer()
+	err = a.start(cfg)
+	if err != nil {
+		log.Printf("reload failed, restoring the previous configuration: %v\n", err)
+		if rerr := a.start(old); rerr != nil {
+			return rerr
+		}
+	}
+	return err
+}
+
+// stopServer stops accepting connections and waits for the in flight requests
+// to complete.
+func (a *app) stopServer() {
+	if a.srv == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	err := a.srv.Shutdown(ctx)
+	if err != nil {
+		log.Println(err)
+	}
+	a.srv = nil
+}
+
+// shutdown drains the http server, then closes the device manager which closes
+// the websocket clients and releases the serial ports.
+func (a *app) shutdown() {
+	a.stopServer()
+	a.balanceChecks(&Config{})
+	if a.manager != nil {
+		a.manager.Close()
+		a.manager = nil
+	}
+	err := a.audit.Close()
+	if err != nil {
+		log.Println(err)
+	}
+	if a.history != nil {
+		err = a.history.Close()
+		if err != nil {
+			log.Println(err)
+		}
+	}
+	if a.balances.store != nil {
+		err = a.balances.store.Close()
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// watchdog feeds the systemd watchdog when there is no device manager to do it.
+func (a *app) watchdog() {
+	if a.manager == nil {
+		notify(systemd.Watchdog)
+	}
+}
+
+// notify tells systemd about the state of fconf.
+func notify(state string) {
+	_, err := systemd.Notify(state)
+	if err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,111 @@
+package asterisk
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// DefaultPattern is the name given to adopted devices when no pattern is set.
+const DefaultPattern = "dongle{n}"
+
+// ErrAdopted is returned by Adopt when dongle.conf already has a device for
+// the modem.
+var ErrAdopted = errors.New("the modem already has a device section")
+
+// Adoption describes the device section created for a modem.
+type Adoption struct {
+	IMEI string
+	IMSI string
+
+	// Name is the name of the section. When it is empty the name is made
+	// from Pattern where {imei} and {imsi} are replaced by the identities of
+	// the modem and {n} by the lowest number that gives a name not used yet.
+	Name    string
+	Pattern string
+
+	// Context and Group are only set when they are not empty.
+	Context string
+	Group   string
+}
+
+// Adopt adds a device section for the modem to the dongle.conf src and returns
+// the new content with the name of the section. The section is appended as
+// text so the comments and the layout of src are kept.
+func Adopt(src []byte, a Adoption) ([]byte, string, error) {
+	if len(a.IMEI) != 15 || !isNumber(a.IMEI) {
+		return nil, "", fmt.Errorf("imei must be 15 digits got %q", a.IMEI)
+	}
+	if a.IMSI != "" && (len(a.IMSI) != 15 || !isNumber(a.IMSI)) {
+		return nil, "", fmt.Errorf("imsi must be 15 digits got %q", a.IMSI)
+	}
+	d, err := parse(src)
+	if err != nil {
+		return nil, "", err
+	}
+	used := make(map[string]bool)
+	for _, sec := range d.Sections() {
+		used[sec.Name()] = true
+		if dongleReserved[sec.Name()] {
+			continue
+		}
+		if v, err := sec.Get("imei"); err == nil && v == a.IMEI {
+			return nil, sec.Name(), ErrAdopted
+		}
+	}
+	name := a.Name
+	if name == "" {
+		name = sectionName(a, used)
+	}
+	if !validSectionName(name) {
+		return nil, "", fmt.Errorf("bad section name %q", name)
+	}
+	if used[name] || dongleReserved[name] {
+		return nil, "", fmt.Errorf("section [%s] already exists", name)
+	}
+	values := [][2]string{{"imei", a.IMEI}}
+	if a.IMSI != "" {
+		values = append(values, [2]string{"imsi", a.IMSI})
+	}
+	for _, v := range [][2]string{{"context", a.Context}, {"group", a.Group}} {
+		if !validValue(v[1]) {
+			return nil, "", fmt.Errorf("bad %s %q", v[0], v[1])
+		}
+	}
+	if a.Context != "" {
+		values = append(values, [2]string{"context", a.Context})
+	}
+	if a.Group != "" {
+		values = append(values, [2]string{"group", a.Group})
+	}
+	return AddSection(src, name, values), name, nil
+}
+
+func sectionName(a Adoption, used map[string]bool) string {
+	pattern := a.Pattern
+	if pattern == "" {
+		pattern = DefaultPattern
+	}
+	name := strings.Replace(pattern, "{imei}", a.IMEI, -1)
+	name = strings.Replace(name, "{imsi}", a.IMSI, -1)
+	if !strings.Contains(name, "{n}") {
+		return name
+	}
+	for n := 1; ; n++ {
+		v := strings.Replace(name, "{n}", strconv.Itoa(n), -1)
+		if !used[v] {
+			return v
+		}
+	}
+}
+
+func validSectionName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, "[]=;\r\n\t ")
+}
+
+// validValue reports whether v can be written as a value without starting a
+// new line, a section or a comment.
+func validValue(v string) bool {
+	return !strings.ContainsAny(v, "[];\r\n")
+}
@@ -0,0 +1,69 @@
+package asterisk
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestAdopt(t *testing.T) {
+	src, err := ioutil.ReadFile("../sample/dongle.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := Adoption{IMEI: "356789012345678", IMSI: "640050123456789", Context: "from-trunk", Group: "1"}
+	out, name, err := Adopt(src, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "dongle1" {
+		t.Errorf("expected dongle1 got %s", name)
+	}
+	if !strings.HasPrefix(string(out), string(src)) {
+		t.Error("expected the original content to be kept")
+	}
+	d, err := parse(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sec, err := d.Section(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range map[string]string{"imei": a.IMEI, "imsi": a.IMSI, "context": "from-trunk", "group": "1"} {
+		if got, _ := sec.Get(k); got != v {
+			t.Errorf("%s: expected %s got %s", k, v, got)
+		}
+	}
+
+	if _, name, err := Adopt(out, a); err != ErrAdopted || name != "dongle1" {
+		t.Errorf("expected the modem to be adopted already got %s %v", name, err)
+	}
+	a.IMEI = "356789012345679"
+	_, name, err = Adopt(out, a)
+	if err != nil || name != "dongle2" {
+		t.Errorf("expected dongle2 got %s %v", name, err)
+	}
+	a.Pattern = "modem-{imei}"
+	_, name, _ = Adopt(out, a)
+	if name != "modem-356789012345679" {
+		t.Errorf("unexpected name %s", name)
+	}
+	a.Name = "dongle1"
+	if _, _, err := Adopt(out, a); err == nil {
+		t.Error("expected a used name to fail")
+	}
+	a.Name = "bad name"
+	if _, _, err := Adopt(out, a); err == nil {
+		t.Error("expected a bad name to fail")
+	}
+	a.Name = ""
+	for _, v := range []string{"from-trunk\n[general]", "from-trunk\rinitstate=stop", "from-trunk ; x"} {
+		if _, _, err := Adopt(out, Adoption{IMEI: a.IMEI, Context: v}); err == nil {
+			t.Errorf("expected context %q to fail", v)
+		}
+		if _, _, err := Adopt(out, Adoption{IMEI: a.IMEI, Group: v}); err == nil {
+			t.Errorf("expected group %q to fail", v)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package asterisk
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+)
+
+// locks are the locks of the configuration directories, by clean path.
+var (
+	locksMu sync.Mutex
+	locks   = make(map[string]*sync.Mutex)
+)
+
+// Lock takes the lock of the configuration files in dir and returns the
+// function releasing it. Every writer holds it across reading the files,
+// changing them, applying the change and rolling it back.
+//
+// Besides the lock shared by the goroutines of the process, the directory is
+// locked with flock so the fconf commands exclude the server too. When dir can
+// not be opened only the first one is taken, writing to it fails anyway.
+func Lock(dir string) (unlock func()) {
+	dir = filepath.Clean(dir)
+	locksMu.Lock()
+	mu, ok := locks[dir]
+	if !ok {
+		mu = &sync.Mutex{}
+		locks[dir] = mu
+	}
+	locksMu.Unlock()
+	mu.Lock()
+	f, err := os.Open(dir)
+	if err != nil {
+		return mu.Unlock
+	}
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		_ = f.Close()
+		return mu.Unlock
+	}
+	return func() {
+		// closing the last descriptor of the directory drops the flock
+		_ = f.Close()
+		mu.Unlock()
+	}
+}
+
+// ErrRolledBack is returned by Apply when the devices did not come back after
+// the reload and the previous files were put back.
+var ErrRolledBack = errors.New("the devices did not come back, the previous configuration was restored")
+
+// Verifier checks the chan_dongle devices after a reload.
+type Verifier interface {
+	// Before returns the state of the named devices before the reload.
+	Before(devices []string) []DeviceState
+
+	// Verify waits for the devices to have restarted and to be working, or
+	// gives up, and returns the state of each of them. before is what Before
+	// returned.
+	Verify(before []DeviceState) []DeviceState
+}
+
+// DeviceState is the state of a device after a reload. Pending is true for a
+// device that is OK only because its restart is still waiting for a call to
+// end, its new settings are not verified.
+type DeviceState struct {
+	Device  string `json:"device"`
+	State   string `json:"state"`
+	OK      bool   `json:"ok"`
+	Pending bool   `json:"pending,omitempty"`
+}
+
+// Report describes what happened when a changeset was applied.
+type Report struct {
+	Files []string `json:"files"`
+
+	// Devices are the devices that were added or changed, with the state
+	// they reached. It is empty when there was nothing to verify.
+	Devices []DeviceState `json:"devices"`
+
+	// Verified is true when the devices were checked after the reload.
+	Verified   bool   `json:"verified"`
+	RolledBack bool   `json:"rolled_back"`
+	Error      string `json:"error,omitempty"`
+}
+
+// Apply validates and writes the changeset, reloads asterisk with r and then
+// uses v to wait for the devices that were added or changed in dongle.conf to
+// come back. If the reload fails or a device does not come back, the previous
+// files are restored, asterisk is reloaded again and ErrRolledBack is
+// returned. The changeset stays open after a rollback so it can be fixed and
+// applied again.
+//
+// The caller holds Lock for the directory of the changeset from the time it
+// read the files it changed, so the files put back by a rollback are never
+// older than a write made in the meantime.
+//
+// r and v can be nil, the devices are not verified without v.
+func (c *Changeset) Apply(r Reloader, v Verifier) (*Report, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	report := &Report{Files: sortedKeys(c.files)}
+	fail := func(err error) (*Report, error) {
+		report.Error = err.Error()
+		return report, err
+	}
+	if c.done {
+		return fail(fmt.Errorf("changeset %s is already closed", c.ID))
+	}
+	if err := c.validate(); err != nil {
+		return fail(err)
+	}
+	devices, err := c.changedDevices()
+	if err != nil {
+		return fail(err)
+	}
+	old, err := c.write()
+	if err != nil {
+		return fail(err)
+	}
+	if r == nil {
+		c.done = true
+		return report, nil
+	}
+	verify := v != nil && len(devices) > 0
+	var before []DeviceState
+	if verify {
+		before = v.Before(devices)
+	}
+	err = r.Reload()
+	if err == nil && verify {
+		report.Verified = true
+		report.Devices = v.Verify(before)
+		for _, d := range report.Devices {
+			if !d.OK {
+				err = ErrRolledBack
+			}
+		}
+	}
+	if err == nil {
+		c.done = true
+		return report, nil
+	}
+	report.RolledBack = true
+	if rerr := c.restore(report.Files, old); rerr != nil {
+		return fail(fmt.Errorf("%v, restoring the previous files failed: %v", err, rerr))
+	}
+	if rerr := r.Reload(); rerr != nil {
+		return fail(fmt.Errorf("%v, reloading the previous files failed: %v", err, rerr))
+	}
+	if err != ErrRolledBack {
+		err = fmt.Errorf("%v, the previous configuration was restored", err)
+	}
+	return fail(err)
+}
+
+// changedDevices returns the devices in the staged dongle.conf that were added
+// or whose settings are different from the file on disk.
+func (c *Changeset) changedDevices() ([]string, error) {
+	staged, ok := c.files[DongleConf]
+	if !ok {
+		return nil, nil
+	}
+	after, err := parse(staged)
+	if err != nil {
+		return nil, err
+	}
+	nu := settings(after)
+	old := make(map[string]map[string]string)
+	if src, ok, err := c.current(DongleConf); err != nil {
+		return nil, err
+	} else if ok {
+		if before, err := parse(src); err == nil {
+			old = settings(before)
+		}
+	}
+	// a change to the defaults or the general settings affects every device
+	all := false
+	for name := range dongleReserved {
+		all = all || !sameSettings(old[name], nu[name]) && (old[name] != nil || nu[name] != nil)
+	}
+	var devices []string
+	for _, name := range sortedNames(nu) {
+		if dongleReserved[name] {
+			continue
+		}
+		if state := nu[name]["initstate"]; state == "stop" || state == "remove" {
+			// stopped devices are not expected to come back
+			continue
+		}
+		if all || !sameSettings(old[name], nu[name]) {
+			devices = append(devices, name)
+		}
+	}
+	return devices, nil
+}
+
+// current returns the content of the file name as it is on disk.
+func (c *Changeset) current(name string) ([]byte, bool, error) {
+	b, err := ioutil.ReadFile(filepath.Join(c.dir, name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	return b, true, nil
+}
+
+func sameSettings(a, b map[string]string) bool {
+	if a == nil || len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || w != v {
+			return false
+		}
+	}
+	return true
+}
+
+func sortedNames(m map[string]map[string]string) []string {
+	return union(names(m), nil)
+}
@@ -0,0 +1,179 @@
+package asterisk
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fakeVerifier reports the devices in down as not connected.
+type fakeVerifier struct {
+	down  map[string]bool
+	asked [][]string
+}
+
+func (f *fakeVerifier) Before(devices []string) []DeviceState {
+	states := make([]DeviceState, len(devices))
+	for i, d := range devices {
+		states[i] = DeviceState{Device: d, State: "Free", OK: true}
+	}
+	return states
+}
+
+func (f *fakeVerifier) Verify(before []DeviceState) []DeviceState {
+	var devices []string
+	for _, d := range before {
+		devices = append(devices, d.Device)
+	}
+	f.asked = append(f.asked, devices)
+	var states []DeviceState
+	for _, d := range devices {
+		if f.down[d] {
+			states = append(states, DeviceState{Device: d, State: "Not connected"})
+			continue
+		}
+		states = append(states, DeviceState{Device: d, State: "Free", OK: true})
+	}
+	return states
+}
+
+func TestApply(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fconf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	fName := filepath.Join(dir, DongleConf)
+	err = ioutil.WriteFile(fName, []byte(sampleDongle), 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// tigo1 is new and does not come back, airtel1 is untouched
+	changed := sampleDongle + "[tigo1]\nimei=353220047976426\n\n"
+	c := NewChangeset(dir)
+	_ = c.StageRaw(DongleConf, []byte(changed))
+	var r countReloader
+	v := &fakeVerifier{down: map[string]bool{"tigo1": true}}
+	report, err := c.Apply(&r, v)
+	if err != ErrRolledBack {
+		t.Fatalf("expected a rollback got %v", err)
+	}
+	if !report.RolledBack || !report.Verified || len(report.Devices) != 1 || report.Devices[0].Device != "tigo1" {
+		t.Errorf("unexpected report %+v", report)
+	}
+	if r != 2 {
+		t.Errorf("expected the previous files to be reloaded got %d reloads", r)
+	}
+	b, _ := ioutil.ReadFile(fName)
+	if string(b) != sampleDongle {
+		t.Errorf("expected the previous file to be restored got %q", b)
+	}
+	if info, _ := os.Stat(fName); info.Mode() != 0640 {
+		t.Errorf("expected the mode to be kept got %v", info.Mode())
+	}
+	if c.Closed() {
+		t.Error("expected the changeset to stay open after a rollback")
+	}
+
+	v.down = nil
+	report, err = c.Apply(&r, v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.RolledBack || !report.Devices[0].OK {
+		t.Errorf("unexpected report %+v", report)
+	}
+	b, _ = ioutil.ReadFile(fName)
+	if string(b) != changed {
+		t.Errorf("expected the new file got %q", b)
+	}
+
+	// changing the defaults affects every device
+	c = NewChangeset(dir)
+	_ = c.StageRaw(DongleConf, []byte("[defaults]\ngroup=1\n\n"+changed))
+	report, err = c.Apply(&r, v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Devices) != 2 {
+		t.Errorf("expected both devices to be verified got %+v", report.Devices)
+	}
+}
+
+type failReloader struct{ calls int }
+
+func (f *failReloader) Reload() error {
+	f.calls++
+	if f.calls == 1 {
+		return os.ErrPermission
+	}
+	return nil
+}
+
+func TestApplyReloadFails(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fconf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	c := NewChangeset(dir)
+	_ = c.StageRaw(DongleConf, []byte(sampleDongle))
+	r := &failReloader{}
+	report, err := c.Apply(r, nil)
+	if err == nil || !strings.Contains(err.Error(), "restored") {
+		t.Fatalf("expected a rollback got %v", err)
+	}
+	if !report.RolledBack || r.calls != 2 {
+		t.Errorf("unexpected report %+v after %d reloads", report, r.calls)
+	}
+	if _, err := os.Stat(filepath.Join(dir, DongleConf)); !os.IsNotExist(err) {
+		t.Error("expected the new file to be removed")
+	}
+}
+
+func TestLock(t *testing.T) {
+	unlock := Lock("/etc/asterisk")
+	done := make(chan struct{})
+	go func() {
+		defer Lock("/etc/asterisk/")()
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("expected the second writer to wait for the lock")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected the second writer to get the lock")
+	}
+	// another directory has its own lock
+	Lock("/tmp/asterisk")()
+
+	// other processes are kept out with flock
+	dir, err := ioutil.TempDir("", "fconf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	f, err := os.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = f.Close() }()
+	unlock = Lock(dir)
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != syscall.EWOULDBLOCK {
+		t.Errorf("expected the directory to be locked got %v", err)
+	}
+	unlock()
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		t.Errorf("expected the directory to be unlocked got %v", err)
+	}
+}
@@ -0,0 +1,582 @@
+// Package asterisk manages the asterisk configuration files that fconf is
+// allowed to touch.
+//
+// Changes that span several files( for instance dongle.conf and
+// extensions.conf) are staged in a Changeset, validated together and then
+// written to disk in one go followed by a single reload of asterisk.
+package asterisk
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/FarmRadioHangar/fessboxconfig/parser"
+)
+
+// The configuration files that are checked against each other when validating
+// a changeset.
+const (
+	DongleConf     = "dongle.conf"
+	ExtensionsConf = "extensions.conf"
+)
+
+// sections in dongle.conf that are not device definitions.
+var dongleReserved = map[string]bool{
+	"main":     true,
+	"general":  true,
+	"defaults": true,
+}
+
+// Reloader tells asterisk to pick up the changes written to the configuration
+// files.
+type Reloader interface {
+	Reload() error
+}
+
+// CommandReloader reloads asterisk by running a shell command, for instance
+//
+//	asterisk -rx "dongle reload when convenient"
+type CommandReloader string
+
+// Reload runs the command, the output of the command is included in the error
+// if it fails.
+func (c CommandReloader) Reload() error {
+	if c == "" {
+		return nil
+	}
+	out, err := exec.Command("sh", "-c", string(c)).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("reload %q: %v %s", string(c), err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// ValidationError is returned when the staged files are not consistent. It
+// holds all the problems found so they can be reported at once.
+type ValidationError struct {
+	Problems []string `json:"problems"`
+}
+
+func (v *ValidationError) Error() string {
+	return "invalid configuration: " + strings.Join(v.Problems, "; ")
+}
+
+// Changeset is a set of edits to files in the asterisk configuration directory
+// that are applied together.
+//
+// Nothing is written to disk until Commit is called. It is safe to use in
+// multiple goroutines.
+type Changeset struct {
+	ID      string    `json:"id"`
+	Created time.Time `json:"created"`
+	dir     string
+	mu      sync.Mutex
+	files   map[string][]byte
+	done    bool
+}
+
+// NewChangeset returns an empty changeset for the configuration files in dir.
+func NewChangeset(dir string) *Changeset {
+	return &Changeset{
+		ID:      newID(),
+		Created: time.Now(),
+		dir:     dir,
+		files:   make(map[string][]byte),
+	}
+}
+
+func newID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Stage adds the file name with the content of a to the changeset. Staging the
+// same file twice replaces the earlier content.
+func (c *Changeset) Stage(name string, a *parser.Ast) error {
+	buf := &bytes.Buffer{}
+	parser.PrintAst(buf, a)
+	return c.StageRaw(name, buf.Bytes())
+}
+
+// StageRaw is like Stage but takes the file content as it will be written to
+// disk.
+func (c *Changeset) StageRaw(name string, src []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.done {
+		return fmt.Errorf("changeset %s is already closed", c.ID)
+	}
+	if name != filepath.Base(name) {
+		return fmt.Errorf("bad file name %s", name)
+	}
+	c.files[name] = src
+	return nil
+}
+
+// Files returns the names of the staged files.
+func (c *Changeset) Files() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var names []string
+	for k := range c.files {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Staged returns the content staged for the file name.
+func (c *Changeset) Staged(name string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b, ok := c.files[name]
+	return b, ok
+}
+
+// content returns the content of the file name as it would be after the
+// changeset is committed. ok is false if the file does not exist at all.
+func (c *Changeset) content(name string) (src []byte, ok bool, err error) {
+	if b, staged := c.files[name]; staged {
+		return b, true, nil
+	}
+	b, err := ioutil.ReadFile(filepath.Join(c.dir, name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	return b, true, nil
+}
+
+// Validate checks that every staged file parses and that the files are
+// consistent with each other. A *ValidationError is returned if there is any
+// problem.
+func (c *Changeset) Validate() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.validate()
+}
+
+func (c *Changeset) validate() error {
+	v := &ValidationError{}
+	for _, name := range sortedKeys(c.files) {
+		if name == ExtensionsConf {
+			// extensions.conf has dialplan syntax which the parser does not
+			// understand yet.
+			v.Problems = append(v.Problems, checkDialplan(c.files[name])...)
+			continue
+		}
+		if _, err := parse(c.files[name]); err != nil {
+			v.Problems = append(v.Problems, fmt.Sprintf("%s: %v", name, err))
+		}
+	}
+	if len(v.Problems) > 0 {
+		return v
+	}
+	dongle, ok, err := c.content(DongleConf)
+	if err != nil {
+		return err
+	}
+	if ok {
+		d, err := parse(dongle)
+		if err != nil {
+			v.Problems = append(v.Problems, fmt.Sprintf("%s: %v", DongleConf, err))
+			return v
+		}
+		v.Problems = append(v.Problems, checkDongle(d)...)
+		ext, ok, err := c.content(ExtensionsConf)
+		if err != nil {
+			return err
+		}
+		if ok {
+			v.Problems = append(v.Problems, checkContexts(d, Contexts(ext))...)
+		}
+	}
+	if len(v.Problems) > 0 {
+		return v
+	}
+	return nil
+}
+
+// Commit validates the changeset and writes all the staged files. Once every
+// file is in place r is used to reload asterisk, r can be nil. If the reload
+// fails the previous files are restored and asterisk is reloaded again, the
+// changeset then stays open.
+//
+// The new files are first written next to the old ones and then renamed over
+// them. If any rename fails the files that were already replaced are restored,
+// so either all the files are changed or none is. Commit holds Lock for the
+// directory while it writes.
+func (c *Changeset) Commit(r Reloader) error {
+	defer Lock(c.dir)()
+	_, err := c.Apply(r, nil)
+	return err
+}
+
+// backup is the content and mode of the files replaced by a commit.
+type backup struct {
+	content map[string][]byte
+	mode    map[string]os.FileMode
+}
+
+// write puts all the staged files in place and returns what they replaced.
+func (c *Changeset) write() (*backup, error) {
+	names := sortedKeys(c.files)
+	old := &backup{content: make(map[string][]byte), mode: make(map[string]os.FileMode)}
+	var tmps []string
+	defer func() {
+		for _, t := range tmps {
+			_ = os.Remove(t)
+		}
+	}()
+	for _, name := range names {
+		fName := filepath.Join(c.dir, name)
+		mode := os.FileMode(0644)
+		if info, err := os.Stat(fName); err == nil {
+			mode = info.Mode()
+			b, err := ioutil.ReadFile(fName)
+			if err != nil {
+				return nil, err
+			}
+			old.content[name] = b
+			old.mode[name] = mode
+		}
+		tmp, err := writeTemp(c.dir, name, c.files[name], mode)
+		if err != nil {
+			return nil, err
+		}
+		tmps = append(tmps, tmp)
+	}
+	for i, name := range names {
+		err := os.Rename(tmps[i], filepath.Join(c.dir, name))
+		if err != nil {
+			_ = c.restore(names[:i], old)
+			return nil, err
+		}
+	}
+	return old, nil
+}
+
+// restore puts back the original content of files that were replaced by a
+// commit. Files that did not exist before are removed.
+func (c *Changeset) restore(names []string, old *backup) error {
+	var first error
+	for _, name := range names {
+		fName := filepath.Join(c.dir, name)
+		b, ok := old.content[name]
+		if !ok {
+			if err := os.Remove(fName); err != nil && first == nil {
+				first = err
+			}
+			continue
+		}
+		tmp, err := writeTemp(c.dir, name, b, old.mode[name])
+		if err == nil {
+			err = os.Rename(tmp, fName)
+		}
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// Discard drops all the staged files, the changeset can not be used after this.
+func (c *Changeset) Discard() {
+	c.mu.Lock()
+	c.files = make(map[string][]byte)
+	c.done = true
+	c.mu.Unlock()
+}
+
+// Closed returns true if the changeset was committed or discarded.
+func (c *Changeset) Closed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.done
+}
+
+// writeTemp writes src to a temporary file in dir and syncs it to disk.
+func writeTemp(dir, name string, src []byte, mode os.FileMode) (string, error) {
+	f, err := ioutil.TempFile(dir, "."+name+".")
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Write(src)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = f.Chmod(mode)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+func parse(src []byte) (*parser.Ast, error) {
+	p, err := parser.NewParser(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	return p.Parse()
+}
+
+// checkDongle makes sure every device in dongle.conf can be identified and that
+// no two devices claim the same modem or sim card.
+func checkDongle(a *parser.Ast) []string {
+	var problems []string
+	seen := make(map[string]string)
+	for _, sec := range a.Sections() {
+		name := sec.Name()
+		if dongleReserved[name] {
+			continue
+		}
+		found := false
+		for _, key := range []string{"imei", "imsi", "data"} {
+			value, err := sec.Get(key)
+			if err != nil {
+				continue
+			}
+			found = true
+			if key != "data" && (len(value) != 15 || !isNumber(value)) {
+				problems = append(problems, fmt.Sprintf("%s: [%s] %s must be 15 digits got %q", DongleConf, name, key, value))
+			}
+			id := key + "=" + value
+			if other, ok := seen[id]; ok {
+				problems = append(problems, fmt.Sprintf("%s: [%s] and [%s] have the same %s", DongleConf, other, name, id))
+				continue
+			}
+			seen[id] = name
+		}
+		if !found {
+			problems = append(problems, fmt.Sprintf("%s: [%s] has no imei, imsi or data", DongleConf, name))
+		}
+	}
+	return problems
+}
+
+// checkDialplan makes sure every line of extensions.conf is a context, an
+// include or a key => value setting inside a context, and that the extensions
+// have a priority and an application with balanced parentheses.
+func checkDialplan(src []byte) []string {
+	var problems []string
+	bad := func(n int, format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf("%s: line %d: ", ExtensionsConf, n)+fmt.Sprintf(format, args...))
+	}
+	s := bufio.NewScanner(bytes.NewReader(src))
+	context, exten := "", false
+	for n := 1; s.Scan(); n++ {
+		line := s.Text()
+		if i := strings.IndexRune(line, ';'); i != -1 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "", strings.HasPrefix(line, "#include"), strings.HasPrefix(line, "#exec"):
+			continue
+		case strings.HasPrefix(line, "["):
+			end := strings.IndexRune(line, ']')
+			if end == -1 || strings.TrimSpace(line[1:end]) == "" {
+				bad(n, "bad context %s", line)
+				continue
+			}
+			context, exten = strings.TrimSpace(line[1:end]), false
+			continue
+		case context == "":
+			bad(n, "%s is outside of a context", line)
+			continue
+		}
+		i := strings.IndexRune(line, '=')
+		if i < 1 {
+			bad(n, "expected key => value got %s", line)
+			continue
+		}
+		key := strings.ToLower(strings.TrimSpace(line[:i]))
+		value := strings.TrimSpace(strings.TrimPrefix(line[i+1:], ">"))
+		fields := 3
+		switch key {
+		case "exten":
+			exten = true
+		case "same":
+			if !exten {
+				bad(n, "same in [%s] comes before any exten", context)
+				continue
+			}
+			fields = 2
+		default:
+			continue
+		}
+		f := strings.SplitN(value, ",", fields)
+		if len(f) < fields || strings.TrimSpace(f[fields-1]) == "" {
+			bad(n, "%s in [%s] has no priority or application", key, context)
+			continue
+		}
+		if strings.Count(value, "(") != strings.Count(value, ")") {
+			bad(n, "unbalanced parentheses in [%s] %s", context, value)
+		}
+	}
+	return problems
+}
+
+// checkContexts makes sure the contexts used in dongle.conf are defined in the
+// dialplan.
+func checkContexts(a *parser.Ast, contexts map[string]bool) []string {
+	var problems []string
+	for _, sec := range a.Sections() {
+		ctx, err := sec.Get("context")
+		if err != nil {
+			continue
+		}
+		if !contexts[ctx] {
+			problems = append(problems, fmt.Sprintf("%s: [%s] context %s is not defined in %s", DongleConf, sec.Name(), ctx, ExtensionsConf))
+		}
+	}
+	return problems
+}
+
+// Diff summarises the difference between two versions of a configuration file.
+// It returns the settings that changed as they were in before and as they are
+// in after, for instance
+//
+//	[airtel1] imei=353220047976425
+//	[airtel1] imei=354369047238739
+//
+// Sections that were added or removed are listed by name only. When a version
+// can not be parsed it is summarised by its size.
+func Diff(before, after []byte) (string, string) {
+	b, err := parse(before)
+	if err != nil {
+		return fmt.Sprintf("%d bytes (unparsed)", len(before)), fmt.Sprintf("%d bytes", len(after))
+	}
+	a, err := parse(after)
+	if err != nil {
+		return fmt.Sprintf("%d bytes", len(before)), fmt.Sprintf("%d bytes (unparsed)", len(after))
+	}
+	old, nu := settings(b), settings(a)
+	var was, is []string
+	for _, sec := range union(names(old), names(nu)) {
+		o, ok := old[sec]
+		if !ok {
+			is = append(is, fmt.Sprintf("[%s] added", sec))
+			continue
+		}
+		n, ok := nu[sec]
+		if !ok {
+			was = append(was, fmt.Sprintf("[%s] removed", sec))
+			continue
+		}
+		for _, key := range union(keySet(o), keySet(n)) {
+			if o[key] == n[key] {
+				continue
+			}
+			if v, ok := o[key]; ok {
+				was = append(was, fmt.Sprintf("[%s] %s=%s", sec, key, v))
+			}
+			if v, ok := n[key]; ok {
+				is = append(is, fmt.Sprintf("[%s] %s=%s", sec, key, v))
+			}
+		}
+	}
+	return strings.Join(was, ", "), strings.Join(is, ", ")
+}
+
+func settings(a *parser.Ast) map[string]map[string]string {
+	m := make(map[string]map[string]string)
+	for _, sec := range a.Sections() {
+		values := make(map[string]string)
+		for _, key := range sec.Keys() {
+			values[key], _ = sec.Get(key)
+		}
+		m[sec.Name()] = values
+	}
+	return m
+}
+
+func names(m map[string]map[string]string) map[string]bool {
+	set := make(map[string]bool)
+	for k := range m {
+		set[k] = true
+	}
+	return set
+}
+
+func keySet(m map[string]string) map[string]bool {
+	set := make(map[string]bool)
+	for k := range m {
+		set[k] = true
+	}
+	return set
+}
+
+func union(a, b map[string]bool) []string {
+	var keys []string
+	for k := range a {
+		keys = append(keys, k)
+	}
+	for k := range b {
+		if !a[k] {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Contexts returns the names of the contexts defined in the dialplan src.
+func Contexts(src []byte) map[string]bool {
+	ctx := make(map[string]bool)
+	s := bufio.NewScanner(bytes.NewReader(src))
+	for s.Scan() {
+		line := s.Text()
+		if i := strings.IndexRune(line, ';'); i != -1 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "[") {
+			continue
+		}
+		end := strings.IndexRune(line, ']')
+		if end == -1 {
+			continue
+		}
+		ctx[strings.TrimSpace(line[1:end])] = true
+	}
+	return ctx
+}
+
+func isNumber(src string) bool {
+	for _, v := range src {
+		if v < '0' || v > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func sortedKeys(m map[string][]byte) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
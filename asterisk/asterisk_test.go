@@ -0,0 +1,171 @@
+package asterisk
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const sampleDongle = `
+[airtel1]
+imei=353220047976425
+context=from-airtel
+
+`
+
+const sampleExtensions = `
+[from-airtel]
+exten => s,1,Answer()
+`
+
+type countReloader int
+
+func (c *countReloader) Reload() error {
+	*c++
+	return nil
+}
+
+func TestChangeset(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fconf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	c := NewChangeset(dir)
+	err = c.StageRaw(DongleConf, []byte(sampleDongle))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the context is not defined in the dialplan
+	err = c.StageRaw(ExtensionsConf, []byte("[from-tigo]\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Validate()
+	if _, ok := err.(*ValidationError); !ok {
+		t.Fatalf("expected validation error got %v", err)
+	}
+	var r countReloader
+	err = c.Commit(&r)
+	if err == nil {
+		t.Fatal("expected commit to fail")
+	}
+	if _, err := os.Stat(filepath.Join(dir, DongleConf)); !os.IsNotExist(err) {
+		t.Error("expected nothing to be written")
+	}
+
+	err = c.StageRaw(ExtensionsConf, []byte(sampleExtensions))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Commit(&r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r != 1 {
+		t.Errorf("expected 1 reload got %d", r)
+	}
+	for _, name := range []string{DongleConf, ExtensionsConf} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Error(err)
+		}
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Errorf("expected 2 files got %d", len(files))
+	}
+	if err := c.StageRaw(DongleConf, []byte(sampleDongle)); err == nil {
+		t.Error("expected staging on a committed changeset to fail")
+	}
+}
+
+func TestCheckDongle(t *testing.T) {
+	sample := []struct {
+		src    string
+		errors int
+	}{
+		{"\n[a]\nimei=353220047976425\n\n", 0},
+		{"\n[a]\nimei=3532200\n\n", 1},
+		{"\n[a]\ncontext=x\n\n", 1},
+		{"\n[a]\nimei=353220047976425\n\n\n[b]\nimei=353220047976425\n\n", 1},
+	}
+	for _, v := range sample {
+		a, err := parse([]byte(v.src))
+		if err != nil {
+			t.Fatal(err)
+		}
+		problems := checkDongle(a)
+		if len(problems) != v.errors {
+			t.Errorf("%q: expected %d problems got %v", v.src, v.errors, problems)
+		}
+	}
+}
+
+func TestCheckDialplan(t *testing.T) {
+	sample := []struct {
+		src    string
+		errors int
+	}{
+		{sampleExtensions, 0},
+		{"#include extensions_custom.conf\n[general]\nstatic=yes\n[a](!)\nexten => _X.,1,NoOp(${EXTEN})\n same => n(dial),Dial(Dongle/g1/${EXTEN}) ; out\n", 0},
+		{"exten => s,1,Answer()\n", 1},
+		{"[a\nexten => s,1,Answer()\n", 2},
+		{"[a]\nexten => s,1\n", 1},
+		{"[a]\nsame => n,Hangup()\n", 1},
+		{"[a]\nexten => s,1,Dial(Dongle/g1/1\n", 1},
+		{"[a]\nAnswer()\n", 1},
+	}
+	for _, v := range sample {
+		problems := checkDialplan([]byte(v.src))
+		if len(problems) != v.errors {
+			t.Errorf("%q: expected %d problems got %v", v.src, v.errors, problems)
+		}
+	}
+}
+
+func TestContexts(t *testing.T) {
+	src := `
+[general]
+static=yes
+; [commented]
+[from-trunk] ; incoming calls
+exten => s,1,Answer()
+`
+	ctx := Contexts([]byte(src))
+	for _, name := range []string{"general", "from-trunk"} {
+		if !ctx[name] {
+			t.Errorf("expected context %s", name)
+		}
+	}
+	if ctx["commented"] {
+		t.Error("commented out context should be ignored")
+	}
+	if !strings.Contains((&ValidationError{[]string{"a"}}).Error(), "a") {
+		t.Error("expected the problem in the error message")
+	}
+}
+
+func TestDiff(t *testing.T) {
+	before := "\n[airtel1]\nimei=353220047976425\n\n[tigo1]\nimei=352215045819420\n\n"
+	after := "\n[airtel1]\nimei=354369047238739\n\n[vodacom1]\nimei=354369047238580\n\n"
+	was, is := Diff([]byte(before), []byte(after))
+	expectWas := "[airtel1] imei=353220047976425, [tigo1] removed"
+	expectIs := "[airtel1] imei=354369047238739, [vodacom1] added"
+	if was != expectWas {
+		t.Errorf("expected %q got %q", expectWas, was)
+	}
+	if is != expectIs {
+		t.Errorf("expected %q got %q", expectIs, is)
+	}
+}
@@ -0,0 +1,85 @@
+package asterisk
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// The functions in this file change configuration files as text, unlike
+// parser.PrintAst they keep the comments and the layout of the file.
+
+// AddSection appends a section with the given key value pairs to src.
+func AddSection(src []byte, name string, values [][2]string) []byte {
+	buf := bytes.NewBuffer(append([]byte(nil), src...))
+	if len(src) > 0 && !bytes.HasSuffix(src, []byte("\n")) {
+		buf.WriteByte('\n')
+	}
+	if len(src) > 0 && !bytes.HasSuffix(src, []byte("\n\n")) {
+		buf.WriteByte('\n')
+	}
+	fmt.Fprintf(buf, "[%s]\n", name)
+	for _, kv := range values {
+		fmt.Fprintf(buf, "%s=%s\n", kv[0], kv[1])
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
+
+// SetValue sets key to value in the section of src. The line defining the key
+// is replaced, or a new line is added after the last setting of the section
+// when the key is not set yet. Commented out settings are left alone.
+func SetValue(src []byte, section, key, value string) ([]byte, error) {
+	lines := strings.SplitAfter(string(src), "\n")
+	found, last := false, -1
+	for i, line := range lines {
+		text := stripComment(line)
+		if strings.HasPrefix(text, "[") {
+			if found {
+				break
+			}
+			end := strings.IndexRune(text, ']')
+			if end > 0 && strings.TrimSpace(text[1:end]) == section {
+				found, last = true, i
+			}
+			continue
+		}
+		if !found || text == "" {
+			continue
+		}
+		last = i
+		kv := strings.SplitN(text, "=", 2)
+		if len(kv) == 2 && strings.TrimSpace(kv[0]) == key {
+			lines[i] = key + "=" + value + lineEnd(line)
+			return []byte(strings.Join(lines, "")), nil
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("section [%s] not found", section)
+	}
+	end := lineEnd(lines[last])
+	if end == "" {
+		end = "\n"
+		lines[last] += end
+	}
+	rest := append([]string{key + "=" + value + end}, lines[last+1:]...)
+	lines = append(lines[:last+1], rest...)
+	return []byte(strings.Join(lines, "")), nil
+}
+
+func stripComment(line string) string {
+	if i := strings.IndexRune(line, ';'); i != -1 {
+		line = line[:i]
+	}
+	return strings.TrimSpace(line)
+}
+
+func lineEnd(line string) string {
+	switch {
+	case strings.HasSuffix(line, "\r\n"):
+		return "\r\n"
+	case strings.HasSuffix(line, "\n"):
+		return "\n"
+	}
+	return ""
+}
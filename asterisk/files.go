@@ -0,0 +1,114 @@
+package asterisk
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Errors returned when a file can not be reached through the API.
+var (
+	ErrBadName    = errors.New("bad configuration file name")
+	ErrNotManaged = errors.New("configuration file is not managed by fconf")
+	ErrReadOnly   = errors.New("configuration file is read only")
+)
+
+// DefaultManaged are the files exposed when no list is configured.
+var DefaultManaged = []string{DongleConf}
+
+// Files decides which configuration files in Dir can be read and written.
+//
+// Only the files listed in Managed can be accessed, the ones that are also in
+// ReadOnly can not be written. Managed defaults to DefaultManaged when it is
+// empty.
+type Files struct {
+	Dir      string
+	Managed  []string
+	ReadOnly []string
+}
+
+// Path returns the path to the managed file name. The name must be a plain
+// file name, and the file must resolve to a location inside Dir even after
+// following symlinks.
+func (f *Files) Path(name string) (string, error) {
+	if name == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") ||
+		strings.ContainsAny(name, `/\`) {
+		return "", ErrBadName
+	}
+	if !contains(f.managed(), name) {
+		return "", ErrNotManaged
+	}
+	dir, err := filepath.Abs(f.Dir)
+	if err != nil {
+		return "", err
+	}
+	if d, err := filepath.EvalSymlinks(dir); err == nil {
+		dir = d
+	}
+	fName := filepath.Join(dir, name)
+	real, err := filepath.EvalSymlinks(fName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fName, nil
+		}
+		return "", err
+	}
+	rel, err := filepath.Rel(dir, real)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", ErrBadName
+	}
+	return fName, nil
+}
+
+// Writable returns the path to name if the file can be written.
+func (f *Files) Writable(name string) (string, error) {
+	p, err := f.Path(name)
+	if err != nil {
+		return "", err
+	}
+	if contains(f.ReadOnly, name) {
+		return "", ErrReadOnly
+	}
+	return p, nil
+}
+
+// List returns the names of the managed files.
+func (f *Files) List() []string {
+	return append([]string(nil), f.managed()...)
+}
+
+// Check makes sure the managed file name can be read and parsed. The dialplan
+// is only checked for being readable since the parser does not understand it.
+func (f *Files) Check(name string) error {
+	p, err := f.Path(name)
+	if err != nil {
+		return err
+	}
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		return err
+	}
+	if name == ExtensionsConf {
+		return nil
+	}
+	_, err = parse(b)
+	return err
+}
+
+func (f *Files) managed() []string {
+	if len(f.Managed) == 0 {
+		return DefaultManaged
+	}
+	return f.Managed
+}
+
+func contains(list []string, name string) bool {
+	for _, v := range list {
+		if v == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,60 @@
+package asterisk
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fconf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	outside, err := ioutil.TempFile("", "manager.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = outside.Close()
+	defer func() { _ = os.Remove(outside.Name()) }()
+	err = os.Symlink(outside.Name(), filepath.Join(dir, "sip.conf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := &Files{
+		Dir:      dir,
+		Managed:  []string{DongleConf, ExtensionsConf, "sip.conf"},
+		ReadOnly: []string{ExtensionsConf},
+	}
+	sample := []struct {
+		name        string
+		read, write error
+	}{
+		{DongleConf, nil, nil},
+		{ExtensionsConf, nil, ErrReadOnly},
+		{"manager.conf", ErrNotManaged, ErrNotManaged},
+		{"../manager.conf", ErrBadName, ErrBadName},
+		{"..", ErrBadName, ErrBadName},
+		{".dongle.conf", ErrBadName, ErrBadName},
+		{"sip.conf", ErrBadName, ErrBadName},
+	}
+	for _, v := range sample {
+		_, err := f.Path(v.name)
+		if err != v.read {
+			t.Errorf("read %s: expected %v got %v", v.name, v.read, err)
+		}
+		_, err = f.Writable(v.name)
+		if err != v.write {
+			t.Errorf("write %s: expected %v got %v", v.name, v.write, err)
+		}
+	}
+
+	// only dongle.conf is exposed by default
+	f = &Files{Dir: dir}
+	if _, err := f.Path(ExtensionsConf); err != ErrNotManaged {
+		t.Errorf("expected %v got %v", ErrNotManaged, err)
+	}
+}
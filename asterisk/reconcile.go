@@ -0,0 +1,220 @@
+package asterisk
+
+import "fmt"
+
+// Actions offered by a reconciliation.
+const (
+	ActionStop   = "stop"
+	ActionAdopt  = "adopt"
+	ActionRebind = "rebind"
+)
+
+// Identity identifies a modem and the SIM card in it.
+type Identity struct {
+	IMEI string `json:"imei"`
+	IMSI string `json:"imsi"`
+}
+
+// Missing is a device section whose modem and SIM are not plugged in.
+type Missing struct {
+	Section string `json:"section"`
+	Identity
+	// Stopped is true when the section already has initstate=stop, there is
+	// nothing left to do about it then.
+	Stopped bool   `json:"stopped"`
+	Action  string `json:"action,omitempty"`
+}
+
+// New is a plugged in modem that no device section matches. Section is set
+// when a device is bound to the modem by imei but follows its SIM elsewhere,
+// adopting the modem is not offered then.
+type New struct {
+	Identity
+	Section string `json:"section,omitempty"`
+	Action  string `json:"action,omitempty"`
+}
+
+// Moved is a SIM that is plugged in, but in another modem than the one its
+// device section is bound to.
+type Moved struct {
+	Section string `json:"section"`
+	IMSI    string `json:"imsi"`
+	From    string `json:"from_imei"`
+	To      string `json:"to_imei"`
+	Action  string `json:"action"`
+}
+
+// Changed is a modem that is plugged in with another SIM than the one its
+// device section is bound to. The section can be bound to the new SIM, unless
+// the modem is empty or another section has the SIM, or be stopped.
+type Changed struct {
+	Section string   `json:"section"`
+	IMEI    string   `json:"imei"`
+	From    string   `json:"from_imsi"`
+	To      string   `json:"to_imsi"`
+	Actions []string `json:"actions"`
+}
+
+// Reconciliation compares the devices in dongle.conf with the modems that are
+// plugged in.
+type Reconciliation struct {
+	Missing []Missing `json:"missing"`
+	New     []New     `json:"new"`
+	Moved   []Moved   `json:"moved"`
+	Changed []Changed `json:"changed"`
+}
+
+// Reconcile compares the device sections of the dongle.conf src with the
+// modems that are present. chan_dongle needs every identity a section sets to
+// match, so a section with an imsi follows its SIM: it is reported as moved
+// when the SIM is in another modem, even one that is bound to another section,
+// and as changed when its modem holds another SIM. A section with only an imei
+// matches the modem by imei.
+func Reconcile(src []byte, present []Identity) (*Reconciliation, error) {
+	d, err := parse(src)
+	if err != nil {
+		return nil, err
+	}
+	byIMEI := make(map[string]Identity)
+	byIMSI := make(map[string]Identity)
+	for _, v := range present {
+		byIMEI[v.IMEI] = v
+		if v.IMSI != "" {
+			byIMSI[v.IMSI] = v
+		}
+	}
+	boundIMEI := make(map[string]string)
+	boundIMSI := make(map[string]bool)
+	for _, sec := range d.Sections() {
+		if dongleReserved[sec.Name()] {
+			continue
+		}
+		if imei, _ := sec.Get("imei"); imei != "" {
+			boundIMEI[imei] = sec.Name()
+		}
+		if imsi, _ := sec.Get("imsi"); imsi != "" {
+			boundIMSI[imsi] = true
+		}
+	}
+	matched := make(map[string]bool)
+	r := &Reconciliation{}
+	for _, sec := range d.Sections() {
+		name := sec.Name()
+		if dongleReserved[name] {
+			continue
+		}
+		imei, _ := sec.Get("imei")
+		imsi, _ := sec.Get("imsi")
+		if imei == "" && imsi == "" {
+			// bound by tty with audio= and data=, nothing to compare
+			continue
+		}
+		state, _ := sec.Get("initstate")
+		if imsi != "" {
+			if m, ok := byIMSI[imsi]; ok {
+				matched[m.IMEI] = true
+				if imei != "" && imei != m.IMEI {
+					r.Moved = append(r.Moved, Moved{Section: name, IMSI: imsi, From: imei, To: m.IMEI, Action: ActionRebind})
+				}
+				continue
+			}
+			if m, ok := byIMEI[imei]; ok && !matched[m.IMEI] {
+				matched[m.IMEI] = true
+				c := Changed{Section: name, IMEI: imei, From: imsi, To: m.IMSI}
+				if m.IMSI != "" && !boundIMSI[m.IMSI] {
+					c.Actions = append(c.Actions, ActionRebind)
+				}
+				if state != "stop" {
+					c.Actions = append(c.Actions, ActionStop)
+				}
+				r.Changed = append(r.Changed, c)
+				continue
+			}
+		} else if m, ok := byIMEI[imei]; ok {
+			matched[m.IMEI] = true
+			continue
+		}
+		missing := Missing{Section: name, Identity: Identity{IMEI: imei, IMSI: imsi}, Stopped: state == "stop"}
+		if !missing.Stopped {
+			missing.Action = ActionStop
+		}
+		r.Missing = append(r.Missing, missing)
+	}
+	for _, v := range present {
+		if matched[v.IMEI] {
+			continue
+		}
+		n := New{Identity: v, Section: boundIMEI[v.IMEI]}
+		if n.Section == "" {
+			n.Action = ActionAdopt
+		}
+		r.New = append(r.New, n)
+	}
+	return r, nil
+}
+
+// Offers returns true if the reconciliation lists the action for the device
+// section, or for the modem with the imei when the action is adopt.
+func (r *Reconciliation) Offers(action, section string) bool {
+	switch action {
+	case ActionStop:
+		for _, m := range r.Missing {
+			if m.Section == section && m.Action == ActionStop {
+				return true
+			}
+		}
+		return r.changedOffers(action, section)
+	case ActionRebind:
+		for _, m := range r.Moved {
+			if m.Section == section {
+				return true
+			}
+		}
+		return r.changedOffers(action, section)
+	case ActionAdopt:
+		for _, n := range r.New {
+			if n.IMEI == section && n.Action == ActionAdopt {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (r *Reconciliation) changedOffers(action, section string) bool {
+	for _, c := range r.Changed {
+		if c.Section != section {
+			continue
+		}
+		for _, a := range c.Actions {
+			if a == action {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Stop sets initstate=stop on the device section so chan_dongle stops waiting
+// for its modem.
+func Stop(src []byte, section string) ([]byte, error) {
+	return SetValue(src, section, "initstate", "stop")
+}
+
+// Rebind binds the device section of a moved SIM to the modem it is in now, or
+// the device section of a modem with another SIM to that SIM.
+func (r *Reconciliation) Rebind(src []byte, section string) ([]byte, error) {
+	for _, m := range r.Moved {
+		if m.Section == section {
+			return SetValue(src, section, "imei", m.To)
+		}
+	}
+	if r.changedOffers(ActionRebind, section) {
+		for _, c := range r.Changed {
+			if c.Section == section {
+				return SetValue(src, section, "imsi", c.To)
+			}
+		}
+	}
+	return nil, fmt.Errorf("the SIM of [%s] did not move", section)
+}
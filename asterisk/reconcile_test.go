@@ -0,0 +1,149 @@
+package asterisk
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestSetValue(t *testing.T) {
+	src := "[airtel1]\r\nimei=353220047976425\r\n;imsi=640021046580298\r\n\r\n[tigo1]\nimei=352215045819420 ; old\n\n"
+	out, err := SetValue([]byte(src), "tigo1", "imei", "354369047238739")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(string(out), "[tigo1]\nimei=354369047238739\n\n") {
+		t.Errorf("unexpected result %q", out)
+	}
+	out, err = SetValue([]byte(src), "airtel1", "imsi", "640021046580298")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := "[airtel1]\r\nimei=353220047976425\r\nimsi=640021046580298\r\n;imsi=640021046580298\r\n\r\n[tigo1]"
+	if !strings.HasPrefix(string(out), expect) {
+		t.Errorf("expected the new line after the last setting got %q", out)
+	}
+	if _, err := SetValue([]byte(src), "vodacom1", "imei", "1"); err == nil {
+		t.Error("expected a missing section to fail")
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	src, err := ioutil.ReadFile("../sample/dongle.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// sample has airtel1 353220047976425, tigo1 352215045819420 and vodacom1
+	// 354369047238580, tigo1 gets an imsi so its SIM can be followed.
+	src, err = SetValue(src, "tigo1", "imsi", "640020000000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	present := []Identity{
+		{IMEI: "353220047976425", IMSI: "640050000000001"},
+		{IMEI: "354369047238739", IMSI: "640020000000001"},
+		{IMEI: "356789012345678", IMSI: "640030000000001"},
+	}
+	r, err := Reconcile(src, present)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Missing) != 1 || r.Missing[0].Section != "vodacom1" || r.Missing[0].Action != ActionStop {
+		t.Errorf("unexpected missing %+v", r.Missing)
+	}
+	if len(r.Moved) != 1 || r.Moved[0].Section != "tigo1" || r.Moved[0].To != "354369047238739" {
+		t.Errorf("unexpected moved %+v", r.Moved)
+	}
+	if len(r.New) != 1 || r.New[0].IMEI != "356789012345678" {
+		t.Errorf("unexpected new %+v", r.New)
+	}
+
+	src, err = Stop(src, "vodacom1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err = r.Rebind(src, "tigo1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err = Reconcile(src, present)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Moved) != 0 || len(r.Missing) != 1 || !r.Missing[0].Stopped || r.Missing[0].Action != "" {
+		t.Errorf("expected only the stopped device to be left got %+v", r)
+	}
+}
+
+func TestReconcileSIMs(t *testing.T) {
+	src := []byte("[tigo1]\nimei=352215045819420\nimsi=640020000000001\n\n" +
+		"[airtel1]\nimei=353220047976425\nimsi=640050000000001\n\n" +
+		"[vodacom1]\nimei=354369047238580\nimsi=640040000000001\n\n")
+	// the SIMs of tigo1 and airtel1 were swapped, the modem of vodacom1 has
+	// another SIM
+	present := []Identity{
+		{IMEI: "352215045819420", IMSI: "640050000000001"},
+		{IMEI: "353220047976425", IMSI: "640020000000001"},
+		{IMEI: "354369047238580", IMSI: "640040000000009"},
+	}
+	r, err := Reconcile(src, present)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Moved) != 2 || r.Moved[0].Section != "tigo1" || r.Moved[0].To != "353220047976425" ||
+		r.Moved[1].Section != "airtel1" || r.Moved[1].To != "352215045819420" {
+		t.Errorf("expected the swapped SIMs to be moved got %+v", r.Moved)
+	}
+	if len(r.Missing) != 0 || len(r.New) != 0 {
+		t.Errorf("expected no missing or new modems got %+v %+v", r.Missing, r.New)
+	}
+	if len(r.Changed) != 1 || r.Changed[0].Section != "vodacom1" || r.Changed[0].To != "640040000000009" {
+		t.Errorf("expected the SIM of vodacom1 to be changed got %+v", r.Changed)
+	}
+}
+
+func TestReconcileChangedSIM(t *testing.T) {
+	src := []byte("[tigo1]\nimei=352215045819420\nimsi=640020000000001\n\n" +
+		"[airtel1]\nimei=353220047976425\nimsi=640050000000001\n\n")
+	// tigo1 has a new SIM, the SIM of airtel1 is in another modem and its
+	// modem has a SIM that no section knows
+	present := []Identity{
+		{IMEI: "352215045819420", IMSI: "640020000000009"},
+		{IMEI: "354369047238739", IMSI: "640050000000001"},
+		{IMEI: "353220047976425", IMSI: "640030000000001"},
+	}
+	r, err := Reconcile(src, present)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Changed) != 1 || r.Changed[0].Section != "tigo1" || r.Changed[0].From != "640020000000001" {
+		t.Fatalf("expected the SIM of tigo1 to be changed got %+v", r.Changed)
+	}
+	if !r.Offers(ActionRebind, "tigo1") || !r.Offers(ActionStop, "tigo1") {
+		t.Errorf("expected rebind and stop to be offered for tigo1 got %v", r.Changed[0].Actions)
+	}
+	if len(r.New) != 1 || r.New[0].Section != "airtel1" || r.New[0].Action != "" {
+		t.Errorf("expected the modem of airtel1 without an action got %+v", r.New)
+	}
+	for _, v := range present {
+		if r.Offers(ActionAdopt, v.IMEI) {
+			t.Errorf("expected no adopt for %s", v.IMEI)
+		}
+	}
+	src, err = r.Rebind(src, "tigo1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(src), "[tigo1]\nimei=352215045819420\nimsi=640020000000009\n") {
+		t.Errorf("expected tigo1 bound to the new SIM got %q", src)
+	}
+
+	// an empty modem can only be stopped
+	present[0].IMSI = ""
+	if r, err = Reconcile(src, present); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Changed) != 1 || r.Offers(ActionRebind, "tigo1") || !r.Offers(ActionStop, "tigo1") {
+		t.Errorf("expected only stop for the empty modem got %+v", r.Changed)
+	}
+}
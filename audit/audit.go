@@ -0,0 +1,182 @@
+// Package audit keeps an append only record of the changes made through fconf.
+//
+// Entries are stored one json object per line, so the log can be inspected
+// with standard tools and is never rewritten.
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Actions recorded in the log.
+const (
+	ConfigWrite     = "config.write"
+	ChangesetCommit = "changeset.commit"
+	ATCommand       = "device.at"
+	DeviceAdd       = "device.add"
+	DeviceRemove    = "device.remove"
+	SMSSend         = "device.sms.send"
+	SMSDelete       = "device.sms.delete"
+	USSD            = "device.ussd"
+	BalanceCheck    = "device.balance.check"
+)
+
+// Entry is a single action recorded in the log.
+type Entry struct {
+	Time   time.Time `json:"time"`
+	User   string    `json:"user"`
+	Source string    `json:"source"`
+	Action string    `json:"action"`
+	Target string    `json:"target"`
+	Before string    `json:"before,omitempty"`
+	After  string    `json:"after,omitempty"`
+	Error  string    `json:"error,omitempty"`
+}
+
+// Filter selects entries from the log. Empty fields match everything.
+type Filter struct {
+	User   string
+	Action string
+	Target string
+	From   time.Time
+	To     time.Time
+
+	// Limit is the maximum number of entries returned, the most recent ones are
+	// kept.
+	Limit int
+}
+
+func (f *Filter) match(e *Entry) bool {
+	switch {
+	case f.User != "" && f.User != e.User:
+		return false
+	case f.Action != "" && f.Action != e.Action:
+		return false
+	case f.Target != "" && f.Target != e.Target:
+		return false
+	case !f.From.IsZero() && e.Time.Before(f.From):
+		return false
+	case !f.To.IsZero() && e.Time.After(f.To):
+		return false
+	}
+	return true
+}
+
+// Log is an append only audit log backed by a file.
+//
+// It is safe to use in multiple goroutines.
+type Log struct {
+	path string
+	mu   sync.Mutex
+	f    *os.File
+}
+
+// Open opens the log file at path, creating it if it does not exist.
+func Open(path string) (*Log, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &Log{path: path, f: f}, nil
+}
+
+// Record appends e to the log. The time is set to now if it is missing.
+func (l *Log) Record(e Entry) error {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err = l.f.Write(b)
+	if err != nil {
+		return err
+	}
+	return l.f.Sync()
+}
+
+// Query returns the entries matching f, oldest first.
+func (l *Log) Query(f *Filter) ([]Entry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	file, err := os.Open(l.path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = file.Close() }()
+	var entries []Entry
+	s := bufio.NewScanner(file)
+	s.Buffer(make([]byte, 64*1024), 1024*1024)
+	for s.Scan() {
+		var e Entry
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			continue
+		}
+		if f.match(&e) {
+			entries = append(entries, e)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if f.Limit > 0 && len(entries) > f.Limit {
+		entries = entries[len(entries)-f.Limit:]
+	}
+	return entries, nil
+}
+
+// Close closes the log file.
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Close()
+}
+
+// Handler serves the entries of the log as a json array. The entries can be
+// filtered with the query parameters user, action, target, from, to and limit,
+// from and to are RFC 3339 timestamps.
+func (l *Log) Handler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	q := r.URL.Query()
+	f := &Filter{
+		User:   q.Get("user"),
+		Action: q.Get("action"),
+		Target: q.Get("target"),
+	}
+	var err error
+	if v := q.Get("from"); v != "" {
+		f.From, err = time.Parse(time.RFC3339, v)
+	}
+	if v := q.Get("to"); v != "" && err == nil {
+		f.To, err = time.Parse(time.RFC3339, v)
+	}
+	if v := q.Get("limit"); v != "" && err == nil {
+		f.Limit, err = strconv.Atoi(v)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = enc.Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	entries, err := l.Query(f)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		_ = enc.Encode(map[string]string{"error": "trouble reading the audit log"})
+		return
+	}
+	if entries == nil {
+		entries = []Entry{}
+	}
+	_ = enc.Encode(entries)
+}
@@ -0,0 +1,76 @@
+package audit
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fconf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	l, err := Open(filepath.Join(dir, "audit.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = l.Close() }()
+	now := time.Now()
+	sample := []Entry{
+		{Time: now.Add(-2 * time.Hour), User: "juma", Action: ConfigWrite, Target: "dongle.conf",
+			Before: "[airtel1] imei=353220047976425", After: "[airtel1] imei=354369047238739"},
+		{Time: now.Add(-time.Hour), User: "system", Action: DeviceAdd, Target: "354369047238739"},
+		{User: "amina", Action: ConfigWrite, Target: "dongle.conf"},
+	}
+	for _, e := range sample {
+		if err := l.Record(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	queries := []struct {
+		filter Filter
+		count  int
+	}{
+		{Filter{}, 3},
+		{Filter{Action: ConfigWrite}, 2},
+		{Filter{User: "juma"}, 1},
+		{Filter{From: now.Add(-90 * time.Minute)}, 2},
+		{Filter{To: now.Add(-90 * time.Minute)}, 1},
+		{Filter{Limit: 1}, 1},
+	}
+	for _, v := range queries {
+		e, err := l.Query(&v.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(e) != v.count {
+			t.Errorf("%+v: expected %d entries got %d", v.filter, v.count, len(e))
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/audit?action=config.write&limit=1", nil)
+	w := httptest.NewRecorder()
+	l.Handler(w, r)
+	var entries []Entry
+	err = json.Unmarshal(w.Body.Bytes(), &entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].User != "amina" {
+		t.Errorf("expected the latest entry got %v", entries)
+	}
+
+	r = httptest.NewRequest("GET", "/audit?from=yesterday", nil)
+	w = httptest.NewRecorder()
+	l.Handler(w, r)
+	if w.Code != 400 {
+		t.Errorf("expected 400 got %d", w.Code)
+	}
+}
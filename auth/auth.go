@@ -0,0 +1,431 @@
+// Package auth provides users, login sessions and role based access control
+// for the fconf http API.
+//
+// Users are kept in a json file with bcrypt hashed passwords. A successful
+// login returns a token which is sent back either as a bearer token in the
+// Authorization header or as the session cookie.
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// CookieName is the name of the cookie that carries the session token.
+const CookieName = "fconf_session"
+
+// SessionTTL is how long a login session is valid.
+var SessionTTL = 12 * time.Hour
+
+// Errors returned by the Store.
+var (
+	ErrBadCredentials = errors.New("wrong username or password")
+	ErrUserExists     = errors.New("user already exists")
+	ErrNoUser         = errors.New("user not found")
+	ErrBadRole        = errors.New("unknown role")
+)
+
+// Role is what a user is allowed to do. Each role can do everything the roles
+// below it can.
+type Role int
+
+// The supported roles.
+const (
+	// Viewer can only read.
+	Viewer Role = iota + 1
+
+	// Operator can change the dongle settings.
+	Operator
+
+	// Admin can change every managed file, run AT commands and manage users.
+	Admin
+)
+
+var roleNames = map[Role]string{
+	Viewer:   "viewer",
+	Operator: "operator",
+	Admin:    "admin",
+}
+
+func (r Role) String() string {
+	return roleNames[r]
+}
+
+// ParseRole returns the role with the given name.
+func ParseRole(name string) (Role, error) {
+	for k, v := range roleNames {
+		if v == name {
+			return k, nil
+		}
+	}
+	return 0, ErrBadRole
+}
+
+// MarshalJSON encodes the role as its name.
+func (r Role) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.String())
+}
+
+// UnmarshalJSON decodes the role from its name.
+func (r *Role) UnmarshalJSON(b []byte) error {
+	var name string
+	err := json.Unmarshal(b, &name)
+	if err != nil {
+		return err
+	}
+	*r, err = ParseRole(name)
+	return err
+}
+
+// User is a person who can log into fconf.
+type User struct {
+	Name     string `json:"name"`
+	Role     Role   `json:"role"`
+	Password string `json:"password,omitempty"`
+}
+
+type session struct {
+	user    User
+	expires time.Time
+}
+
+// Store holds the users and their login sessions.
+//
+// It is safe to use in multiple goroutines.
+type Store struct {
+	path     string
+	mu       sync.RWMutex
+	users    map[string]*User
+	sessions map[string]*session
+}
+
+// Open loads the users stored in the json file path. A missing file is not an
+// error, it gives an empty store which will create the file when the first user
+// is added.
+func Open(path string) (*Store, error) {
+	users, err := readUsers(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Store{
+		path:     path,
+		users:    users,
+		sessions: make(map[string]*session),
+	}, nil
+}
+
+// readUsers reads the users in the json file path, a missing file has none.
+func readUsers(path string) (map[string]*User, error) {
+	users := make(map[string]*User)
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return users, nil
+		}
+		return nil, err
+	}
+	var list []*User
+	err = json.Unmarshal(b, &list)
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range list {
+		users[u.Name] = u
+	}
+	return users, nil
+}
+
+// Reload replaces the users with the ones stored in the json file path, which
+// is used from then on. The sessions of the users who are gone end, the others
+// get the role the user has now.
+func (s *Store) Reload(path string) error {
+	users, err := readUsers(path)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.path, s.users = path, users
+	for k, v := range s.sessions {
+		u, ok := users[v.user.Name]
+		if !ok {
+			delete(s.sessions, k)
+			continue
+		}
+		v.user.Role = u.Role
+	}
+	return nil
+}
+
+// Len returns the number of users.
+func (s *Store) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.users)
+}
+
+// Users returns all the users sorted by name, without their passwords.
+func (s *Store) Users() []User {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var users []User
+	for _, u := range s.users {
+		users = append(users, User{Name: u.Name, Role: u.Role})
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Name < users[j].Name })
+	return users
+}
+
+// Add creates a new user and saves the store.
+func (s *Store) Add(name, password string, role Role) error {
+	if name == "" || password == "" {
+		return errors.New("username and password are required")
+	}
+	if _, ok := roleNames[role]; !ok {
+		return ErrBadRole
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[name]; ok {
+		return ErrUserExists
+	}
+	s.users[name] = &User{Name: name, Role: role, Password: string(hash)}
+	return s.save()
+}
+
+// Remove deletes the user name and ends all of the user's sessions.
+func (s *Store) Remove(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[name]; !ok {
+		return ErrNoUser
+	}
+	delete(s.users, name)
+	for k, v := range s.sessions {
+		if v.user.Name == name {
+			delete(s.sessions, k)
+		}
+	}
+	return s.save()
+}
+
+// save writes the users to the store file, the caller must hold the lock.
+func (s *Store) save() error {
+	var users []*User
+	for _, u := range s.users {
+		users = append(users, u)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Name < users[j].Name })
+	b, err := json.MarshalIndent(users, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	err = ioutil.WriteFile(tmp, b, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// Authenticate checks the password of the user name.
+func (s *Store) Authenticate(name, password string) (*User, error) {
+	s.mu.RLock()
+	u, ok := s.users[name]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, ErrBadCredentials
+	}
+	err := bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(password))
+	if err != nil {
+		return nil, ErrBadCredentials
+	}
+	return &User{Name: u.Name, Role: u.Role}, nil
+}
+
+// Login authenticates the user and starts a new session. The returned token
+// identifies the session.
+func (s *Store) Login(name, password string) (string, time.Time, error) {
+	u, err := s.Authenticate(name, password)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	b := make([]byte, 32)
+	_, err = rand.Read(b)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	token := hex.EncodeToString(b)
+	expires := time.Now().Add(SessionTTL)
+	s.mu.Lock()
+	s.sessions[token] = &session{user: *u, expires: expires}
+	s.mu.Unlock()
+	return token, expires, nil
+}
+
+// Logout ends the session identified by token.
+func (s *Store) Logout(token string) {
+	s.mu.Lock()
+	delete(s.sessions, token)
+	s.mu.Unlock()
+}
+
+// Session returns the user logged in with token.
+func (s *Store) Session(token string) (*User, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.sessions[token]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(sess.expires) {
+		delete(s.sessions, token)
+		return nil, false
+	}
+	u := sess.user
+	return &u, true
+}
+
+// Token returns the session token sent with the request r.
+func Token(r *http.Request) string {
+	h := r.Header.Get("Authorization")
+	if strings.HasPrefix(h, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(h, "Bearer "))
+	}
+	if c, err := r.Cookie(CookieName); err == nil {
+		return c.Value
+	}
+	return ""
+}
+
+// userFromRequest returns the user who made the request. Both session tokens
+// and basic auth are accepted, the latter is handy for scripts.
+func (s *Store) userFromRequest(r *http.Request) (*User, bool) {
+	if name, password, ok := r.BasicAuth(); ok {
+		u, err := s.Authenticate(name, password)
+		return u, err == nil
+	}
+	token := Token(r)
+	if token == "" {
+		return nil, false
+	}
+	return s.Session(token)
+}
+
+type userKey struct{}
+
+// UserFrom returns the authenticated user of the request r.
+func UserFrom(r *http.Request) (*User, bool) {
+	u, ok := r.Context().Value(userKey{}).(*User)
+	return u, ok
+}
+
+// Require returns a handler that only calls h when the request is made by a
+// user with at least the given role. The user is available to h through
+// UserFrom.
+func (s *Store) Require(role Role, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, ok := s.userFromRequest(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="fconf"`)
+			writeError(w, http.StatusUnauthorized, "authentication required")
+			return
+		}
+		if u.Role < role {
+			writeError(w, http.StatusForbidden, "this requires the "+role.String()+" role")
+			return
+		}
+		h(w, r.WithContext(context.WithValue(r.Context(), userKey{}, u)))
+	}
+}
+
+func writeError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
+
+// LoginHandler logs in with a json object with username and password fields.
+// The session token is returned in the response and is also set as a cookie,
+// which is only sent back over https when the login came over https.
+func (s *Store) LoginHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "trouble reading request body")
+		return
+	}
+	token, expires, err := s.Login(req.Username, req.Password)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	u, _ := s.Session(token)
+	http.SetCookie(w, &http.Cookie{
+		Name:     CookieName,
+		Value:    token,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"token":   token,
+		"user":    u.Name,
+		"role":    u.Role,
+		"expires": expires,
+	})
+}
+
+// LogoutHandler ends the session of the request.
+func (s *Store) LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	s.Logout(Token(r))
+	http.SetCookie(w, &http.Cookie{Name: CookieName, Path: "/", MaxAge: -1})
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]bool{"ok": true})
+}
+
+// UsersHandler serves the list of users.
+func (s *Store) UsersHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(s.Users())
+}
+
+// AddUserHandler creates a user from a json object with name, password and
+// role fields.
+func (s *Store) AddUserHandler(w http.ResponseWriter, r *http.Request) {
+	u := &User{}
+	err := json.NewDecoder(r.Body).Decode(u)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "trouble reading request body")
+		return
+	}
+	err = s.Add(u.Name, u.Password, u.Role)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(User{Name: u.Name, Role: u.Role})
+}
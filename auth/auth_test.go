@@ -0,0 +1,184 @@
+package auth
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func newStore(t *testing.T) (*Store, func()) {
+	dir, err := ioutil.TempDir("", "fconf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := Open(filepath.Join(dir, "users.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, func() { _ = os.RemoveAll(dir) }
+}
+
+func TestStore(t *testing.T) {
+	s, clean := newStore(t)
+	defer clean()
+	err := s.Add("juma", "secret", Operator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Add("juma", "secret", Admin); err != ErrUserExists {
+		t.Errorf("expected %v got %v", ErrUserExists, err)
+	}
+
+	// the users must survive reopening the store
+	s, err = Open(s.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Authenticate("juma", "wrong"); err != ErrBadCredentials {
+		t.Errorf("expected %v got %v", ErrBadCredentials, err)
+	}
+	u, err := s.Authenticate("juma", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Role != Operator {
+		t.Errorf("expected %s got %s", Operator, u.Role)
+	}
+	if s.users["juma"].Password == "secret" {
+		t.Error("password is stored in plain text")
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(s.users["juma"].Password), []byte("secret")); err != nil {
+		t.Error(err)
+	}
+
+	token, _, err := s.Login("juma", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.Session(token); !ok {
+		t.Error("expected a session")
+	}
+	err = s.Remove("juma")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.Session(token); ok {
+		t.Error("expected the session to end with the user")
+	}
+}
+
+func TestRequire(t *testing.T) {
+	s, clean := newStore(t)
+	defer clean()
+	for name, role := range map[string]Role{"viewer": Viewer, "operator": Operator, "admin": Admin} {
+		err := s.Add(name, "secret", role)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	h := s.Require(Operator, func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := UserFrom(r); !ok {
+			t.Error("expected the user in the request")
+		}
+	})
+	token, _, err := s.Login("admin", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sample := []struct {
+		desc string
+		auth func(*http.Request)
+		code int
+	}{
+		{"anonymous", func(r *http.Request) {}, http.StatusUnauthorized},
+		{"wrong password", func(r *http.Request) { r.SetBasicAuth("operator", "x") }, http.StatusUnauthorized},
+		{"viewer", func(r *http.Request) { r.SetBasicAuth("viewer", "secret") }, http.StatusForbidden},
+		{"operator", func(r *http.Request) { r.SetBasicAuth("operator", "secret") }, http.StatusOK},
+		{"bearer", func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+token) }, http.StatusOK},
+		{"cookie", func(r *http.Request) { r.AddCookie(&http.Cookie{Name: CookieName, Value: token}) }, http.StatusOK},
+		{"bad token", func(r *http.Request) { r.Header.Set("Authorization", "Bearer x") }, http.StatusUnauthorized},
+	}
+	for _, v := range sample {
+		r := httptest.NewRequest("GET", "/", nil)
+		v.auth(r)
+		w := httptest.NewRecorder()
+		h(w, r)
+		if w.Code != v.code {
+			t.Errorf("%s: expected %d got %d", v.desc, v.code, w.Code)
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	s, clean := newStore(t)
+	defer clean()
+	for _, name := range []string{"juma", "amina"} {
+		err := s.Add(name, "secret", Operator)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	juma, _, err := s.Login("juma", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	amina, _, err := s.Login("amina", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// amina is removed from the file behind the store's back
+	other, err := Open(s.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = other.Remove("amina")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Reload(s.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.Session(juma); !ok {
+		t.Error("expected the session of juma to be kept")
+	}
+	if _, ok := s.Session(amina); ok {
+		t.Error("expected the session of amina to end")
+	}
+	if _, err := s.Authenticate("amina", "secret"); err != ErrBadCredentials {
+		t.Errorf("expected %v got %v", ErrBadCredentials, err)
+	}
+}
+
+func TestLoginCookie(t *testing.T) {
+	s, clean := newStore(t)
+	defer clean()
+	err := s.Add("juma", "secret", Operator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secure := range []bool{false, true} {
+		r := httptest.NewRequest("POST", "/login", strings.NewReader(`{"username":"juma","password":"secret"}`))
+		if secure {
+			r.TLS = &tls.ConnectionState{}
+		}
+		w := httptest.NewRecorder()
+		s.LoginHandler(w, r)
+		cookies := w.Result().Cookies()
+		if len(cookies) != 1 {
+			t.Fatalf("expected the session cookie got %v", cookies)
+		}
+		c := cookies[0]
+		if !c.HttpOnly || c.SameSite != http.SameSiteStrictMode || c.Secure != secure {
+			t.Errorf("unexpected cookie %+v over tls %v", c, secure)
+		}
+	}
+}
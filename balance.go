@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/FarmRadioHangar/fessboxconfig/audit"
+	"github.com/FarmRadioHangar/fessboxconfig/balance"
+	"github.com/FarmRadioHangar/fessboxconfig/device"
+	"github.com/gorilla/mux"
+)
+
+// balanceTick is how often the modems are looked at for a balance check that
+// is due.
+const balanceTick = time.Minute
+
+// balanceRetry is how long a failed balance check waits before it is tried
+// again, unless the interval is shorter.
+const balanceRetry = time.Hour
+
+// errNoCheck is returned for a SIM matching none of the balance checks.
+var errNoCheck = errors.New("no balance check for the operator of the SIM")
+
+// balances runs the balance checks and keeps the last reading of each modem,
+// and the last one with an amount, in the store when there is one.
+type balances struct {
+	store *balance.Store
+
+	mu      sync.Mutex
+	last    map[string]balance.Reading
+	amounts map[string]balance.Reading
+}
+
+func newBalances(store *balance.Store) *balances {
+	return &balances{
+		store:   store,
+		last:    make(map[string]balance.Reading),
+		amounts: make(map[string]balance.Reading),
+	}
+}
+
+// lastReading returns the latest reading of the modem with the imei.
+func (b *balances) lastReading(imei string) (balance.Reading, bool) {
+	if b.store != nil {
+		return b.store.Last(imei)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	v, ok := b.last[imei]
+	return v, ok
+}
+
+// check dials the balance code of the operator of the SIM of mod and records
+// the reading. A low balance event is published when the balance drops below
+// the threshold of the check.
+func (b *balances) check(ctx context.Context, m *device.Manager, cfg *Config, mod device.Modem) (balance.Reading, error) {
+	chk, ok := balance.Find(cfg.BalanceChecks, mod.IMSI)
+	if !ok {
+		return balance.Reading{}, errNoCheck
+	}
+	v := balance.Reading{
+		IMEI:      mod.IMEI,
+		IMSI:      mod.IMSI,
+		Currency:  chk.Currency,
+		Threshold: chk.Threshold,
+	}
+	reply, err := m.USSDIfIdle(ctx, mod.IMEI, chk.Code)
+	if err == device.ErrUSSDBusy {
+		return balance.Reading{}, err
+	}
+	if err == nil {
+		v.Reply = reply.Text
+		if reply.Status == 1 {
+			// a menu, the balance should be in it
+			_ = m.CancelUSSD(ctx, mod.IMEI)
+		}
+		if reply.Status > 1 {
+			err = fmt.Errorf("the network replied with status %d", reply.Status)
+		}
+	}
+	if err == nil {
+		var amount float64
+		amount, err = chk.Parse(reply.Text)
+		if err == nil {
+			v.Amount = &amount
+		}
+	}
+	if err != nil {
+		v.Error = err.Error()
+	}
+	v.Time = time.Now()
+	prev := b.lastAmount(mod.IMEI)
+	b.record(v)
+	if v.Amount != nil && chk.Low(*v.Amount) && (prev == nil || !chk.Low(*prev)) {
+		log.Printf("the balance of %s is %v %s, below %v\n", mod.IMEI, *v.Amount, chk.Currency, chk.Threshold)
+		m.Publish(device.Event{
+			Type: device.EventLowBalance,
+			IMEI: mod.IMEI,
+			Time: v.Time,
+			Balance: &device.Balance{
+				Amount:    *v.Amount,
+				Currency:  chk.Currency,
+				Threshold: chk.Threshold,
+			},
+		})
+	}
+	return v, err
+}
+
+// lastAmount returns the amount of the latest successful reading of the modem,
+// nil when there is none. A failed check between two low balances is not
+// taken as the balance going up.
+func (b *balances) lastAmount(imei string) *float64 {
+	var v balance.Reading
+	if b.store != nil {
+		v, _ = b.store.LastAmount(imei)
+	} else {
+		b.mu.Lock()
+		v = b.amounts[imei]
+		b.mu.Unlock()
+	}
+	return v.Amount
+}
+
+func (b *balances) record(v balance.Reading) {
+	b.mu.Lock()
+	b.last[v.IMEI] = v
+	if v.Amount != nil {
+		b.amounts[v.IMEI] = v
+	}
+	b.mu.Unlock()
+	if b.store == nil {
+		return
+	}
+	err := b.store.Record(v)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// due returns true if the balance of mod was never checked or was checked
+// longer than the interval ago, or the retry delay after a failure.
+func (b *balances) due(cfg *Config, mod device.Modem, now time.Time) bool {
+	if _, ok := balance.Find(cfg.BalanceChecks, mod.IMSI); !ok {
+		return false
+	}
+	v, ok := b.lastReading(mod.IMEI)
+	if !ok {
+		return true
+	}
+	wait := time.Duration(cfg.BalanceInterval) * time.Hour
+	if v.Amount == nil && balanceRetry < wait {
+		wait = balanceRetry
+	}
+	return now.Sub(v.Time) >= wait
+}
+
+// run checks the balance of every modem that is due, one after the other.
+func (b *balances) run(ctx context.Context, m *device.Manager, cfg *Config, now time.Time) {
+	for _, mod := range m.Modems() {
+		if ctx.Err() != nil {
+			return
+		}
+		if mod.IMSI == "" || !b.due(cfg, mod, now) || m.USSDBusy(mod.IMEI) {
+			continue
+		}
+		_, err := b.check(ctx, m, cfg, mod)
+		if err != nil {
+			log.Printf("checking the balance of %s: %v\n", mod.IMEI, err)
+		}
+	}
+}
+
+// loop runs the balance checks as they are due until stop is closed.
+func (b *balances) loop(m *device.Manager, cfg *Config, stop chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-stop
+		cancel()
+	}()
+	t := time.NewTicker(balanceTick)
+	defer t.Stop()
+	for {
+		select {
+		case now := <-t.C:
+			b.run(ctx, m, cfg, now)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Balance serves the balances of the SIM of the modem with the imei in the url
+// checked between the RFC 3339 timestamps from and to, the last 90 days by
+// default.
+func (ww *web) Balance(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	if ww.balances == nil || ww.balances.store == nil {
+		w.WriteHeader(http.StatusNotFound)
+		_ = enc.Encode(&errMSG{"the balance history is off"})
+		return
+	}
+	q := r.URL.Query()
+	to, from := time.Now(), time.Time{}
+	var err error
+	if v := q.Get("to"); v != "" {
+		to, err = time.Parse(time.RFC3339, v)
+	}
+	if v := q.Get("from"); v != "" && err == nil {
+		from, err = time.Parse(time.RFC3339, v)
+	}
+	if from.IsZero() {
+		from = to.Add(-90 * 24 * time.Hour)
+	}
+	if err == nil && !from.Before(to) {
+		err = errors.New("expected from before to")
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = enc.Encode(&errMSG{err.Error()})
+		return
+	}
+	imei := mux.Vars(r)["imei"]
+	list, err := ww.balances.store.Query(imei, from, to)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		_ = enc.Encode(&errMSG{"trouble reading the balance history"})
+		return
+	}
+	if list == nil {
+		list = []balance.Reading{}
+	}
+	_ = enc.Encode(map[string]interface{}{
+		"imei":     imei,
+		"from":     from,
+		"to":       to,
+		"readings": list,
+	})
+}
+
+// CheckBalance checks the balance of the SIM of the modem with the imei in the
+// url right away and serves the reading. The check is recorded in the audit
+// log.
+func (ww *web) CheckBalance(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	if ww.manager == nil || ww.balances == nil {
+		w.WriteHeader(http.StatusNotFound)
+		_ = enc.Encode(&errMSG{"device detection is off"})
+		return
+	}
+	imei := mux.Vars(r)["imei"]
+	mod, ok := ww.manager.Modem(imei)
+	if !ok {
+		modemError(w, device.ErrNoModem)
+		return
+	}
+	v, err := ww.balances.check(r.Context(), ww.manager, ww.cfg, mod)
+	e := audit.Entry{Action: audit.BalanceCheck, Target: imei, Before: mod.IMSI}
+	if v.Amount != nil {
+		e.After = fmt.Sprintf("%v %s", *v.Amount, v.Currency)
+	}
+	ww.recordEntry(r, e, err)
+	switch {
+	case err == errNoCheck:
+		w.WriteHeader(http.StatusNotFound)
+		_ = enc.Encode(&errMSG{err.Error()})
+	case v.Time.IsZero():
+		modemError(w, err)
+	case err != nil:
+		w.WriteHeader(http.StatusBadGateway)
+		_ = enc.Encode(v)
+	default:
+		_ = enc.Encode(v)
+	}
+}
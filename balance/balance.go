@@ -0,0 +1,108 @@
+// Package balance checks the airtime left on the SIMs of the modems and keeps
+// the balances over time.
+//
+// Each operator has its own USSD code for the balance and its own wording for
+// the reply, so a Check is configured per operator and picked by the start of
+// the IMSI of the SIM, the mobile country and network codes.
+package balance
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Check is how the balance of the SIMs of an operator is checked.
+type Check struct {
+	// Prefix is the start of the IMSI of the SIMs of the operator, the MCC
+	// and MNC like 64002.
+	Prefix string `json:"prefix"`
+
+	// Operator names the operator, it is only shown.
+	Operator string `json:"operator,omitempty"`
+
+	// Code is the USSD code answering the balance, like *102#.
+	Code string `json:"code"`
+
+	// Pattern is the regular expression finding the balance in the reply,
+	// the first group is the amount like 1,000.50.
+	Pattern string `json:"pattern"`
+
+	// Currency is the currency of the amount, it is only shown.
+	Currency string `json:"currency,omitempty"`
+
+	// Threshold is the amount below which the balance is low, zero never
+	// is.
+	Threshold float64 `json:"threshold,omitempty"`
+}
+
+// Validate returns an error saying what is wrong with the check.
+func (c *Check) Validate() error {
+	if len(c.Prefix) < 5 || len(c.Prefix) > 15 || strings.Trim(c.Prefix, "0123456789") != "" {
+		return fmt.Errorf("prefix %q is not the start of an IMSI like 64002", c.Prefix)
+	}
+	if c.Code == "" {
+		return fmt.Errorf("%s: the code is missing", c.Prefix)
+	}
+	re, err := regexp.Compile(c.Pattern)
+	if err != nil {
+		return fmt.Errorf("%s: %v", c.Prefix, err)
+	}
+	if re.NumSubexp() < 1 {
+		return fmt.Errorf("%s: the pattern has no group for the amount", c.Prefix)
+	}
+	if c.Threshold < 0 {
+		return fmt.Errorf("%s: the threshold must not be negative", c.Prefix)
+	}
+	return nil
+}
+
+// Parse returns the amount in the reply of the network.
+func (c *Check) Parse(reply string) (float64, error) {
+	re, err := regexp.Compile(c.Pattern)
+	if err != nil {
+		return 0, err
+	}
+	m := re.FindStringSubmatch(reply)
+	if len(m) < 2 || m[1] == "" {
+		return 0, errors.New("no balance in the reply")
+	}
+	return ParseAmount(m[1])
+}
+
+// Low returns true if amount is below the threshold.
+func (c *Check) Low(amount float64) bool {
+	return amount < c.Threshold
+}
+
+// ParseAmount returns the value of an amount written like 1000, 1,000.50 or
+// 12,50. A comma followed by one or two digits at the end and no dot is taken
+// as the decimal separator, the other commas and spaces group the digits. The
+// punctuation ending a sentence is ignored.
+func ParseAmount(s string) (float64, error) {
+	v := strings.TrimRight(strings.Replace(strings.TrimSpace(s), " ", "", -1), ".,")
+	if i := strings.LastIndex(v, ","); i != -1 && !strings.Contains(v, ".") && len(v)-i-1 <= 2 {
+		v = v[:i] + "." + v[i+1:]
+	}
+	v = strings.Replace(v, ",", "", -1)
+	n, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not an amount", s)
+	}
+	return n, nil
+}
+
+// Find returns the check of the SIM with the imsi, the one with the longest
+// matching prefix.
+func Find(checks []Check, imsi string) (Check, bool) {
+	var found Check
+	ok := false
+	for _, c := range checks {
+		if strings.HasPrefix(imsi, c.Prefix) && (!ok || len(c.Prefix) > len(found.Prefix)) {
+			found, ok = c, true
+		}
+	}
+	return found, ok
+}
@@ -0,0 +1,146 @@
+package balance
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCheck(t *testing.T) {
+	c := Check{Prefix: "64002", Code: "*102#", Pattern: `(?i)salio.*?TZS ([0-9][0-9,.]*)`, Currency: "TZS", Threshold: 2000}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	sample := []struct {
+		reply  string
+		amount float64
+		ok     bool
+	}{
+		{"Salio lako ni TZS 1,500.50. Asante", 1500.50, true},
+		{"SALIO: TZS 12000", 12000, true},
+		{"Huduma haipatikani", 0, false},
+	}
+	for _, v := range sample {
+		n, err := c.Parse(v.reply)
+		if (err == nil) != v.ok || n != v.amount {
+			t.Errorf("%q: expected %v ok=%v got %v %v", v.reply, v.amount, v.ok, n, err)
+		}
+	}
+	if !c.Low(1500) || c.Low(2000) {
+		t.Error("expected the balance to be low below the threshold only")
+	}
+
+	for _, v := range []Check{
+		{Prefix: "640", Code: "*102#", Pattern: "([0-9]+)"},
+		{Prefix: "64002", Pattern: "([0-9]+)"},
+		{Prefix: "64002", Code: "*102#", Pattern: "[0-9]+"},
+		{Prefix: "64002", Code: "*102#", Pattern: "([0-9]+"},
+		{Prefix: "64002", Code: "*102#", Pattern: "([0-9]+)", Threshold: -1},
+	} {
+		if err := v.Validate(); err == nil {
+			t.Errorf("expected %+v to be invalid", v)
+		}
+	}
+}
+
+func TestParseAmount(t *testing.T) {
+	sample := []struct {
+		s      string
+		amount float64
+	}{
+		{"1000", 1000},
+		{"1,000", 1000},
+		{"1,000.50", 1000.50},
+		{"12,50", 12.50},
+		{"1 234 567", 1234567},
+		{"0.5", 0.5},
+	}
+	for _, v := range sample {
+		n, err := ParseAmount(v.s)
+		if err != nil || n != v.amount {
+			t.Errorf("%q: expected %v got %v %v", v.s, v.amount, n, err)
+		}
+	}
+	if _, err := ParseAmount("many"); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestFind(t *testing.T) {
+	checks := []Check{
+		{Prefix: "64002", Code: "*102#"},
+		{Prefix: "640021", Code: "*150#"},
+		{Prefix: "64004", Code: "*104#"},
+	}
+	sample := []struct {
+		imsi, code string
+	}{
+		{"640020123456789", "*102#"},
+		{"640021123456789", "*150#"},
+		{"640040123456789", "*104#"},
+		{"639020123456789", ""},
+	}
+	for _, v := range sample {
+		c, ok := Find(checks, v.imsi)
+		if ok != (v.code != "") || c.Code != v.code {
+			t.Errorf("%s: expected %q got %q", v.imsi, v.code, c.Code)
+		}
+	}
+}
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "balance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	path := filepath.Join(dir, "balance", "balance.log")
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	amount := 1500.0
+	for i, v := range []Reading{
+		{Time: now.Add(-48 * time.Hour), IMEI: "356789012345678", Amount: &amount},
+		{Time: now.Add(-24 * time.Hour), IMEI: "356789012345678", Error: "unknown modem"},
+		{Time: now, IMEI: "356789012345679", Amount: &amount},
+	} {
+		if err := s.Record(v); err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = s.Close() }()
+	last, ok := s.Last("356789012345678")
+	if !ok || last.Error != "unknown modem" {
+		t.Errorf("expected the last reading to be kept got %+v", last)
+	}
+	last, ok = s.LastAmount("356789012345678")
+	if !ok || last.Amount == nil || !last.Time.Equal(now.Add(-48*time.Hour)) {
+		t.Errorf("expected the last successful reading got %+v", last)
+	}
+	list, err := s.Query("356789012345678", now.Add(-72*time.Hour), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].Amount == nil || *list[0].Amount != 1500 {
+		t.Errorf("unexpected readings %+v", list)
+	}
+	list, err = s.Query("356789012345678", now.Add(-30*time.Hour), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 {
+		t.Errorf("expected one reading in range got %+v", list)
+	}
+}
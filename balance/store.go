@@ -0,0 +1,148 @@
+package balance
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Reading is the outcome of a balance check. Amount is missing when the check
+// failed, Error then says why.
+type Reading struct {
+	Time      time.Time `json:"time"`
+	IMEI      string    `json:"imei"`
+	IMSI      string    `json:"imsi"`
+	Amount    *float64  `json:"amount,omitempty"`
+	Currency  string    `json:"currency,omitempty"`
+	Threshold float64   `json:"threshold,omitempty"`
+	Reply     string    `json:"reply,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// Store is the history of the balances, one json object per line in a file.
+// The checks are few, a handful per SIM and week, so the file is never pruned.
+//
+// It is safe to use in multiple goroutines.
+type Store struct {
+	path string
+
+	mu      sync.Mutex
+	f       *os.File
+	last    map[string]Reading
+	amounts map[string]Reading
+}
+
+// Open opens the history in the file at path, creating it and its directory if
+// they do not exist.
+func Open(path string) (*Store, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return nil, err
+	}
+	s := &Store{path: path, last: make(map[string]Reading), amounts: make(map[string]Reading)}
+	_, err = s.read(func(v *Reading) bool {
+		if last, ok := s.last[v.IMEI]; !ok || !v.Time.Before(last.Time) {
+			s.last[v.IMEI] = *v
+		}
+		if last, ok := s.amounts[v.IMEI]; v.Amount != nil && (!ok || !v.Time.Before(last.Time)) {
+			s.amounts[v.IMEI] = *v
+		}
+		return false
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.f, err = os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Record appends the reading to the history. The time is set to now if it is
+// missing.
+func (s *Store) Record(v Reading) error {
+	if v.Time.IsZero() {
+		v.Time = time.Now()
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.f.Write(append(b, '\n'))
+	if err != nil {
+		return err
+	}
+	s.last[v.IMEI] = v
+	if v.Amount != nil {
+		s.amounts[v.IMEI] = v
+	}
+	return nil
+}
+
+// Last returns the latest reading of the modem with the imei.
+func (s *Store) Last(imei string) (Reading, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.last[imei]
+	return v, ok
+}
+
+// LastAmount returns the latest reading of the modem with the imei that has an
+// amount, the failed checks are skipped.
+func (s *Store) LastAmount(imei string) (Reading, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.amounts[imei]
+	return v, ok
+}
+
+// Query returns the readings of the modem with the imei taken from from to to,
+// both included, oldest first.
+func (s *Store) Query(imei string, from, to time.Time) ([]Reading, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list, err := s.read(func(v *Reading) bool {
+		return v.IMEI == imei && !v.Time.Before(from) && !v.Time.After(to)
+	})
+	sort.SliceStable(list, func(i, j int) bool { return list[i].Time.Before(list[j].Time) })
+	return list, err
+}
+
+// read returns the readings of the file matching keep. Lines that can not be
+// read, like the last one after a crash, are skipped.
+func (s *Store) read(keep func(*Reading) bool) ([]Reading, error) {
+	f, err := os.Open(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	var list []Reading
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var v Reading
+		if err := json.Unmarshal(sc.Bytes(), &v); err != nil {
+			continue
+		}
+		if keep(&v) {
+			list = append(list, v)
+		}
+	}
+	return list, sc.Err()
+}
+
+// Close closes the file.
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.f.Close()
+}
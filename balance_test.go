@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/FarmRadioHangar/fessboxconfig/audit"
+	"github.com/FarmRadioHangar/fessboxconfig/balance"
+	"github.com/FarmRadioHangar/fessboxconfig/device"
+	"github.com/gorilla/mux"
+)
+
+func TestBalances(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fconf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	store, err := balance.Open(filepath.Join(dir, "balance.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = store.Close() }()
+	l, err := audit.Open(filepath.Join(dir, "audit.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = l.Close() }()
+	e := device.NewEmulator("356789012345678", "640020123456789")
+	e.Manufacturer = "ZTE"
+	e.USSD = map[string]string{"*149#": "1. Salio", "*149#>1": "Salio lako ni TZS 1,200"}
+	cusd := `AT+CUSD=1,"*102#",15`
+	e.Reply(cusd, "OK", `+CUSD: 0,"Salio lako ni TZS 2,500.00",15`)
+	e.Reply(cusd, "OK", `+CUSD: 0,"Salio lako ni TZS 1,500.00",15`)
+	e.Reply(cusd, "OK", `+CUSD: 0,"Salio lako ni TZS 1,500.00",15`)
+	e.Reply(cusd, "OK", "+CUSD: 4")
+	e.Reply(cusd, "OK", `+CUSD: 0,"Salio lako ni TZS 1,200.00",15`)
+	e.Reply(cusd, "OK", `+CUSD: 0,"Salio lako ni TZS 3,000",15`)
+	m := device.New()
+	m.Open = e.Open
+	err = m.AddPort("/dev/ttyUSB0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = m.RemoveDevice("/dev/ttyUSB0") }()
+	cfg := defaultConfig()
+	cfg.BalanceChecks = []balance.Check{
+		{Prefix: "64002", Code: "*102#", Pattern: `TZS ([0-9,.]+)`, Currency: "TZS", Threshold: 2000},
+	}
+	b := newBalances(store)
+	events, cancel := m.Subscribe()
+	defer cancel()
+	mod, _ := m.Modem("356789012345678")
+	now := time.Now()
+	if !b.due(cfg, mod, now) {
+		t.Error("expected a modem never checked to be due")
+	}
+
+	b.run(context.Background(), m, cfg, now)
+	last, ok := store.Last("356789012345678")
+	if !ok || last.Amount == nil || *last.Amount != 2500 || last.Currency != "TZS" {
+		t.Fatalf("expected the balance to be recorded got %+v", last)
+	}
+	if b.due(cfg, mod, now.Add(time.Hour)) || !b.due(cfg, mod, now.Add(25*time.Hour)) {
+		t.Error("expected the next check a day later")
+	}
+
+	lows := func() int {
+		n := 0
+		for {
+			select {
+			case ev := <-events:
+				if ev.Type == device.EventLowBalance {
+					n++
+				}
+			default:
+				return n
+			}
+		}
+	}
+	if n := lows(); n != 0 {
+		t.Errorf("expected no low balance event got %d", n)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := b.check(context.Background(), m, cfg, mod); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := lows(); n != 1 {
+		t.Errorf("expected one low balance event when the balance drops got %d", n)
+	}
+
+	v, err := b.check(context.Background(), m, cfg, mod)
+	if err == nil || v.Amount != nil || v.Error == "" {
+		t.Errorf("expected a failed check got %+v %v", v, err)
+	}
+	if b.due(cfg, mod, v.Time.Add(30*time.Minute)) || !b.due(cfg, mod, v.Time.Add(time.Hour)) {
+		t.Error("expected a failed check to be tried again an hour later")
+	}
+	if _, err := b.check(context.Background(), m, cfg, mod); err != nil {
+		t.Fatal(err)
+	}
+	if n := lows(); n != 0 {
+		t.Errorf("expected no low balance event after a failed check got %d", n)
+	}
+
+	if _, err := m.USSD(context.Background(), "356789012345678", "*149#"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.check(context.Background(), m, cfg, mod); err != device.ErrUSSDBusy {
+		t.Errorf("expected no check during a USSD session got %v", err)
+	}
+	if err := m.CancelUSSD(context.Background(), "356789012345678"); err != nil {
+		t.Fatal(err)
+	}
+
+	ww := &web{cfg: cfg, manager: m, audit: l, balances: b}
+	router := mux.NewRouter()
+	router.HandleFunc("/serial/{imei}/balance", ww.Balance).Methods("GET")
+	router.HandleFunc("/serial/{imei}/balance", ww.CheckBalance).Methods("POST")
+	do := func(method, path string, out interface{}) int {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+		_ = json.NewDecoder(w.Body).Decode(out)
+		return w.Code
+	}
+	var reading balance.Reading
+	code := do("POST", "/serial/356789012345678/balance", &reading)
+	if code != http.StatusOK || reading.Amount == nil || *reading.Amount != 3000 {
+		t.Errorf("expected the balance to be checked got %d %+v", code, reading)
+	}
+	if code := do("POST", "/serial/356789012345670/balance", &reading); code != http.StatusNotFound {
+		t.Errorf("expected an unknown modem got %d", code)
+	}
+	var out struct {
+		Readings []balance.Reading `json:"readings"`
+	}
+	code = do("GET", "/serial/356789012345678/balance", &out)
+	if code != http.StatusOK || len(out.Readings) != 6 {
+		t.Errorf("expected six readings got %d %+v", code, out.Readings)
+	}
+	if code := do("GET", "/serial/356789012345678/balance?from=soon", &out); code != http.StatusBadRequest {
+		t.Errorf("expected a bad from to fail got %d", code)
+	}
+	entries, err := l.Query(&audit.Filter{Target: "356789012345678"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Action != audit.BalanceCheck || entries[0].After != "3000 TZS" {
+		t.Errorf("unexpected audit entries %+v", entries)
+	}
+}
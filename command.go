@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/FarmRadioHangar/fessboxconfig/asterisk"
+	"github.com/FarmRadioHangar/fessboxconfig/audit"
+	"github.com/FarmRadioHangar/fessboxconfig/auth"
+	"github.com/gorilla/mux"
+)
+
+const commandUsage = `usage:
+	fconf [-c config] user add NAME ROLE   add a user, the password is read from stdin
+	fconf [-c config] user remove NAME     remove a user
+	fconf [-c config] user list            list the users
+	fconf [-c config] config print         print the settings and where they come from
+	fconf [-c config] config adopt IMEI [NAME]
+	                                       add a dongle.conf section for a plugged in modem
+
+roles are viewer, operator and admin`
+
+// isCommand returns true if name is one of the commands handled by runCommand.
+// Other arguments are ignored, which keeps the old `fconf -dev true` working.
+func isCommand(name string) bool {
+	return name == "user" || name == "config"
+}
+
+// runCommand runs the command given on the command line instead of starting the
+// server.
+func runCommand(cfg *Config, src sources, args []string) error {
+	if len(args) < 2 {
+		return errors.New(commandUsage)
+	}
+	if args[0] == "config" {
+		switch {
+		case args[1] == "print" && len(args) == 2:
+			return printConfig(os.Stdout, cfg, src)
+		case args[1] == "adopt" && (len(args) == 3 || len(args) == 4):
+			return adoptCommand(cfg, args[2:])
+		}
+		return errors.New(commandUsage)
+	}
+	users, err := auth.Open(cfg.UsersFile)
+	if err != nil {
+		return err
+	}
+	switch args[1] {
+	case "add":
+		if len(args) != 4 {
+			return errors.New(commandUsage)
+		}
+		role, err := auth.ParseRole(args[3])
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "password for %s: ", args[2])
+		password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && password == "" {
+			return err
+		}
+		return users.Add(args[2], strings.TrimRight(password, "\r\n"), role)
+	case "remove":
+		if len(args) != 3 {
+			return errors.New(commandUsage)
+		}
+		return users.Remove(args[2])
+	case "list":
+		for _, u := range users.Users() {
+			fmt.Printf("%s\t%s\n", u.Name, u.Role)
+		}
+		return nil
+	}
+	return errors.New(commandUsage)
+}
+
+// adoptCommand adopts the modem with the imei in args, it is found through its
+// symlinks in /dev which are kept by the running server.
+func adoptCommand(cfg *Config, args []string) error {
+	m, ok := findModem(nil, args[0])
+	if !ok {
+		return errNoModem
+	}
+	var req adoptRequest
+	if len(args) > 1 {
+		req.Name = args[1]
+	}
+	res, err := adopt(cfg, m, req, reloaderFor(cfg, cfg.ReloadWhen, []string{asterisk.DongleConf}), verifierFor(cfg))
+	if res != nil && res.after != nil {
+		recordAdoption(cfg.AuditLog, os.Getenv("USER"), "cli", res, err)
+	}
+	if res != nil && res.Section != "" {
+		fmt.Printf("[%s] imei=%s imsi=%s\n", res.Section, m.IMEI, m.IMSI)
+	}
+	if res != nil && res.Report != nil {
+		for _, d := range res.Report.Devices {
+			fmt.Printf("%s\t%s\n", d.Device, d.State)
+		}
+	}
+	return err
+}
+
+// recordAdoption adds an adoption made outside of the api to the audit log at
+// path.
+func recordAdoption(path, user, source string, res *adoption, err error) {
+	l, oerr := audit.Open(path)
+	if oerr != nil {
+		log.Println(oerr)
+		return
+	}
+	defer func() { _ = l.Close() }()
+	recordAdoptionTo(l, user, source, res, err)
+}
+
+func recordAdoptionTo(l *audit.Log, user, source string, res *adoption, err error) {
+	e := audit.Entry{
+		User:   user,
+		Source: source,
+		Action: audit.ConfigWrite,
+		Target: asterisk.DongleConf,
+	}
+	e.Before, e.After = asterisk.Diff(res.before, res.after)
+	if err != nil {
+		e.Error = err.Error()
+	}
+	if rerr := l.Record(e); rerr != nil {
+		log.Println(rerr)
+	}
+}
+
+// removeUser returns a handler that deletes the user named in the url.
+func removeUser(users *auth.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		name := mux.Vars(r)["name"]
+		err := users.Remove(name)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			_ = json.NewEncoder(w).Encode(&errMSG{err.Error()})
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"name": name, "removed": true})
+	}
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/FarmRadioHangar/fessboxconfig/ami"
+)
+
+// envPrefix is the prefix of the environment variables that override settings,
+// for instance FCONF_PORT overrides port.
+const envPrefix = "FCONF_"
+
+// configLoader builds the configuration from several layers, each overriding
+// the previous one:
+//
+//	built in defaults
+//	the json configuration file
+//	FCONF_* environment variables
+//	command line flags
+type configLoader struct {
+	path string
+
+	// required is true when the configuration file was named explicitly, a
+	// missing file is only an error in that case.
+	required bool
+
+	// flags are the settings given on the command line, by json key.
+	flags map[string]string
+}
+
+// sources records where the value of each setting came from, by json key.
+type sources map[string]string
+
+// settingFlag is a command line flag for a single setting.
+type settingFlag struct {
+	key    string
+	isBool bool
+	flags  map[string]string
+}
+
+func (s *settingFlag) String() string { return "" }
+
+func (s *settingFlag) Set(v string) error {
+	s.flags[s.key] = v
+	return nil
+}
+
+func (s *settingFlag) IsBoolFlag() bool { return s.isBool }
+
+// registerFlags defines a command line flag for every setting in Config. The
+// flag has the same name as the json key, for instance -port and
+// -asterisk_config_dir.
+func (l *configLoader) registerFlags(fs *flag.FlagSet) {
+	l.flags = make(map[string]string)
+	t := reflect.TypeOf(Config{})
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		key := jsonKey(f)
+		fs.Var(&settingFlag{key: key, isBool: f.Type.Kind() == reflect.Bool, flags: l.flags},
+			key, fmt.Sprintf("overrides %s in the configuration file", key))
+	}
+}
+
+// load builds and validates the configuration.
+func (l *configLoader) load() (*Config, sources, error) {
+	cfg := defaultConfig()
+	src := make(sources)
+	v := reflect.ValueOf(cfg).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		src[jsonKey(t.Field(i))] = "default"
+	}
+
+	b, err := ioutil.ReadFile(l.path)
+	switch {
+	case err == nil:
+		keys, err := fileKeys(b)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", l.path, err)
+		}
+		for _, k := range keys {
+			if _, ok := src[k]; !ok {
+				return nil, nil, fmt.Errorf("%s: unknown setting %q", l.path, k)
+			}
+			src[k] = "file " + l.path
+		}
+		err = json.Unmarshal(b, cfg)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", l.path, err)
+		}
+	case os.IsNotExist(err) && !l.required:
+	default:
+		return nil, nil, err
+	}
+
+	for i := 0; i < t.NumField(); i++ {
+		key := jsonKey(t.Field(i))
+		name := envPrefix + strings.ToUpper(key)
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		err := setField(v.Field(i), value)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", name, err)
+		}
+		src[key] = "env " + name
+	}
+
+	for i := 0; i < t.NumField(); i++ {
+		key := jsonKey(t.Field(i))
+		value, ok := l.flags[key]
+		if !ok {
+			continue
+		}
+		err := setField(v.Field(i), value)
+		if err != nil {
+			return nil, nil, fmt.Errorf("-%s: %v", key, err)
+		}
+		src[key] = "flag -" + key
+	}
+
+	err = cfg.validate()
+	if err != nil {
+		return nil, nil, err
+	}
+	return cfg, src, nil
+}
+
+// fileKeys returns the top level keys of the json object in src.
+func fileKeys(src []byte) ([]string, error) {
+	var obj map[string]json.RawMessage
+	err := json.Unmarshal(src, &obj)
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func jsonKey(f reflect.StructField) string {
+	return strings.Split(f.Tag.Get("json"), ",")[0]
+}
+
+// setField sets the setting v from its text form. Lists of strings are comma
+// separated, the other lists are json.
+func setField(v reflect.Value, value string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%q is not a number", value)
+		}
+		v.SetInt(n)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%q is not true or false", value)
+		}
+		v.SetBool(b)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.String {
+			p := reflect.New(v.Type())
+			if err := json.Unmarshal([]byte(value), p.Interface()); err != nil {
+				return fmt.Errorf("%q is not a json list: %v", value, err)
+			}
+			v.Set(p.Elem())
+			return nil
+		}
+		var list []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		v.Set(reflect.ValueOf(list))
+	default:
+		return fmt.Errorf("unsupported setting type %s", v.Type())
+	}
+	return nil
+}
+
+// validate checks that the settings make sense together. All the problems are
+// reported at once.
+func (c *Config) validate() error {
+	var problems []string
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+	if c.Port < 1 || c.Port > 65535 {
+		add("port must be between 1 and 65535, got %d", c.Port)
+	}
+	if c.AsteriskConfig == "" {
+		add("asterisk_config_dir is required")
+	} else if info, err := os.Stat(c.AsteriskConfig); err == nil && !info.IsDir() {
+		add("asterisk_config_dir %s is not a directory", c.AsteriskConfig)
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		add("tls_cert and tls_key must be set together")
+	}
+	if c.UsersFile == "" {
+		add("users_file is required")
+	}
+	if c.AuditLog == "" {
+		add("audit_log is required")
+	}
+	for _, name := range c.ManagedFiles {
+		if name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+			add("managed_files: %q is not a plain file name", name)
+		}
+	}
+	for _, name := range c.ReadOnlyFiles {
+		found := false
+		for _, m := range c.ManagedFiles {
+			found = found || m == name
+		}
+		if !found {
+			add("read_only_files: %s is not in managed_files", name)
+		}
+	}
+	if !validWhen(c.ReloadWhen) {
+		add("reload_when must be one of now, gracefully or when convenient, got %q", c.ReloadWhen)
+	}
+	if c.VerifyTimeout < 0 {
+		add("verify_timeout must not be negative, got %d", c.VerifyTimeout)
+	}
+	if c.ModemRefresh <= 0 {
+		add("modem_refresh must be positive, got %d", c.ModemRefresh)
+	}
+	if c.HistoryDir != "" && c.HistoryRetention <= 0 {
+		add("history_retention must be positive, got %d", c.HistoryRetention)
+	}
+	if len(c.BalanceChecks) > 0 && c.BalanceInterval <= 0 {
+		add("balance_interval must be positive, got %d", c.BalanceInterval)
+	}
+	prefixes := make(map[string]bool)
+	for _, v := range c.BalanceChecks {
+		if err := v.Validate(); err != nil {
+			add("balance_checks: %v", err)
+		}
+		if prefixes[v.Prefix] {
+			add("balance_checks: prefix %s is given twice", v.Prefix)
+		}
+		prefixes[v.Prefix] = true
+	}
+	if c.AMIAddress != "" {
+		if _, _, err := net.SplitHostPort(c.AMIAddress); err != nil {
+			add("ami_address: %v", err)
+		}
+		if c.AMIUsername == "" {
+			add("ami_username is required with ami_address")
+		}
+	}
+	if c.MetricsToken != "" && len(c.MetricsToken) < 16 {
+		add("metrics_token must be at least 16 characters")
+	}
+	for _, v := range c.VirtualModems {
+		if _, _, err := parseVirtualModem(v); err != nil {
+			add("virtual_modems: %v", err)
+		}
+	}
+	if len(problems) > 0 {
+		return errors.New("invalid configuration:\n\t" + strings.Join(problems, "\n\t"))
+	}
+	return nil
+}
+
+func validWhen(when string) bool {
+	switch when {
+	case ami.Now, ami.Gracefully, ami.WhenConvenient:
+		return true
+	}
+	return false
+}
+
+// secretKeys are the settings that printConfig does not show.
+var secretKeys = map[string]bool{"ami_secret": true, "metrics_token": true}
+
+// printConfig writes every setting of cfg with the place its value came from.
+func printConfig(w io.Writer, cfg *Config, src sources) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	v := reflect.ValueOf(cfg).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		key := jsonKey(t.Field(i))
+		b, err := json.Marshal(v.Field(i).Interface())
+		if err != nil {
+			return err
+		}
+		if secretKeys[key] && v.Field(i).String() != "" {
+			b = []byte(`"********"`)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", key, b, src[key])
+	}
+	return tw.Flush()
+}
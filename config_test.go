@@ -0,0 +1,91 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConfigLoader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fconf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	path := filepath.Join(dir, "fconf.json")
+	err = ioutil.WriteFile(path, []byte(`{"port": 9000, "host": "127.0.0.1"}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Setenv("FCONF_HOST", "10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.Unsetenv("FCONF_HOST") }()
+
+	l := &configLoader{path: path, required: true, flags: map[string]string{"autodetect": "false"}}
+	cfg, src, err := l.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sample := []struct {
+		key, source string
+		ok          bool
+	}{
+		{"port", "file " + path, cfg.Port == 9000},
+		{"host", "env FCONF_HOST", cfg.Host == "10.0.0.1"},
+		{"autodetect", "flag -autodetect", !cfg.Autodetect},
+		{"asterisk_config_dir", "default", cfg.AsteriskConfig == "/etc/asterisk"},
+	}
+	for _, v := range sample {
+		if !v.ok {
+			t.Errorf("wrong value for %s", v.key)
+		}
+		if src[v.key] != v.source {
+			t.Errorf("%s: expected source %q got %q", v.key, v.source, src[v.key])
+		}
+	}
+
+	l.flags["reload_when"] = "later"
+	if _, _, err := l.load(); err == nil {
+		t.Error("expected invalid reload_when to fail")
+	}
+	delete(l.flags, "reload_when")
+
+	l.flags["virtual_modems"] = "356789012345678:640050123456789,35678901234:1"
+	if _, _, err := l.load(); err == nil {
+		t.Error("expected invalid virtual_modems to fail")
+	}
+	delete(l.flags, "virtual_modems")
+
+	l.flags["balance_checks"] = `[{"prefix":"64002","code":"*102#","pattern":"TZS ([0-9,.]+)"}]`
+	if cfg, _, err := l.load(); err != nil || len(cfg.BalanceChecks) != 1 || cfg.BalanceChecks[0].Code != "*102#" {
+		t.Errorf("expected the balance checks from json got %v", err)
+	}
+	l.flags["balance_checks"] = `[{"prefix":"64002","code":"*102#","pattern":"TZS [0-9]+"}]`
+	if _, _, err := l.load(); err == nil {
+		t.Error("expected a balance pattern without a group to fail")
+	}
+	delete(l.flags, "balance_checks")
+
+	l.flags["metrics_token"] = "secret"
+	if _, _, err := l.load(); err == nil {
+		t.Error("expected a short metrics token to fail")
+	}
+	delete(l.flags, "metrics_token")
+
+	l.flags["port"] = "0"
+	if _, _, err := l.load(); err == nil {
+		t.Error("expected invalid port to fail")
+	}
+
+	l = &configLoader{path: filepath.Join(dir, "missing.json")}
+	if _, _, err := l.load(); err != nil {
+		t.Errorf("expected the defaults when the file is missing got %v", err)
+	}
+	l.required = true
+	if _, _, err := l.load(); err == nil {
+		t.Error("expected missing file to fail")
+	}
+}
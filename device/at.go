@@ -0,0 +1,427 @@
+package device
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrTimeout is returned when the modem does not give a final result code
+// before the deadline of the command.
+var ErrTimeout = errors.New("the modem did not answer in time")
+
+// ErrTooLong is returned when an answer grows past maxResponse bytes without a
+// final result code.
+var ErrTooLong = errors.New("the answer of the modem is too long")
+
+// maxResponse bounds the size of an answer, a full SIM listed with AT+CMGL is
+// well below it.
+const maxResponse = 256 * 1024
+
+// settleTimeout is how long the late answer of a command that timed out is
+// waited for before the next command is sent.
+const settleTimeout = 2 * time.Second
+
+// defaultTimeout is the deadline of the commands missing from
+// commandTimeouts.
+const defaultTimeout = 5 * time.Second
+
+// commandTimeouts are the deadlines of the commands that wait for the network.
+var commandTimeouts = map[string]time.Duration{
+	"+CMGS": 60 * time.Second,
+	"+CMSS": 60 * time.Second,
+	"+CUSD": 30 * time.Second,
+	"+COPS": 180 * time.Second,
+	"+CMGL": 30 * time.Second,
+}
+
+// Timeout returns the deadline of the AT command cmd.
+func Timeout(cmd string) time.Duration {
+	name := strings.ToUpper(strings.TrimSpace(cmd))
+	name = strings.TrimPrefix(name, "AT")
+	if i := strings.IndexAny(name, "=?"); i != -1 {
+		name = name[:i]
+	}
+	if d, ok := commandTimeouts[name]; ok {
+		return d
+	}
+	return defaultTimeout
+}
+
+// Response is the answer of a modem to a command.
+type Response struct {
+	Command string
+
+	// Lines are the lines between the echo of the command and the final
+	// result code, the empty lines are dropped.
+	Lines []string
+
+	// Result is the final result code, like OK or +CME ERROR: 10.
+	Result string
+}
+
+// Value returns the first line of the answer, which holds the value asked for
+// by commands like AT+GSN.
+func (r *Response) Value() string {
+	if len(r.Lines) == 0 {
+		return ""
+	}
+	return r.Lines[0]
+}
+
+// String returns the lines and the result code, one per line.
+func (r *Response) String() string {
+	return strings.Join(append(append([]string(nil), r.Lines...), r.Result), "\n")
+}
+
+// ModemError is a final result code other than OK.
+type ModemError struct {
+	Command string
+	Result  string
+
+	// Kind is CME for equipment errors, CMS for message service errors and
+	// empty otherwise. Code is the number of the error or -1 when the modem
+	// gave no number.
+	Kind string
+	Code int
+}
+
+func (e *ModemError) Error() string {
+	if text := e.Text(); text != "" && text != e.Result {
+		return fmt.Sprintf("%s: %s (%s)", e.Command, e.Result, text)
+	}
+	return fmt.Sprintf("%s: %s", e.Command, e.Result)
+}
+
+// Text describes the error, it is the text sent by the modem when verbose
+// errors are on.
+func (e *ModemError) Text() string {
+	switch e.Kind {
+	case "CME":
+		if text, ok := cmeErrors[e.Code]; ok {
+			return text
+		}
+	case "CMS":
+		if text, ok := cmsErrors[e.Code]; ok {
+			return text
+		}
+	}
+	if i := strings.IndexRune(e.Result, ':'); i != -1 && e.Code == -1 {
+		return strings.TrimSpace(e.Result[i+1:])
+	}
+	return ""
+}
+
+var cmeErrors = map[int]string{
+	0:   "phone failure",
+	1:   "no connection to phone",
+	3:   "operation not allowed",
+	4:   "operation not supported",
+	10:  "SIM not inserted",
+	11:  "SIM PIN required",
+	12:  "SIM PUK required",
+	13:  "SIM failure",
+	14:  "SIM busy",
+	15:  "SIM wrong",
+	16:  "incorrect password",
+	17:  "SIM PIN2 required",
+	18:  "SIM PUK2 required",
+	20:  "memory full",
+	21:  "invalid index",
+	22:  "not found",
+	23:  "memory failure",
+	24:  "text string too long",
+	25:  "invalid characters in text string",
+	26:  "dial string too long",
+	27:  "invalid characters in dial string",
+	30:  "no network service",
+	31:  "network timeout",
+	32:  "network not allowed, emergency calls only",
+	100: "unknown error",
+}
+
+var cmsErrors = map[int]string{
+	300: "ME failure",
+	301: "SMS service of ME reserved",
+	302: "operation not allowed",
+	303: "operation not supported",
+	304: "invalid PDU mode parameter",
+	305: "invalid text mode parameter",
+	310: "SIM not inserted",
+	311: "SIM PIN required",
+	313: "SIM failure",
+	314: "SIM busy",
+	315: "SIM wrong",
+	320: "memory failure",
+	321: "invalid memory index",
+	322: "memory full",
+	330: "SMSC address unknown",
+	331: "no network service",
+	332: "network timeout",
+	340: "no +CNMA acknowledgement expected",
+	500: "unknown error",
+}
+
+// finalResult returns the error of the final result code line, ok is false if
+// line is not a final result code.
+func finalResult(cmd, line string) (err error, ok bool) {
+	switch line {
+	case "OK":
+		return nil, true
+	case "ERROR", "NO CARRIER", "BUSY", "NO ANSWER", "NO DIALTONE":
+		return &ModemError{Command: cmd, Result: line, Code: -1}, true
+	}
+	for _, kind := range []string{"CME", "CMS"} {
+		prefix := "+" + kind + " ERROR:"
+		if !strings.HasPrefix(line, prefix) {
+			continue
+		}
+		code, err := strconv.Atoi(strings.TrimSpace(line[len(prefix):]))
+		if err != nil {
+			code = -1
+		}
+		return &ModemError{Command: cmd, Result: line, Kind: kind, Code: code}, true
+	}
+	return nil, false
+}
+
+// urcPrefixes are the prefixes of the unsolicited result codes the modems send
+// on their own, the Huawei ones start with ^.
+var urcPrefixes = []string{
+	"+CMTI:", "+CMT:", "+CDSI:", "+CDS:", "+CBM:", "+CUSD:", "+CREG:", "+CGREG:",
+	"+CLIP:", "+CRING:", "RING", "^",
+}
+
+// bodyPrefixes are the unsolicited result codes followed by a second line, the
+// PDU of the message or report.
+var bodyPrefixes = []string{"+CMT:", "+CDS:", "+CBM:"}
+
+// unsolicited returns true if line is an unsolicited result code and not the
+// answer of cmd, AT+CREG? is answered with a +CREG line for instance. The name
+// of the code up to the colon is compared, so ^RSSI is unsolicited while
+// AT^SYSCFG? runs.
+func unsolicited(cmd, line string) bool {
+	name := strings.TrimPrefix(strings.ToUpper(cmd), "AT")
+	for _, p := range urcPrefixes {
+		if !strings.HasPrefix(line, p) {
+			continue
+		}
+		code := line
+		if i := strings.IndexByte(line, ':'); i != -1 {
+			code = line[:i]
+		}
+		return !strings.HasPrefix(name, code)
+	}
+	return false
+}
+
+// AT runs commands over a port and reads the answers line by line. It expects
+// the reads of the port to time out, a read returning nothing is retried until
+// the deadline of the command.
+//
+// It is not safe to use concurrently.
+type AT struct {
+	port Port
+	buf  []byte
+
+	// Unsolicited is called with the lines read while no command is waiting
+	// for them, like +CMTI when a message comes in. A +CMT, +CDS or +CBM line
+	// is given with the line after it, separated by a line feed. It may be
+	// nil.
+	Unsolicited func(line string)
+
+	// head is the unsolicited line waiting for its second line.
+	head string
+}
+
+// NewAT returns an AT command engine on port.
+func NewAT(port Port) *AT {
+	return &AT{port: port}
+}
+
+// Run sends cmd and waits for its final result code until its Timeout. The
+// response holds what was read, also when the command failed. A final result
+// code other than OK gives a *ModemError.
+func (a *AT) Run(cmd string) (*Response, error) {
+	return a.run(cmd, "", false, Timeout(cmd))
+}
+
+// RunTimeout is Run with the deadline d instead of the default one.
+func (a *AT) RunTimeout(cmd string, d time.Duration) (*Response, error) {
+	return a.run(cmd, "", false, d)
+}
+
+// RunPrompt sends cmd, waits for the > prompt and sends body ended by ctrl-z,
+// as done by AT+CMGS to send a message.
+func (a *AT) RunPrompt(cmd, body string) (*Response, error) {
+	return a.run(cmd, body, true, Timeout(cmd))
+}
+
+func (a *AT) run(cmd, body string, prompt bool, timeout time.Duration) (*Response, error) {
+	cmd = strings.TrimSpace(cmd)
+	resp := &Response{Command: cmd}
+	deadline := time.Now().Add(timeout)
+	a.drain()
+	_, err := a.port.Write([]byte(cmd + "\r"))
+	if err != nil {
+		return resp, err
+	}
+	// echo is what the modem may repeat before answering, the command and
+	// then the body typed after the prompt.
+	echo, size := cmd, 0
+	for {
+		if prompt && a.prompted() {
+			prompt, echo = false, strings.TrimSpace(body)
+			_, err = a.port.Write([]byte(body + "\x1a"))
+			if err != nil {
+				return resp, err
+			}
+			continue
+		}
+		line, ok := a.line()
+		if !ok {
+			if time.Now().After(deadline) {
+				return resp, ErrTimeout
+			}
+			if err := a.fill(); err != nil {
+				return resp, err
+			}
+			continue
+		}
+		if line == "" {
+			continue
+		}
+		if a.head != "" || unsolicited(cmd, line) {
+			a.urc(line)
+			continue
+		}
+		if echo != "" && strings.EqualFold(line, echo) {
+			echo = ""
+			continue
+		}
+		echo = ""
+		if err, ok := finalResult(cmd, line); ok {
+			resp.Result = line
+			return resp, err
+		}
+		size += len(line)
+		if size > maxResponse {
+			return resp, ErrTooLong
+		}
+		resp.Lines = append(resp.Lines, line)
+	}
+}
+
+// Settle reads what the modem still sends for a command that timed out, up to
+// its final result code or for d, so the late answer is not taken for the one
+// of the next command. The unsolicited lines read meanwhile are handed to
+// Unsolicited.
+func (a *AT) Settle(d time.Duration) error {
+	deadline := time.Now().Add(d)
+	for {
+		line, ok := a.line()
+		if !ok {
+			if time.Now().After(deadline) {
+				return nil
+			}
+			if err := a.fill(); err != nil {
+				return err
+			}
+			continue
+		}
+		if line == "" {
+			continue
+		}
+		if a.head != "" || unsolicited("", line) {
+			a.urc(line)
+			continue
+		}
+		if _, ok := finalResult("", line); ok {
+			return nil
+		}
+	}
+}
+
+// Poll waits for the data the modem sends on its own, up to the read timeout of
+// the port, and hands the complete lines to Unsolicited.
+func (a *AT) Poll() error {
+	err := a.fill()
+	a.drain()
+	return err
+}
+
+// drain hands the lines read before a command to Unsolicited.
+func (a *AT) drain() {
+	for {
+		line, ok := a.line()
+		if !ok {
+			break
+		}
+		if line != "" {
+			a.urc(line)
+		}
+	}
+}
+
+// urc hands an unsolicited line to Unsolicited, the lines starting with one of
+// bodyPrefixes once the line after them is read too.
+func (a *AT) urc(line string) {
+	if a.head != "" {
+		line, a.head = a.head+"\n"+line, ""
+	} else {
+		for _, p := range bodyPrefixes {
+			if strings.HasPrefix(line, p) {
+				a.head = line
+				return
+			}
+		}
+	}
+	if a.Unsolicited != nil {
+		a.Unsolicited(line)
+	}
+}
+
+// line takes the next complete line out of the buffer. The line ends at a
+// carriage return or a line feed, the NUL bytes some modems pad with are
+// dropped.
+func (a *AT) line() (string, bool) {
+	i := bytes.IndexAny(a.buf, "\r\n")
+	if i == -1 {
+		return "", false
+	}
+	line := string(bytes.TrimSpace(bytes.Trim(a.buf[:i], "\x00")))
+	a.buf = a.buf[i+1:]
+	return line, true
+}
+
+// prompted returns true and drops the prompt if the buffer holds the > prompt,
+// which is not followed by a line end.
+func (a *AT) prompted() bool {
+	s := bytes.TrimLeft(a.buf, "\r\n")
+	if bytes.HasPrefix(s, []byte(">")) {
+		a.buf = a.buf[:0]
+		return true
+	}
+	return false
+}
+
+// fill reads from the port into the buffer, a read that times out is not an
+// error.
+func (a *AT) fill() error {
+	if len(a.buf) > maxResponse {
+		a.buf = a.buf[:0]
+		return ErrTooLong
+	}
+	b := make([]byte, 512)
+	n, err := a.port.Read(b)
+	a.buf = append(a.buf, b[:n]...)
+	if err == io.EOF && n == 0 {
+		time.Sleep(10 * time.Millisecond)
+		return nil
+	}
+	return err
+}
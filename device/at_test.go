@@ -0,0 +1,99 @@
+package device
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAT(t *testing.T) {
+	e := NewEmulator("356789012345678", "")
+	e.ReadTimeout = 20 * time.Millisecond
+	a := NewAT(e)
+	var urc []string
+	a.Unsolicited = func(line string) {
+		urc = append(urc, line)
+	}
+
+	r, err := a.Run("AT+GSN")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Value() != "356789012345678" || r.Result != "OK" || len(r.Lines) != 1 {
+		t.Errorf("unexpected response %+v", r)
+	}
+
+	_, err = a.Run("AT+CIMI")
+	me, ok := err.(*ModemError)
+	if !ok || me.Kind != "CME" || me.Code != 10 || me.Text() != "SIM not inserted" {
+		t.Errorf("expected SIM not inserted got %v", err)
+	}
+	e.Reply("AT+CPIN?", "+CME ERROR: SIM PIN required")
+	_, err = a.Run("AT+CPIN?")
+	if me, ok := err.(*ModemError); !ok || me.Code != -1 || me.Text() != "SIM PIN required" {
+		t.Errorf("expected the verbose error got %v", err)
+	}
+
+	long := strings.Repeat("x", 100)
+	var lines []string
+	for i := 0; i < 100; i++ {
+		lines = append(lines, long)
+	}
+	e.Reply("AT+CMGL=\"ALL\"", append(lines, "OK")...)
+	r, err = a.Run("AT+CMGL=\"ALL\"")
+	if err != nil || len(r.Lines) != 100 {
+		t.Errorf("expected 100 lines got %d: %v", len(r.Lines), err)
+	}
+
+	e.Unsolicited("+CMTI: \"SM\",3")
+	r, err = a.RunPrompt("AT+CMGS=\"+255700000001\"", "hello")
+	if err != nil || r.Value() != "+CMGS: 1" {
+		t.Errorf("expected the message reference got %+v: %v", r, err)
+	}
+	if len(urc) != 1 || urc[0] != "+CMTI: \"SM\",3" {
+		t.Errorf("expected the unsolicited line got %v", urc)
+	}
+
+	// Huawei codes are told apart by their name, a PDU follows +CMT
+	e.Reply("AT^SYSCFG?", "^RSSI:18", "^SYSCFG:2,2,3FFFFFFF,1,2", "OK")
+	r, err = a.Run("AT^SYSCFG?")
+	if err != nil || len(r.Lines) != 1 || r.Value() != "^SYSCFG:2,2,3FFFFFFF,1,2" {
+		t.Errorf("expected only the ^SYSCFG line got %+v: %v", r, err)
+	}
+	e.Reply("AT+CSQ", "+CMT: ,24", "07915892000000F0040B915892214365F7000021", "+CSQ: 18,99", "OK")
+	r, err = a.Run("AT+CSQ")
+	if err != nil || len(r.Lines) != 1 || r.Value() != "+CSQ: 18,99" {
+		t.Errorf("expected only the +CSQ line got %+v: %v", r, err)
+	}
+	expect := []string{"+CMTI: \"SM\",3", "^RSSI:18", "+CMT: ,24\n07915892000000F0040B915892214365F7000021"}
+	if strings.Join(urc, "|") != strings.Join(expect, "|") {
+		t.Errorf("expected %q got %q", expect, urc)
+	}
+
+	e.Reply("AT+CSQ")
+	if _, err = a.RunTimeout("AT+CSQ", 100*time.Millisecond); err != ErrTimeout {
+		t.Errorf("expected a timeout got %v", err)
+	}
+
+	e.Delay = 200 * time.Millisecond
+	if _, err = a.RunTimeout("AT+CSQ", 100*time.Millisecond); err != ErrTimeout {
+		t.Errorf("expected a timeout got %v", err)
+	}
+	if err = a.Settle(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	e.Delay = 0
+	r, err = a.Run("AT+GSN")
+	if err != nil || r.Value() != "356789012345678" {
+		t.Errorf("expected the late answer to be dropped got %+v: %v", r, err)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	if d := Timeout("AT+CMGS=\"+255700000001\""); d != 60*time.Second {
+		t.Errorf("expected 60s got %v", d)
+	}
+	if d := Timeout("at+gsn"); d != defaultTimeout {
+		t.Errorf("expected the default got %v", d)
+	}
+}
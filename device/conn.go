@@ -0,0 +1,279 @@
+package device
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/tarm/serial"
+)
+
+// ErrClosed is returned for the commands sent to a closed Conn.
+var ErrClosed = errors.New("the connection to the modem is closed")
+
+// Priority orders the commands waiting for a modem, the higher ones are sent
+// first and the ones with the same priority in the order they came.
+type Priority int
+
+// The priorities of the commands. Background polls use Low so they never hold
+// up a user, and High is for the commands a user is waiting on in real time.
+const (
+	Low Priority = iota
+	Normal
+	High
+)
+
+// Conn is a device serial connection. The port is opened on the first
+// command and kept open, one goroutine owns it and sends the queued commands
+// one at a time so the bytes of concurrent commands are never mixed.
+//
+// This is safe to use concurrently in multiple goroutines.
+type Conn struct {
+	device      serial.Config
+	open        Opener
+	onRun       func(cmd string, err error)
+	onUnsolicit func(line string)
+
+	mu     sync.Mutex
+	queue  []*request
+	seq    uint64
+	wake   chan struct{}
+	quit   chan struct{}
+	done   chan struct{}
+	closed bool
+
+	// port and at are only used by the goroutine started by start.
+	port Port
+	at   *AT
+}
+
+// request is a command waiting in the queue of a Conn.
+type request struct {
+	ctx    context.Context
+	setup  string
+	cmd    string
+	body   string
+	prompt bool
+	prio   Priority
+	seq    uint64
+	result chan result
+}
+
+type result struct {
+	resp *Response
+	err  error
+}
+
+// Run sends the command to the modem with Normal priority and returns its
+// answer.
+func (c *Conn) Run(cmd string) (*Response, error) {
+	return c.Do(context.Background(), Normal, cmd)
+}
+
+// Do queues cmd with the priority and waits for the answer. When ctx is done
+// first its error is returned, a command already sent still runs to the end so
+// its answer is not mistaken for the one of the next command.
+func (c *Conn) Do(ctx context.Context, prio Priority, cmd string) (*Response, error) {
+	return c.do(&request{ctx: ctx, cmd: cmd, prio: prio})
+}
+
+// Prompt is Do for the commands like AT+CMGS that wait for a > prompt, body is
+// sent after the prompt.
+func (c *Conn) Prompt(ctx context.Context, prio Priority, cmd, body string) (*Response, error) {
+	return c.do(&request{ctx: ctx, cmd: cmd, body: body, prompt: true, prio: prio})
+}
+
+// inPDU is Do, or Prompt when body is not empty, with the message format set to
+// PDU right before cmd in the same turn, so a command of another client can not
+// switch it to text in between.
+func (c *Conn) inPDU(ctx context.Context, prio Priority, cmd, body string) (*Response, error) {
+	return c.do(&request{ctx: ctx, setup: "AT+CMGF=0", cmd: cmd, body: body, prompt: body != "", prio: prio})
+}
+
+func (c *Conn) do(req *request) (*Response, error) {
+	req.result = make(chan result, 1)
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, ErrClosed
+	}
+	c.start()
+	c.seq++
+	req.seq = c.seq
+	c.push(req)
+	c.mu.Unlock()
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+	var res result
+	select {
+	case res = <-req.result:
+	case <-req.ctx.Done():
+		res.err = req.ctx.Err()
+	}
+	if c.onRun != nil {
+		c.onRun(req.cmd, res.err)
+	}
+	return res.resp, res.err
+}
+
+// start starts the goroutine owning the port, c.mu must be held.
+func (c *Conn) start() {
+	if c.wake != nil {
+		return
+	}
+	c.wake = make(chan struct{}, 1)
+	c.quit = make(chan struct{})
+	c.done = make(chan struct{})
+	go c.loop()
+}
+
+// push inserts req after the requests with the same or a higher priority,
+// c.mu must be held.
+func (c *Conn) push(req *request) {
+	i := len(c.queue)
+	for i > 0 && c.queue[i-1].prio < req.prio {
+		i--
+	}
+	c.queue = append(c.queue, nil)
+	copy(c.queue[i+1:], c.queue[i:])
+	c.queue[i] = req
+}
+
+// pop returns the next request, or nil when the queue is empty.
+func (c *Conn) pop() *request {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.queue) == 0 {
+		return nil
+	}
+	req := c.queue[0]
+	c.queue = c.queue[1:]
+	return req
+}
+
+// SetUnsolicited sets the function called with the unsolicited result codes
+// of the modem. It is called from the goroutine owning the port and must not
+// send commands to c.
+func (c *Conn) SetUnsolicited(fn func(line string)) {
+	c.mu.Lock()
+	c.onUnsolicit = fn
+	c.mu.Unlock()
+}
+
+func (c *Conn) unsolicited(line string) {
+	c.mu.Lock()
+	fn := c.onUnsolicit
+	c.mu.Unlock()
+	if fn != nil {
+		fn(line)
+	}
+}
+
+// loop sends the queued commands. Between commands it reads the port so the
+// unsolicited result codes are seen as they come.
+func (c *Conn) loop() {
+	defer close(c.done)
+	for {
+		select {
+		case <-c.quit:
+			return
+		default:
+		}
+		if req := c.pop(); req != nil {
+			if err := req.ctx.Err(); err != nil {
+				req.result <- result{err: err}
+				continue
+			}
+			resp, err := c.exec(req)
+			req.result <- result{resp: resp, err: err}
+			if err == ErrTimeout && c.at != nil {
+				// the answer may still come, it must not be read as the
+				// one of the next command.
+				if c.at.Settle(settleTimeout) != nil {
+					c.reset()
+				}
+			}
+			continue
+		}
+		if c.port != nil {
+			if err := c.at.Poll(); err != nil {
+				c.reset()
+			}
+			continue
+		}
+		select {
+		case <-c.quit:
+			return
+		case <-c.wake:
+		}
+	}
+}
+
+// exec runs req on the port, opening it if needed, after its setup command
+// when it has one. The port is closed after an i/o error so the next command
+// opens it again.
+func (c *Conn) exec(req *request) (*Response, error) {
+	if c.port == nil {
+		open := c.open
+		if open == nil {
+			open = openSerial
+		}
+		p, err := open(&c.device)
+		if err != nil {
+			return nil, err
+		}
+		c.port, c.at = p, NewAT(p)
+		c.at.Unsolicited = c.unsolicited
+	}
+	var resp *Response
+	var err error
+	if req.setup != "" {
+		resp, err = c.at.Run(req.setup)
+	}
+	switch {
+	case err != nil:
+	case req.prompt:
+		resp, err = c.at.RunPrompt(req.cmd, req.body)
+	default:
+		resp, err = c.at.Run(req.cmd)
+	}
+	if _, ok := err.(*ModemError); err != nil && !ok && err != ErrTimeout {
+		c.reset()
+	}
+	return resp, err
+}
+
+// reset closes the port after an i/o error, the next command opens it again.
+func (c *Conn) reset() {
+	_ = c.port.Close()
+	c.port, c.at = nil, nil
+}
+
+// Close stops the goroutine owning the port and closes the port. The commands
+// still queued fail with ErrClosed.
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	started := c.wake != nil
+	queue := c.queue
+	c.queue = nil
+	c.mu.Unlock()
+	for _, req := range queue {
+		req.result <- result{err: ErrClosed}
+	}
+	if !started {
+		return nil
+	}
+	close(c.quit)
+	<-c.done
+	if c.port != nil {
+		return c.port.Close()
+	}
+	return nil
+}
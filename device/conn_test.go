@@ -0,0 +1,82 @@
+package device
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConnConcurrent(t *testing.T) {
+	e := NewEmulator("356789012345678", "640050123456789")
+	e.Delay = time.Millisecond
+	c := emulatorConn(e)
+	defer func() { _ = c.Close() }()
+	expect := map[string]string{
+		"AT+GSN":  "356789012345678",
+		"AT+CIMI": "640050123456789",
+		"AT+CGMI": "huawei",
+		"AT+CSQ":  "+CSQ: 18,99",
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, 40)
+	for i := 0; i < 10; i++ {
+		for cmd, value := range expect {
+			wg.Add(1)
+			go func(cmd, value string) {
+				defer wg.Done()
+				r, err := c.Run(cmd)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if r.Value() != value {
+					errs <- fmt.Errorf("%s: expected %s got %+v", cmd, value, r)
+				}
+			}(cmd, value)
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestConnPriority(t *testing.T) {
+	e := NewEmulator("356789012345678", "640050123456789")
+	e.Delay = 50 * time.Millisecond
+	c := emulatorConn(e)
+	defer func() { _ = c.Close() }()
+	var mu sync.Mutex
+	var order []string
+	var wg sync.WaitGroup
+	run := func(ctx context.Context, prio Priority, cmd string) {
+		defer wg.Done()
+		_, err := c.Do(ctx, prio, cmd)
+		mu.Lock()
+		order = append(order, fmt.Sprintf("%s %v", cmd, err))
+		mu.Unlock()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	wg.Add(4)
+	go run(context.Background(), Normal, "AT")
+	time.Sleep(10 * time.Millisecond)
+	go run(context.Background(), Low, "AT+CSQ")
+	go run(ctx, Normal, "AT+CIMI")
+	time.Sleep(10 * time.Millisecond)
+	go run(context.Background(), High, "AT+GSN")
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	wg.Wait()
+	expect := "[AT+CIMI context canceled AT <nil> AT+GSN <nil> AT+CSQ <nil>]"
+	if fmt.Sprint(order) != expect {
+		t.Errorf("expected %s got %v", expect, order)
+	}
+
+	_ = c.Close()
+	if _, err := c.Run("AT"); err != ErrClosed {
+		t.Errorf("expected ErrClosed got %v", err)
+	}
+}
@@ -2,6 +2,7 @@ package device
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -12,10 +13,10 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 	"unicode"
-	"unicode/utf8"
 
 	"github.com/gorilla/websocket"
 	"github.com/jochenvg/go-udev"
@@ -29,10 +30,8 @@ var modemCommands = struct {
 }
 var upgrader = websocket.Upgrader{}
 
-type Message struct {
-	Type string                 `json:"type"`
-	Data map[string]interface{} `json:"data"`
-}
+// ErrNoModem is returned for an IMEI that is not one of the modems.
+var ErrNoModem = errors.New("unknown modem")
 
 // Manager manages devices that are plugged into the system. It supports auto
 // detection of devices.
@@ -51,9 +50,55 @@ type Manager struct {
 	monitor *udev.Monitor
 	done    chan struct{}
 	stop    chan struct{}
-	events  chan *Message
+	clients map[*websocket.Conn]bool
+	subs    map[chan Event]bool
+	ussd    map[string]*ussdSession
+
+	// OnChange is called when a modem is added or removed. action is either
+	// add or remove, target identifies the device and summary describes it.
+	OnChange func(action, target, summary string)
+
+	// Heartbeat is called every HeartbeatInterval and after each udev event
+	// by the goroutine handling the udev events. It stops being called if
+	// that goroutine gets stuck or the udev monitor stops, which makes it
+	// suitable for feeding a watchdog.
+	Heartbeat         func()
+	HeartbeatInterval time.Duration
+
+	// OnCommand is called after every AT command sent to a modem with the
+	// error returned by the modem, if any.
+	OnCommand func(imei, cmd string, err error)
+
+	// OnRefresh is called with a copy of the modem each time its volatile
+	// state has been queried.
+	OnRefresh func(mod Modem)
+
+	// RefreshInterval is how often the volatile state of the modems, like
+	// the signal quality and the network registration, is queried. It defaults to refreshInterval.
+	RefreshInterval time.Duration
+
+	// USSDTimeout is how long a USSD session waits for an answer before it
+	// is cancelled. It defaults to ussdTimeout.
+	USSDTimeout time.Duration
+
+	// Open opens the serial ports of the devices. It defaults to opening the
+	// tty, tests set it to talk to emulated modems.
+	Open Opener
+
+	quit    chan struct{}
+	virtual []*VirtualModem
+
+	// beat is the unix time in nanoseconds of the last pass of the goroutine
+	// watching udev.
+	beat int64
 }
 
+// beatInterval is how often the udev goroutine reports that it is alive.
+const beatInterval = 10 * time.Second
+
+// refreshInterval is how often the volatile state of the modems is queried.
+const refreshInterval = time.Minute
+
 // New returns a new Manager instance
 func New() *Manager {
 	return &Manager{
@@ -61,7 +106,10 @@ func New() *Manager {
 		modems:  make(map[string]*Modem),
 		done:    make(chan struct{}),
 		stop:    make(chan struct{}),
-		events:  make(chan *Message),
+		clients: make(map[*websocket.Conn]bool),
+		subs:    make(map[chan Event]bool),
+		ussd:    make(map[string]*ussdSession),
+		quit:    make(chan struct{}),
 	}
 }
 
@@ -80,11 +128,85 @@ func (m *Manager) Init() {
 		panic(err)
 	}
 	m.monitor = monitor
+	m.watch(devCh)
+}
+
+// InitVirtual initializes the manager with virtual modems instead of udev. The
+// modems are added like the ttys reported by udev, Plug and Unplug add and
+// remove more of them later. They are closed with the manager.
+func (m *Manager) InitVirtual(modems []*VirtualModem) {
+	for _, v := range modems {
+		err := m.Plug(v)
+		if err != nil {
+			log.Printf("virtual modem %s: %v\n", v.Path(), err)
+		}
+	}
+	m.watch(nil)
+}
+
+// Plug adds the virtual modem to the manager.
+func (m *Manager) Plug(v *VirtualModem) error {
+	m.mu.Lock()
+	m.virtual = append(m.virtual, v)
+	m.mu.Unlock()
+	err := m.AddPort(v.Path())
+	if err != nil {
+		return err
+	}
+	return m.Symlink()
+}
+
+// Unplug removes the virtual modem from the manager and closes it.
+func (m *Manager) Unplug(v *VirtualModem) error {
+	m.mu.Lock()
+	for i, vv := range m.virtual {
+		if vv == v {
+			m.virtual = append(m.virtual[:i], m.virtual[i+1:]...)
+			break
+		}
+	}
+	m.mu.Unlock()
+	err := m.RemoveDevice(v.Path())
+	if cerr := v.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// watch starts the goroutines handling the udev events from devCh, which is
+// nil without udev, the heartbeat and the refresh of the modems.
+func (m *Manager) watch(devCh <-chan *udev.Device) {
+	interval := beatInterval
+	if m.Heartbeat != nil && m.HeartbeatInterval > 0 && m.HeartbeatInterval < interval {
+		interval = m.HeartbeatInterval
+	}
+	atomic.StoreInt64(&m.beat, time.Now().UnixNano())
 	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		// alive turns false when the udev monitor closes its channel, the
+		// heartbeat stops then so the watchdog restarts fconf.
+		alive := true
+		beat := func(now time.Time) {
+			if !alive {
+				return
+			}
+			atomic.StoreInt64(&m.beat, now.UnixNano())
+			if m.Heartbeat != nil {
+				m.Heartbeat()
+			}
+		}
 	stop:
 		for {
 			select {
-			case d := <-devCh:
+			case now := <-t.C:
+				beat(now)
+			case d, ok := <-devCh:
+				if !ok {
+					log.Println("the udev monitor stopped")
+					alive, devCh = false, nil
+					continue
+				}
 				dpath := filepath.Join("/dev", filepath.Base(d.Devpath()))
 				switch d.Action() {
 				case "add":
@@ -94,16 +216,18 @@ func (m *Manager) Init() {
 				case "remove":
 					fmt.Println(" removed device " + dpath)
 
-					//TODO remove symlinks after the modem is remoed
 					m.RemoveDevice(dpath)
 				}
+				beat(time.Now())
 			case quit := <-m.stop:
-				m.done <- quit
+				if devCh != nil {
+					m.done <- quit
+				}
 				break stop
 			}
 		}
 	}()
-
+	go m.refreshLoop()
 }
 
 func (m *Manager) startup() {
@@ -134,37 +258,58 @@ func (m *Manager) AddDevice(d *udev.Device) error {
 }
 func (m *Manager) addDevice(d *udev.Device) error {
 	name := filepath.Join("/dev", filepath.Base(d.Devpath()))
-	cfg := serial.Config{Name: name, Baud: 9600, ReadTimeout: 10 * time.Second}
-	conn := &Conn{device: cfg}
 	if strings.Contains(name, "ttyUSB") {
-		fmt.Println("checking modem")
-		modem, err := newModem(conn)
+		return m.AddPort(name)
+	}
+	return nil
+}
+
+// AddPort probes the tty name for a modem and adds it to the manager. A modem
+// answering on several ttys is kept on the one with the lowest number. Unlike
+// AddDevice no symlinks are made.
+func (m *Manager) AddPort(name string) error {
+	cfg := serial.Config{Name: name, Baud: 9600, ReadTimeout: readTimeout}
+	conn := &Conn{device: cfg, open: m.Open}
+	fmt.Println("checking modem")
+	modem, err := newModem(conn)
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	fmt.Println("found ", *modem)
+	if mm, ok := m.getModem(modem.IMEI); ok {
+		n1, err := getttyNum(mm.Path)
 		if err != nil {
+			_ = conn.Close()
 			return err
 		}
-		fmt.Println("found ", *modem)
-		if mm, ok := m.getModem(modem.IMEI); ok {
-			n1, err := getttyNum(mm.Path)
-			if err != nil {
-				return err
-			}
-			n2, err := getttyNum(modem.Path)
-			if err != nil {
-				return err
-			}
-			if n1 > n2 {
-				m.setModem(modem)
-			}
+		n2, err := getttyNum(modem.Path)
+		if err != nil {
+			_ = conn.Close()
+			return err
+		}
+		if n1 > n2 {
+			m.probe(modem)
+			m.refresh(modem)
+			m.setModem(modem)
+			_ = mm.conn.Close()
 			return nil
 		}
-		m.setModem(modem)
+		_ = conn.Close()
+		return nil
 	}
+	m.probe(modem)
+	m.refresh(modem)
+	m.setModem(modem)
+	m.notify("add", modem.IMEI, fmt.Sprintf("imsi=%s tty=%s", modem.IMSI, modem.Path))
 	return nil
 }
 
+// Symlink links every modem detected so far by its IMEI and IMSI. It works on
+// copies of the modems so the manager is not locked while it touches /dev.
 func (m *Manager) Symlink() error {
 	fmt.Println("SYMLINKING")
-	for _, v := range m.modems {
+	for _, v := range m.Modems() {
 		err := v.Symlink()
 		if err != nil {
 			fmt.Printf(" ERROR %v\n", err)
@@ -177,6 +322,17 @@ func (m *Manager) Symlink() error {
 
 func (m *Manager) setModem(mod *Modem) {
 	fmt.Println("SETTING UP " + mod.IMEI)
+	if mod.conn != nil {
+		imei := mod.IMEI
+		mod.conn.onRun = func(cmd string, err error) {
+			if m.OnCommand != nil {
+				m.OnCommand(imei, cmd, err)
+			}
+		}
+		mod.conn.SetUnsolicited(func(line string) {
+			m.unsolicited(imei, line)
+		})
+	}
 	m.mu.Lock()
 	m.modems[mod.IMEI] = mod
 	m.mu.Unlock()
@@ -189,6 +345,80 @@ func (m *Manager) getModem(imei string) (*Modem, bool) {
 	return mod, ok
 }
 
+func (m *Manager) notify(action, target, summary string) {
+	if m.OnChange != nil {
+		m.OnChange(action, target, summary)
+	}
+	m.publish(Event{Type: action, IMEI: target, Time: time.Now(), Line: summary})
+}
+
+// unsolicited handles a line sent by the modem with the imei on its own. The
+// signal and the registration of the modem are updated from the events
+// reporting them, and the text of the USSD replies is decoded.
+func (m *Manager) unsolicited(imei, line string) {
+	ev, ok := ParseEvent(line)
+	if !ok {
+		return
+	}
+	ev.IMEI = imei
+	switch {
+	case ev.Registration != nil:
+		m.mu.Lock()
+		if mod, ok := m.modems[imei]; ok {
+			if strings.HasPrefix(line, "+CREG") {
+				mod.Registration = ev.Registration.Status
+			} else {
+				mod.GPRSRegistration = ev.Registration.Status
+			}
+			if ev.Registration.LAC != "" {
+				mod.LAC, mod.CellID = ev.Registration.LAC, ev.Registration.CellID
+			}
+		}
+		m.mu.Unlock()
+	case ev.RSSI != nil:
+		m.mu.Lock()
+		if mod, ok := m.modems[imei]; ok {
+			mod.Signal = *ev.RSSI
+			mod.DBM = rssiDBM(*ev.RSSI)
+		}
+		m.mu.Unlock()
+	case ev.USSD != nil:
+		ev.USSD.Text = decodeUSSD(ev.USSD.Text, ev.USSD.DCS, m.packedUSSD(imei))
+	}
+	m.publish(ev)
+}
+
+// Subscribe returns a channel receiving the events of all the modems, and a
+// function to call when they are no longer wanted. Events are dropped while
+// the channel is full.
+func (m *Manager) Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, 32)
+	m.mu.Lock()
+	m.subs[ch] = true
+	m.mu.Unlock()
+	return ch, func() {
+		m.mu.Lock()
+		delete(m.subs, ch)
+		m.mu.Unlock()
+	}
+}
+
+// Publish sends ev to the subscribers like the events of the modems.
+func (m *Manager) Publish(ev Event) {
+	m.publish(ev)
+}
+
+func (m *Manager) publish(ev Event) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for ch := range m.subs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
 func getttyNum(tty string) (int, error) {
 	b := filepath.Base(tty)
 	b = strings.TrimPrefix(b, "ttyUSB")
@@ -204,29 +434,198 @@ func (m *Manager) List(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 }
 
-// RunComand runs commands to the exposed devices over serial ports
-func (m *Manager) RunCommand(w http.ResponseWriter, r *http.Request) {
+// LastBeat returns the last time the goroutine watching udev was seen alive. It
+// is the zero time if Init was not called.
+func (m *Manager) LastBeat() time.Time {
+	n := atomic.LoadInt64(&m.beat)
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
+
+// MonitorAlive returns true if the goroutine watching udev is still running its
+// loop.
+func (m *Manager) MonitorAlive() bool {
+	return time.Since(m.LastBeat()) < 3*beatInterval
+}
+
+// Modems returns a copy of the modems detected so far.
+func (m *Manager) Modems() []Modem {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var list []Modem
+	for _, v := range m.modems {
+		list = append(list, *v)
+	}
+	return list
+}
+
+// Modem returns a copy of the modem with the given IMEI.
+func (m *Manager) Modem(imei string) (Modem, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	mod, ok := m.modems[imei]
+	if !ok {
+		return Modem{}, false
+	}
+	return *mod, true
+}
+
+// Ping checks that the modem with the given IMEI answers the AT command.
+func (m *Manager) Ping(imei string) error {
+	mod, ok := m.getModem(imei)
+	if !ok {
+		return ErrNoModem
+	}
+	if mod.conn == nil {
+		return errors.New("modem " + imei + " has no connection")
+	}
+	_, err := mod.conn.Run("AT")
+	return err
+}
+
+// Command sends the AT command cmd to the modem with the given IMEI. It waits
+// behind the commands already queued for the modem unless prio is higher.
+func (m *Manager) Command(ctx context.Context, imei string, prio Priority, cmd string) (*Response, error) {
+	c, err := m.conn(imei)
+	if err != nil {
+		return nil, err
+	}
+	return c.Do(ctx, prio, cmd)
 }
 
-// RemoveDevice removes device name from the manager
+// RemoveDevice removes device name from the manager. If name is the tty of a
+// modem, the modem is dropped together with its symlinks.
 func (m *Manager) RemoveDevice(name string) error {
+	m.mu.Lock()
+	var mod *Modem
+	for k, v := range m.modems {
+		if v.Path == name {
+			mod = v
+			delete(m.modems, k)
+			break
+		}
+	}
+	m.mu.Unlock()
+	if mod == nil {
+		return nil
+	}
+	if mod.conn != nil {
+		_ = mod.conn.Close()
+	}
+	mod.removeSymlinks()
+	m.notify("remove", mod.IMEI, fmt.Sprintf("imsi=%s tty=%s", mod.IMSI, mod.Path))
 	return nil
 }
 
+func (m *Manager) refreshLoop() {
+	interval := m.RefreshInterval
+	if interval <= 0 {
+		interval = refreshInterval
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			m.Refresh()
+		case <-m.quit:
+			return
+		}
+	}
+}
+
+// Refresh queries the volatile state of all the modems: the SIM, the operator,
+// the signal quality and the network registrations.
+func (m *Manager) Refresh() {
+	m.mu.RLock()
+	var list []*Modem
+	for _, v := range m.modems {
+		list = append(list, v)
+	}
+	m.mu.RUnlock()
+	for _, mod := range list {
+		if mod.conn != nil {
+			m.refresh(mod)
+		}
+	}
+}
+
+// parseCSQ returns the rssi reported by AT+CSQ, from 0 to 31 or 99 when it is
+// not known. It returns -1 if the response can not be parsed.
+func parseCSQ(src []byte) int {
+	f := responseFields(src, "+CSQ:")
+	if len(f) == 0 {
+		return -1
+	}
+	n, err := strconv.Atoi(f[0])
+	if err != nil {
+		return -1
+	}
+	return n
+}
+
+// responseFields returns the comma separated values that follow prefix in the
+// response of a modem.
+func responseFields(src []byte, prefix string) []string {
+	s := string(bytes.Trim(src, "\x00"))
+	i := strings.Index(s, prefix)
+	if i == -1 {
+		return nil
+	}
+	s = s[i+len(prefix):]
+	if n := strings.IndexAny(s, "\r\n"); n != -1 {
+		s = s[:n]
+	}
+	f := strings.Split(s, ",")
+	for i := range f {
+		f[i] = strings.TrimSpace(f[i])
+	}
+	return f
+}
+
+// Modem is a modem plugged into the system. The hardware and the SIM are
+// probed once when it is found, the rest is refreshed every RefreshInterval.
 type Modem struct {
 	IMEI         string `json:"imei"`
 	IMSI         string `json:"imsi"`
+	ICCID        string `json:"iccid"`
 	Manufacturer string `json:"manufacturer"`
+	Model        string `json:"model"`
+	Firmware     string `json:"firmware"`
 	Path         string `json:"tty"`
-	conn         *Conn
+
+	// PIN is the state of the SIM reported by AT+CPIN?, READY once it is
+	// unlocked.
+	PIN      string `json:"pin"`
+	Operator string `json:"operator"`
+
+	// Signal is the rssi reported by AT+CSQ and Registration the status
+	// reported by AT+CREG?, both are -1 until the modem is queried. DBM is the
+	// signal in dBm, it is missing while the signal is not known.
+	Signal       int  `json:"signal"`
+	DBM          *int `json:"dbm,omitempty"`
+	Registration int  `json:"registration"`
+
+	// GPRSRegistration is the status reported by AT+CGREG?. LAC and CellID
+	// locate the cell the modem is registered to, in hexadecimal.
+	GPRSRegistration int    `json:"gprs_registration"`
+	LAC              string `json:"lac,omitempty"`
+	CellID           string `json:"cell_id,omitempty"`
+
+	// Updated is when the volatile state was last refreshed.
+	Updated time.Time `json:"updated"`
+	conn    *Conn
 }
 
 // Symlink adds symlink to the  modem. The symlink links the tty to the IMEI
 // number of the modem.
 //
 // Two symlinks are created one for IMEI the other is for IMSI
-//  /dev/ttyUSB -> {IMEI}.imei
-//  /dev/ttyUSB -> {IMSI}.imsi
+//
+//	/dev/ttyUSB -> {IMEI}.imei
+//	/dev/ttyUSB -> {IMSI}.imsi
 func (m *Modem) Symlink() error {
 	newIMEILink := (fmt.Sprintf("/dev/%s", m.IMEI+".imei"))
 	err := syscall.Unlink(newIMEILink)
@@ -245,25 +644,111 @@ func (m *Modem) Symlink() error {
 	return os.Symlink(m.Path, newIMSILink)
 }
 
+func (m *Modem) removeSymlinks() {
+	for _, link := range []string{m.IMEI + ".imei", m.IMSI + ".imsi"} {
+		link = filepath.Join("/dev", link)
+		if dst, err := os.Readlink(link); err == nil && dst == m.Path {
+			_ = os.Remove(link)
+		}
+	}
+}
+
+// CheckSymlinks makes sure the IMEI and IMSI symlinks created by Symlink point
+// to the tty of the modem and that the tty exists.
+func (m *Modem) CheckSymlinks() error {
+	if _, err := os.Stat(m.Path); err != nil {
+		return err
+	}
+	for _, link := range []string{m.IMEI + ".imei", m.IMSI + ".imsi"} {
+		link = filepath.Join("/dev", link)
+		dst, err := os.Readlink(link)
+		if err != nil {
+			return err
+		}
+		if dst != m.Path {
+			return fmt.Errorf("%s points to %s instead of %s", link, dst, m.Path)
+		}
+	}
+	return nil
+}
+
+// LinkedModems returns the modems known from the IMEI and IMSI symlinks in
+// /dev. It lets the modems be found without a running Manager, the IMSI is
+// the one whose symlink points to the same tty as the IMEI symlink.
+func LinkedModems() []Modem {
+	imsi := make(map[string]string)
+	links, _ := filepath.Glob("/dev/*.imsi")
+	for _, link := range links {
+		if dst, err := os.Readlink(link); err == nil {
+			imsi[dst] = strings.TrimSuffix(filepath.Base(link), ".imsi")
+		}
+	}
+	var list []Modem
+	links, _ = filepath.Glob("/dev/*.imei")
+	for _, link := range links {
+		dst, err := os.Readlink(link)
+		if err != nil {
+			continue
+		}
+		if _, err := os.Stat(dst); err != nil {
+			continue
+		}
+		list = append(list, Modem{
+			IMEI:             strings.TrimSuffix(filepath.Base(link), ".imei"),
+			IMSI:             imsi[dst],
+			Path:             dst,
+			Signal:           -1,
+			Registration:     -1,
+			GPRSRegistration: -1,
+		})
+	}
+	return list
+}
+
+// StaleSymlinks returns the IMEI and IMSI symlinks in /dev that point to a tty
+// that is gone.
+func StaleSymlinks() []string {
+	var stale []string
+	for _, pattern := range []string{"/dev/*.imei", "/dev/*.imsi"} {
+		links, _ := filepath.Glob(pattern)
+		for _, link := range links {
+			if _, err := os.Stat(link); err != nil {
+				stale = append(stale, link)
+			}
+		}
+	}
+	return stale
+}
+
+// imeiTimeout and imsiTimeout are how long a modem is given to report its IMEI
+// and the IMSI of its SIM, the commands are retried every retryInterval.
+var (
+	imeiTimeout   = 10 * time.Second
+	imsiTimeout   = 20 * time.Second
+	retryInterval = 250 * time.Millisecond
+)
+
+// readTimeout is how long a read of a tty waits for data. The deadlines of the
+// commands are checked between reads.
+const readTimeout = 100 * time.Millisecond
+
 func newModem(c *Conn) (*Modem, error) {
-	m := &Modem{}
-	ich := time.After(10 * time.Second)
+	m := &Modem{Signal: -1, Registration: -1, GPRSRegistration: -1}
+	ich := time.After(imeiTimeout)
 STOP:
 	for {
 		select {
 		case <-ich:
 			break STOP
 		default:
-			imei, err := c.Run(modemCommands.IMEI)
-			if err != nil {
-				continue
-			}
-			i, err := cleanResult(imei)
+			r, err := c.Run(modemCommands.IMEI)
 			if err != nil {
+				time.Sleep(retryInterval)
 				continue
 			}
-			im := string(i)
-			if !isNumber(im) {
+			im := r.Value()
+			if im == "" || !isNumber(im) {
+				time.Sleep(retryInterval)
 				continue
 			}
 			m.IMEI = im
@@ -275,7 +760,7 @@ STOP:
 	}
 	// we make sure we obtain the sim card information.
 	var wg sync.WaitGroup
-	done := time.After(20 * time.Second)
+	done := time.After(imsiTimeout)
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
@@ -286,22 +771,17 @@ STOP:
 				fmt.Println("Timed out")
 				break END
 			default:
-				imsi, err := c.Run("AT+CIMI")
+				r, err := c.Run(modemCommands.IMSI)
 				if err != nil {
+					time.Sleep(retryInterval)
 					continue
 				}
-				s, err := cleanResult(imsi)
-				if err != nil {
-					continue
-				}
-				ss := string(s)
-				if !isNumber(ss) {
+				ss := r.Value()
+				if ss == "" || !isNumber(ss) || m.IMEI == ss {
+					time.Sleep(retryInterval)
 					continue
 				}
-				if m.IMEI == ss {
-					continue
-				}
-				fmt.Println(string(s))
+				fmt.Println(ss)
 				m.IMSI = ss
 				break END
 			}
@@ -327,7 +807,7 @@ func isNumber(src string) bool {
 
 func (m *Manager) reload() {
 	for _, v := range m.devices {
-		conn := &Conn{device: v}
+		conn := &Conn{device: v, open: m.Open}
 		modem, err := newModem(conn)
 		if err != nil {
 			continue
@@ -337,29 +817,44 @@ func (m *Manager) reload() {
 	}
 }
 
-func cleanResult(src []byte) ([]byte, error) {
-	i := bytes.Index(src, []byte("OK"))
-	if i == -1 {
-		return nil, errors.New("not okay")
-	}
-	ns := bytes.TrimSpace(src[:i])
-	ch, _ := utf8.DecodeRune(ns)
-	if unicode.IsLetter(ch) {
-		at := bytes.Index(ns, []byte("AT"))
-		if at != -1 {
-			i := bytes.IndexRune(ns[at:], '\r')
-			if i > 0 {
-				return bytes.TrimSpace(ns[at+i:]), nil
+// Close shuts down the device manager. This makes sure the udev monitor is
+// closed and all goroutines are properly exited.
+//
+// The websocket clients are disconnected, the serial ports of the modems are
+// released and the virtual modems are closed.
+func (m *Manager) Close() {
+	m.stop <- struct{}{}
+	close(m.quit)
+
+	// the conns are closed without the lock, closing waits for their
+	// goroutine which may be handing an unsolicited line to the manager.
+	var conns []*Conn
+	var linked []*Modem
+	m.mu.Lock()
+	for ws := range m.clients {
+		_ = ws.Close()
+	}
+	for _, mod := range m.modems {
+		if mod.conn != nil {
+			conns = append(conns, mod.conn)
+		}
+		for _, v := range m.virtual {
+			if mod.Path == v.Path() {
+				linked = append(linked, mod)
 			}
 		}
 	}
-	return ns, nil
-}
-
-//Close shuts down the device manager. This makes sure the udev monitor is
-//closed and all goroutines are properly exited.
-func (m *Manager) Close() {
-	m.stop <- struct{}{}
+	virtual := append([]*VirtualModem(nil), m.virtual...)
+	m.mu.Unlock()
+	for _, c := range conns {
+		_ = c.Close()
+	}
+	for _, mod := range linked {
+		mod.removeSymlinks()
+	}
+	for _, v := range virtual {
+		_ = v.Close()
+	}
 }
 
 func reader(ws *websocket.Conn) {
@@ -368,12 +863,13 @@ func reader(ws *websocket.Conn) {
 		_, _, err := ws.ReadMessage()
 		if err != nil {
 			log.Println(err)
+			return
 		}
 	}
 }
 
 // Updates is websocket http handler for sending updates about the devices
-// plugged into the system in real time.
+// plugged into the system in real time. Every Event is sent as a json object.
 func (m *Manager) Updates(w http.ResponseWriter, r *http.Request) {
 	ws, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
@@ -382,82 +878,25 @@ func (m *Manager) Updates(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
+	events, cancel := m.Subscribe()
+	defer cancel()
+	m.mu.Lock()
+	m.clients[ws] = true
+	m.mu.Unlock()
+	done := make(chan struct{})
 	go func() {
 		for {
 			select {
-			case ev := <-m.events:
+			case ev := <-events:
 				_ = ws.WriteJSON(ev)
+			case <-done:
+				return
 			}
 		}
 	}()
 	reader(ws)
-}
-
-// Conn is a device serial connection
-type Conn struct {
-	device serial.Config
-	imei   string
-	port   *serial.Port
-	isOpen bool
-}
-
-// Open opens a serial port to the undelying device
-func (c *Conn) Open() error {
-	p, err := serial.OpenPort(&c.device)
-	if err != nil {
-		return err
-	}
-	c.port = p
-	c.isOpen = true
-	return nil
-}
-
-// Close closes the port helt by *Conn.
-func (c *Conn) Close() error {
-	if c.isOpen {
-		return c.port.Close()
-	}
-	return nil
-}
-
-// Write wites b to the serieal port
-func (c *Conn) Write(b []byte) (int, error) {
-	return c.port.Write(b)
-}
-
-// Read reads from serial port
-func (c *Conn) Read(b []byte) (int, error) {
-	return c.port.Read(b)
-}
-
-// Exec sends the command over serial port and rrturns the response. If the port
-// is closed it is opened  before sending the command.
-func (c *Conn) Exec(cmd string) ([]byte, error) {
-	if !c.isOpen {
-		err := c.Open()
-		if err != nil {
-			return nil, err
-		}
-	}
-	_, err := c.Write([]byte(cmd))
-	if err != nil {
-		return nil, err
-	}
-	buf := make([]byte, 128)
-	_, err = c.Read(buf)
-	if err != nil {
-		return nil, err
-	}
-	if !bytes.Contains(buf, []byte("OK")) {
-		return nil, errors.New("command " + string(cmd) + " xeite without OK" + " got " + string(buf))
-	}
-	_ = c.port.Flush()
-	_ = c.port.Close()
-	c.isOpen = false
-	return buf, nil
-}
-
-// Run helper for Exec that adds \r to the command
-func (c *Conn) Run(cmd string) ([]byte, error) {
-	return c.Exec(fmt.Sprintf("%s \r", cmd))
+	close(done)
+	m.mu.Lock()
+	delete(m.clients, ws)
+	m.mu.Unlock()
 }
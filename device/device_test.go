@@ -1,6 +1,12 @@
 package device
 
-import "testing"
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jochenvg/go-udev"
+)
 
 func TestGetTtyNumber(t *testing.T) {
 	sample := []struct {
@@ -16,7 +22,37 @@ func TestGetTtyNumber(t *testing.T) {
 			t.Fatal(err)
 		}
 		if n != v.num {
-			t.Errorf("expected %d got 5d", v.num, n)
+			t.Errorf("expected %d got %d", v.num, n)
 		}
 	}
 }
+
+func TestParseStatus(t *testing.T) {
+	if n := parseCSQ([]byte("AT+CSQ\r\r\n+CSQ: 18,99\r\n\r\nOK\r\n\x00\x00")); n != 18 {
+		t.Errorf("expected 18 got %d", n)
+	}
+	if n := parseCSQ([]byte("ERROR")); n != -1 {
+		t.Errorf("expected -1 got %d", n)
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	m := New()
+	var beats int32
+	m.Heartbeat = func() { atomic.AddInt32(&beats, 1) }
+	m.HeartbeatInterval = 10 * time.Millisecond
+	devCh := make(chan *udev.Device)
+	m.watch(devCh)
+	defer m.Close()
+	time.Sleep(50 * time.Millisecond)
+	if atomic.LoadInt32(&beats) == 0 {
+		t.Fatal("expected the watchdog to be fed")
+	}
+	close(devCh)
+	time.Sleep(20 * time.Millisecond)
+	n := atomic.LoadInt32(&beats)
+	time.Sleep(50 * time.Millisecond)
+	if atomic.LoadInt32(&beats) != n {
+		t.Error("expected the heartbeat to stop with the udev monitor")
+	}
+}
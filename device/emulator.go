@@ -0,0 +1,615 @@
+package device
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf16"
+
+	"github.com/FarmRadioHangar/fessboxconfig/sms"
+	"github.com/tarm/serial"
+)
+
+// Emulator is a virtual modem. It implements Port and answers the AT commands
+// fconf sends to the dongles, so the device code can run without hardware.
+//
+// The identity, the network state and the USSD menu are set through the
+// exported fields, which must not change once the emulator is in use. Reply,
+// Fail and Noise script misbehaviour for the next commands.
+type Emulator struct {
+	IMEI         string
+	IMSI         string
+	Manufacturer string
+	Model        string
+	Firmware     string
+	Operator     string
+
+	// ICCID is the serial number of the SIM and PIN the state answered to
+	// AT+CPIN?, both are ignored without a SIM.
+	ICCID string
+	PIN   string
+
+	// Signal is the rssi answered to AT+CSQ and Registration the status
+	// answered to AT+CREG? and AT+CGREG?. LAC and CellID are the location
+	// given when the reporting of the location is on.
+	Signal       int
+	Registration int
+	LAC          string
+	CellID       string
+
+	// USSD maps the codes sent with AT+CUSD to the text of the network reply.
+	// Codes that are not in the map get an unsupported reply. The answers in
+	// a menu are keyed by the code and the answers before them joined by >,
+	// like *149#>1; the session stays open while the map has answers to the
+	// reply. Texts missing from the GSM 7 bit alphabet are sent in UCS-2.
+	USSD map[string]string
+
+	// Delay is how long the modem takes to answer a command, the echo is sent
+	// right away.
+	Delay time.Duration
+
+	// ReadTimeout is how long Read waits for data before it gives up with
+	// io.EOF, like a tty opened with a read timeout. It defaults to the read
+	// timeout of the ttys.
+	ReadTimeout time.Duration
+
+	mu      sync.Mutex
+	echo    bool
+	text    bool
+	creg    int
+	cgreg   int
+	in      []byte
+	out     []byte
+	avail   chan struct{}
+	replies map[string][][]string
+	noise   []byte
+	noisy   int
+	typing  bool
+	prompt  string
+	pduLen  int
+	inbox   []*EmulatedSMS
+	sent    []EmulatedSMS
+	nextRef int
+	menu    string
+}
+
+// EmulatedSMS is a text message stored in or sent by an Emulator. A long
+// message is stored or sent in parts.
+type EmulatedSMS struct {
+	Index  int
+	Number string
+	Text   string
+	Read   bool
+
+	time   time.Time
+	concat *sms.Concat
+}
+
+// NewEmulator returns an emulated modem with the imei and the SIM imsi, an
+// empty imsi means no SIM is inserted. It has echo on and is registered to
+// its home network with a fair signal.
+func NewEmulator(imei, imsi string) *Emulator {
+	return &Emulator{
+		IMEI:         imei,
+		IMSI:         imsi,
+		ICCID:        "8925" + imsi,
+		PIN:          "READY",
+		Manufacturer: "huawei",
+		Model:        "E173",
+		Firmware:     "11.126.85.00.209",
+		Operator:     "Emulated",
+		Signal:       18,
+		Registration: 1,
+		LAC:          "00A1",
+		CellID:       "1B2C",
+		echo:         true,
+		text:         true,
+		avail:        make(chan struct{}, 1),
+		replies:      make(map[string][][]string),
+	}
+}
+
+// Open returns the emulator as the port of any tty, it is an Opener.
+func (e *Emulator) Open(cfg *serial.Config) (Port, error) {
+	return e, nil
+}
+
+// Reply makes the next time cmd is sent get lines as the answer instead of the
+// normal one. The lines are sent as they are so the last one is usually a
+// final result code. Replies queued for the same command are used in order.
+func (e *Emulator) Reply(cmd string, lines ...string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	cmd = strings.ToUpper(cmd)
+	e.replies[cmd] = append(e.replies[cmd], lines)
+}
+
+// Fail makes the next n times cmd is sent answer ERROR.
+func (e *Emulator) Fail(cmd string, n int) {
+	for i := 0; i < n; i++ {
+		e.Reply(cmd, "ERROR")
+	}
+}
+
+// Noise sends b before each of the next n answers, like the garbage some
+// dongles write when their port is opened.
+func (e *Emulator) Noise(b []byte, n int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.noise = append([]byte(nil), b...)
+	e.noisy = n
+}
+
+// Unsolicited sends line as an unsolicited result code.
+func (e *Emulator) Unsolicited(line string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.emit("\r\n" + line + "\r\n")
+}
+
+// Deliver stores a text message from number in the SIM and announces it with
+// +CMTI like a real modem, a long text is stored in concatenated parts. It
+// returns the index of the first part.
+func (e *Emulator) Deliver(number, text string) int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	index := 0
+	for _, m := range e.inbox {
+		if m.Index > index {
+			index = m.Index
+		}
+	}
+	first := index + 1
+	parts, err := sms.Split(sms.Message{Type: sms.Deliver, Number: number, Text: text}, first)
+	if err != nil {
+		parts = []sms.Message{{Text: text}}
+	}
+	now := time.Now()
+	for _, p := range parts {
+		index++
+		e.inbox = append(e.inbox, &EmulatedSMS{Index: index, Number: number, Text: p.Text, time: now, concat: p.Concat})
+		e.emit(fmt.Sprintf("\r\n+CMTI: \"SM\",%d\r\n", index))
+	}
+	return first
+}
+
+// Sent returns the text messages sent through the emulator.
+func (e *Emulator) Sent() []EmulatedSMS {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]EmulatedSMS(nil), e.sent...)
+}
+
+// Read reads what the modem sent, waiting up to ReadTimeout for it.
+func (e *Emulator) Read(b []byte) (int, error) {
+	timeout := e.ReadTimeout
+	if timeout <= 0 {
+		timeout = readTimeout
+	}
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		e.mu.Lock()
+		if len(e.out) > 0 {
+			n := copy(b, e.out)
+			e.out = e.out[n:]
+			e.mu.Unlock()
+			return n, nil
+		}
+		e.mu.Unlock()
+		select {
+		case <-e.avail:
+		case <-deadline.C:
+			return 0, io.EOF
+		}
+	}
+}
+
+// Write sends b to the modem. Commands are run when their terminating carriage
+// return is written.
+func (e *Emulator) Write(b []byte) (int, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, c := range b {
+		if e.typing {
+			e.promptByte(c)
+			continue
+		}
+		switch c {
+		case '\r':
+			line := string(e.in)
+			e.in = e.in[:0]
+			if e.echo {
+				e.emit(line + "\r")
+			}
+			e.run(strings.TrimSpace(line))
+		case '\n':
+		default:
+			e.in = append(e.in, c)
+		}
+	}
+	return len(b), nil
+}
+
+// Flush drops the data that was not read yet.
+func (e *Emulator) Flush() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.in = e.in[:0]
+	e.out = e.out[:0]
+	return nil
+}
+
+// Close drops the data that was not read yet. The state of the modem is kept,
+// it can be opened again.
+func (e *Emulator) Close() error {
+	return e.Flush()
+}
+
+// emit queues s for Read, e.mu must be held.
+func (e *Emulator) emit(s string) {
+	e.out = append(e.out, s...)
+	select {
+	case e.avail <- struct{}{}:
+	default:
+	}
+}
+
+// answer sends the lines of an answer after Delay, e.mu must be held.
+func (e *Emulator) answer(lines []string) {
+	var s string
+	if e.noisy > 0 {
+		e.noisy--
+		s = string(e.noise)
+	}
+	for _, line := range lines {
+		s += "\r\n" + line + "\r\n"
+	}
+	if e.Delay <= 0 {
+		e.emit(s)
+		return
+	}
+	time.AfterFunc(e.Delay, func() {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		e.emit(s)
+	})
+}
+
+// run answers the command line, e.mu must be held.
+func (e *Emulator) run(line string) {
+	if line == "" {
+		return
+	}
+	cmd := strings.ToUpper(line)
+	if q := e.replies[cmd]; len(q) > 0 {
+		e.replies[cmd] = q[1:]
+		e.answer(q[0])
+		return
+	}
+	if !strings.HasPrefix(cmd, "AT") {
+		e.answer([]string{"ERROR"})
+		return
+	}
+	name, arg := cmd[2:], ""
+	if i := strings.IndexAny(name, "=?"); i != -1 {
+		name, arg = name[:i], line[2+i:]
+	}
+	lines, ok := e.command(name, arg)
+	if !ok {
+		e.answer([]string{"ERROR"})
+		return
+	}
+	if lines != nil {
+		e.answer(lines)
+	}
+}
+
+// command returns the answer to the command name with its argument, which
+// starts with = or ?. A nil answer with ok true means the answer is sent later.
+func (e *Emulator) command(name, arg string) (lines []string, ok bool) {
+	done := func(info ...string) []string {
+		return append(info, "OK")
+	}
+	switch name {
+	case "":
+		return done(), true
+	case "E0", "E1":
+		e.echo = name == "E1"
+		return done(), true
+	case "+GSN", "+CGSN":
+		return done(e.IMEI), true
+	case "+CIMI":
+		if e.IMSI == "" {
+			return []string{"+CME ERROR: 10"}, true
+		}
+		return done(e.IMSI), true
+	case "+CCID", "^ICCID":
+		if e.IMSI == "" {
+			return []string{"+CME ERROR: 10"}, true
+		}
+		return done(name + ": " + e.ICCID), true
+	case "+CPIN":
+		if e.IMSI == "" {
+			return []string{"+CME ERROR: 10"}, true
+		}
+		return done("+CPIN: " + e.PIN), true
+	case "+CGMI":
+		return done(e.Manufacturer), true
+	case "+CGMM":
+		return done(e.Model), true
+	case "+CGMR":
+		return done(e.Firmware), true
+	case "+CSQ":
+		return done(fmt.Sprintf("+CSQ: %d,99", e.Signal)), true
+	case "+CREG":
+		return e.registration(name, &e.creg, arg)
+	case "+CGREG":
+		return e.registration(name, &e.cgreg, arg)
+	case "+COPS":
+		if arg == "?" {
+			return done(fmt.Sprintf("+COPS: 0,0,%q,0", e.Operator)), true
+		}
+		return done(), true
+	case "+CMGF":
+		switch arg {
+		case "?":
+			mode := 0
+			if e.text {
+				mode = 1
+			}
+			return done(fmt.Sprintf("+CMGF: %d", mode)), true
+		case "=0", "=1":
+			e.text = arg == "=1"
+			return done(), true
+		}
+	case "+CMGS":
+		if !e.text {
+			n, err := strconv.Atoi(strings.TrimPrefix(arg, "="))
+			if err != nil {
+				return nil, false
+			}
+			e.typing, e.prompt, e.pduLen = true, "", n
+			e.emit("\r\n> ")
+			return nil, true
+		}
+		number, err := strconv.Unquote(strings.TrimPrefix(arg, "="))
+		if err != nil {
+			return nil, false
+		}
+		e.typing, e.prompt = true, number
+		e.emit("\r\n> ")
+		return nil, true
+	case "+CMGL":
+		if !e.text {
+			return e.listPDU(arg)
+		}
+		var info []string
+		for _, m := range e.inbox {
+			info = append(info, fmt.Sprintf("+CMGL: %d,%q,%q,,", m.Index, smsStatus(m.Read), m.Number), m.Text)
+			m.Read = true
+		}
+		return done(info...), true
+	case "+CMGR":
+		m := e.stored(arg)
+		if m == nil {
+			return []string{"+CMS ERROR: 321"}, true
+		}
+		if !e.text {
+			pdu := e.pdu(m)
+			info := []string{fmt.Sprintf("+CMGR: %d,,%d", pduStatus(m.Read), sms.Length(pdu)), strings.ToUpper(hex.EncodeToString(pdu))}
+			m.Read = true
+			return done(info...), true
+		}
+		info := []string{fmt.Sprintf("+CMGR: %q,%q,,", smsStatus(m.Read), m.Number), m.Text}
+		m.Read = true
+		return done(info...), true
+	case "+CMGD":
+		m := e.stored(arg)
+		if m == nil {
+			return []string{"+CMS ERROR: 321"}, true
+		}
+		for i, v := range e.inbox {
+			if v == m {
+				e.inbox = append(e.inbox[:i], e.inbox[i+1:]...)
+				break
+			}
+		}
+		return done(), true
+	case "+CUSD":
+		return e.ussd(arg)
+	}
+	return nil, false
+}
+
+// registration answers AT+CREG and AT+CGREG, mode is the reporting mode set by
+// the command. The location is given in mode 2.
+func (e *Emulator) registration(name string, mode *int, arg string) ([]string, bool) {
+	switch arg {
+	case "?":
+		line := fmt.Sprintf("%s: %d,%d", name, *mode, e.Registration)
+		if *mode == 2 {
+			line += fmt.Sprintf(",%q,%q", e.LAC, e.CellID)
+		}
+		return []string{line, "OK"}, true
+	case "=0", "=1", "=2":
+		*mode = int(arg[1] - '0')
+		return []string{"OK"}, true
+	}
+	return nil, false
+}
+
+// ussd answers AT+CUSD, the network reply comes as a +CUSD unsolicited result
+// code after the OK. A Huawei takes and gives the strings as packed GSM 7 bit
+// in hex, the plain ones are still taken.
+func (e *Emulator) ussd(arg string) ([]string, bool) {
+	f := strings.SplitN(strings.TrimPrefix(arg, "="), ",", 3)
+	switch {
+	case arg == "?":
+		return []string{"+CUSD: 1", "OK"}, true
+	case len(f) == 1 && f[0] == "2":
+		e.menu = ""
+		return []string{"OK"}, true
+	case len(f) == 1 && (f[0] == "0" || f[0] == "1"):
+		return []string{"OK"}, true
+	case len(f) < 2 || f[0] != "1":
+		return nil, false
+	}
+	code, err := strconv.Unquote(f[1])
+	if err != nil {
+		return nil, false
+	}
+	packed := false
+	if b, err := hex.DecodeString(code); err == nil && len(b) > 0 &&
+		strings.Contains(strings.ToLower(e.Manufacturer), "huawei") {
+		code, packed = decodeUSSD(code, ussdDCS, true), true
+	}
+	key := code
+	if e.menu != "" {
+		key = e.menu + ">" + code
+	}
+	e.menu = ""
+	text, ok := e.USSD[key]
+	if !ok {
+		e.answer([]string{"OK", "+CUSD: 4"})
+		return nil, true
+	}
+	status := 0
+	for k := range e.USSD {
+		if strings.HasPrefix(k, key+">") {
+			status, e.menu = 1, key
+			break
+		}
+	}
+	reply := fmt.Sprintf("+CUSD: %d,%q,15", status, text)
+	if _, ok := sms.GSM7Septets(text); !ok {
+		var b []byte
+		for _, u := range utf16.Encode([]rune(text)) {
+			b = append(b, byte(u>>8), byte(u))
+		}
+		reply = fmt.Sprintf("+CUSD: %d,\"%X\",72", status, b)
+	} else if packed {
+		s, _ := encodeUSSD(text, true)
+		reply = fmt.Sprintf("+CUSD: %d,%q,15", status, s)
+	}
+	e.answer([]string{"OK", reply})
+	return nil, true
+}
+
+// listPDU answers AT+CMGL in PDU mode, arg selects the unread messages with
+// =0, the read ones with =1 and all of them with =4.
+func (e *Emulator) listPDU(arg string) ([]string, bool) {
+	stat, err := strconv.Atoi(strings.TrimPrefix(arg, "="))
+	if err != nil || stat < 0 || stat > 4 {
+		return nil, false
+	}
+	var info []string
+	for _, m := range e.inbox {
+		if stat != 4 && stat != pduStatus(m.Read) {
+			continue
+		}
+		pdu := e.pdu(m)
+		info = append(info, fmt.Sprintf("+CMGL: %d,%d,,%d", m.Index, pduStatus(m.Read), sms.Length(pdu)),
+			strings.ToUpper(hex.EncodeToString(pdu)))
+		m.Read = true
+	}
+	return append(info, "OK"), true
+}
+
+// pdu returns the SMS-DELIVER of a stored message, e.mu must be held.
+func (e *Emulator) pdu(m *EmulatedSMS) []byte {
+	msg := &sms.Message{
+		Type:   sms.Deliver,
+		SMSC:   "+255754000000",
+		Number: m.Number,
+		Time:   m.time,
+		Text:   m.Text,
+		Concat: m.concat,
+	}
+	pdu, err := msg.Encode()
+	if err != nil {
+		// the text mode only messages are stored as they come
+		msg.Number, msg.Text = "0", "?"
+		pdu, _ = msg.Encode()
+	}
+	return pdu
+}
+
+// sendPDU sends the hex PDU typed after the prompt of AT+CMGS in PDU mode,
+// e.mu must be held.
+func (e *Emulator) sendPDU(s string) {
+	b, err := hex.DecodeString(strings.TrimSpace(s))
+	if err != nil || sms.Length(b) != e.pduLen {
+		e.answer([]string{"+CMS ERROR: 304"})
+		return
+	}
+	m, err := sms.Decode(b)
+	if err != nil || m.Type != sms.Submit {
+		e.answer([]string{"+CMS ERROR: 304"})
+		return
+	}
+	e.nextRef++
+	e.sent = append(e.sent, EmulatedSMS{Index: e.nextRef, Number: m.Number, Text: m.Text, time: time.Now(), concat: m.Concat})
+	e.answer([]string{fmt.Sprintf("+CMGS: %d", e.nextRef), "OK"})
+}
+
+// promptByte takes b as part of the message typed after the > prompt of
+// AT+CMGS, e.mu must be held.
+func (e *Emulator) promptByte(b byte) {
+	switch b {
+	case 0x1a:
+		text := string(e.in)
+		e.typing = false
+		e.in = e.in[:0]
+		if !e.text {
+			e.sendPDU(text)
+			return
+		}
+		e.nextRef++
+		e.sent = append(e.sent, EmulatedSMS{Index: e.nextRef, Number: e.prompt, Text: text, time: time.Now()})
+		e.answer([]string{fmt.Sprintf("+CMGS: %d", e.nextRef), "OK"})
+	case 0x1b:
+		e.typing = false
+		e.in = e.in[:0]
+		e.answer([]string{"OK"})
+	default:
+		if e.echo {
+			e.emit(string(b))
+		}
+		e.in = append(e.in, b)
+	}
+}
+
+// stored returns the message at the index given as =n, e.mu must be held.
+func (e *Emulator) stored(arg string) *EmulatedSMS {
+	n, err := strconv.Atoi(strings.TrimPrefix(arg, "="))
+	if err != nil {
+		return nil
+	}
+	for _, m := range e.inbox {
+		if m.Index == n {
+			return m
+		}
+	}
+	return nil
+}
+
+// pduStatus is the status of a stored message in PDU mode, 0 for unread and 1
+// for read.
+func pduStatus(read bool) int {
+	if read {
+		return 1
+	}
+	return 0
+}
+
+func smsStatus(read bool) string {
+	if read {
+		return "REC READ"
+	}
+	return "REC UNREAD"
+}
@@ -0,0 +1,177 @@
+package device
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tarm/serial"
+)
+
+func emulatorConn(e *Emulator) *Conn {
+	return &Conn{device: serial.Config{Name: "/dev/ttyUSB0"}, open: e.Open}
+}
+
+func TestEmulator(t *testing.T) {
+	e := NewEmulator("356789012345678", "640050123456789")
+	e.USSD = map[string]string{"*150#": "Your balance is 1000 TZS"}
+	c := emulatorConn(e)
+	sample := []struct {
+		cmd, expect string
+	}{
+		{"AT", "OK"},
+		{"AT+GSN", "356789012345678"},
+		{"AT+CIMI", "640050123456789"},
+		{"AT+CSQ", "+CSQ: 18,99"},
+		{"AT+CREG?", "+CREG: 0,1"},
+		{"AT+CMGF=1", "OK"},
+	}
+	for _, v := range sample {
+		r, err := c.Run(v.cmd)
+		if err != nil {
+			t.Fatalf("%s: %v", v.cmd, err)
+		}
+		if !strings.Contains(r.String(), v.expect) {
+			t.Errorf("%s: expected %q in %q", v.cmd, v.expect, r)
+		}
+	}
+	if _, err := c.Run("AT+BOGUS"); err == nil {
+		t.Error("expected an unknown command to fail")
+	}
+
+	e.Fail("AT+GSN", 1)
+	if _, err := c.Run("AT+GSN"); err == nil {
+		t.Error("expected the scripted failure")
+	}
+	if _, err := c.Run("AT+GSN"); err != nil {
+		t.Errorf("expected the failure to be used up got %v", err)
+	}
+}
+
+func TestEmulatorMessages(t *testing.T) {
+	e := NewEmulator("356789012345678", "640050123456789")
+	e.USSD = map[string]string{"*150#": "Your balance is 1000 TZS"}
+	p, _ := e.Open(nil)
+	read := func() string {
+		var out []byte
+		buf := make([]byte, 256)
+		for !bytes.Contains(out, []byte("OK\r\n")) && !bytes.Contains(out, []byte("> ")) {
+			n, err := p.Read(buf)
+			if err != nil {
+				t.Fatalf("got %q: %v", out, err)
+			}
+			out = append(out, buf[:n]...)
+		}
+		return string(out)
+	}
+
+	fmt.Fprint(p, "AT+CMGS=\"+255700000001\"\r")
+	if s := read(); !strings.HasSuffix(s, "> ") {
+		t.Fatalf("expected a prompt got %q", s)
+	}
+	fmt.Fprint(p, "hello\x1a")
+	if s := read(); !strings.Contains(s, "+CMGS: 1") {
+		t.Errorf("expected a message reference got %q", s)
+	}
+	sent := e.Sent()
+	if len(sent) != 1 || sent[0].Number != "+255700000001" || sent[0].Text != "hello" {
+		t.Errorf("unexpected sent messages %+v", sent)
+	}
+
+	index := e.Deliver("+255700000002", "hi there")
+	fmt.Fprintf(p, "AT+CMGR=%d\r", index)
+	s := read()
+	if !strings.Contains(s, "+CMTI: \"SM\",1") || !strings.Contains(s, "hi there") {
+		t.Errorf("expected the notice and the message got %q", s)
+	}
+
+	fmt.Fprint(p, "AT+CUSD=1,\"*150#\",15\r")
+	s = read()
+	if !strings.Contains(s, "+CUSD: 0,\"Your balance is 1000 TZS\",15") {
+		t.Errorf("expected the ussd reply got %q", s)
+	}
+}
+
+func TestManagerAddPort(t *testing.T) {
+	ports := map[string]*Emulator{
+		"/dev/ttyUSB2": NewEmulator("356789012345678", "640050123456789"),
+		"/dev/ttyUSB1": NewEmulator("356789012345678", "640050123456789"),
+		"/dev/ttyUSB3": NewEmulator("354369047238739", "640041122334455"),
+	}
+	ports["/dev/ttyUSB2"].Noise([]byte("\x00\xff^BOOT"), 2)
+	ports["/dev/ttyUSB3"].Fail("AT+CIMI", 3)
+	m := New()
+	m.Open = func(cfg *serial.Config) (Port, error) {
+		return ports[cfg.Name], nil
+	}
+	var added []string
+	m.OnChange = func(action, target, summary string) {
+		added = append(added, target)
+	}
+	for _, name := range []string{"/dev/ttyUSB2", "/dev/ttyUSB1", "/dev/ttyUSB3"} {
+		if err := m.AddPort(name); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+	}
+	if len(added) != 2 {
+		t.Errorf("expected two modems got %v", added)
+	}
+	modems := make(map[string]Modem)
+	for _, mod := range m.Modems() {
+		modems[mod.IMEI] = mod
+	}
+	if mod := modems["356789012345678"]; mod.Path != "/dev/ttyUSB1" || mod.IMSI != "640050123456789" {
+		t.Errorf("expected the lowest tty to be kept got %+v", mod)
+	}
+	if mod := modems["354369047238739"]; mod.IMSI != "640041122334455" {
+		t.Errorf("expected the imsi after the failures got %+v", mod)
+	}
+
+	m.Refresh()
+	for _, mod := range m.Modems() {
+		if mod.Signal != 18 || mod.Registration != 1 {
+			t.Errorf("expected the refreshed state got %+v", mod)
+		}
+	}
+
+	imeiTimeout = 100 * time.Millisecond
+	defer func() { imeiTimeout = 10 * time.Second }()
+	silent := NewEmulator("", "")
+	m.Open = silent.Open
+	if err := m.AddPort("/dev/ttyUSB4"); err == nil {
+		t.Error("expected a modem without imei to be rejected")
+	}
+}
+
+func TestVirtualModem(t *testing.T) {
+	v, err := NewVirtualModem(NewEmulator("356789012345678", "640050123456789"))
+	if err != nil {
+		t.Skipf("no pseudo terminals: %v", err)
+	}
+	m := New()
+	var events []string
+	m.OnChange = func(action, target, summary string) {
+		events = append(events, action+" "+target)
+	}
+	err = m.AddPort(v.Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+	modems := m.Modems()
+	if len(modems) != 1 || modems[0].IMSI != "640050123456789" || modems[0].Path != v.Path() {
+		t.Errorf("unexpected modems %+v", modems)
+	}
+	err = m.Unplug(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Modems()) != 0 {
+		t.Errorf("expected the modem to be removed got %+v", m.Modems())
+	}
+	expect := []string{"add 356789012345678", "remove 356789012345678"}
+	if fmt.Sprint(events) != fmt.Sprint(expect) {
+		t.Errorf("expected %v got %v", expect, events)
+	}
+}
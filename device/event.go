@@ -0,0 +1,160 @@
+package device
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The types of Event.
+const (
+	EventAdd          = "add"
+	EventRemove       = "remove"
+	EventSMS          = "sms"
+	EventUSSD         = "ussd"
+	EventRegistration = "registration"
+	EventRing         = "ring"
+	EventCaller       = "caller"
+	EventBoot         = "boot"
+	EventRSSI         = "rssi"
+	EventLowBalance   = "low_balance"
+	EventOther        = "other"
+)
+
+// Event is something that happened to a modem. It was plugged in or removed,
+// or it sent an unsolicited result code which is kept in Line. The fields
+// matching the type are set. Low balance events are raised by fconf itself
+// through Publish.
+type Event struct {
+	Type string    `json:"type"`
+	IMEI string    `json:"imei"`
+	Time time.Time `json:"time"`
+	Line string    `json:"line,omitempty"`
+
+	SMS          *SMSNotice    `json:"sms,omitempty"`
+	USSD         *USSDReply    `json:"ussd,omitempty"`
+	Registration *Registration `json:"registration,omitempty"`
+
+	// Caller is the number of an incoming call and RSSI the signal reported
+	// by Huawei modems with ^RSSI.
+	Caller string `json:"caller,omitempty"`
+	RSSI   *int   `json:"rssi,omitempty"`
+
+	Balance *Balance `json:"balance,omitempty"`
+}
+
+// Balance is the airtime left on the SIM of a modem, below Threshold.
+type Balance struct {
+	Amount    float64 `json:"amount"`
+	Currency  string  `json:"currency,omitempty"`
+	Threshold float64 `json:"threshold"`
+}
+
+// SMSNotice tells where an incoming message was stored, +CMTI: "SM",3.
+type SMSNotice struct {
+	Storage string `json:"storage"`
+	Index   int    `json:"index"`
+}
+
+// USSDReply is a network reply to a USSD request, +CUSD: 0,"text",15. Status
+// 0 ends the session, 1 means the network waits for an answer.
+type USSDReply struct {
+	Status int    `json:"status"`
+	Text   string `json:"text,omitempty"`
+	DCS    int    `json:"dcs"`
+}
+
+// Registration is a change of the network registration, +CREG: 1,"00A1","1B2C"
+// where Status is as reported by AT+CREG? and the location area and cell are
+// hexadecimal.
+type Registration struct {
+	Status int    `json:"status"`
+	LAC    string `json:"lac,omitempty"`
+	CellID string `json:"cell_id,omitempty"`
+}
+
+// ParseEvent returns the event of an unsolicited result code, ok is false if
+// line is not one.
+func ParseEvent(line string) (ev Event, ok bool) {
+	if !unsolicited("", line) {
+		return Event{}, false
+	}
+	ev = Event{Type: EventOther, Time: time.Now(), Line: line}
+	name, args := line, ""
+	if i := strings.IndexRune(line, ':'); i != -1 {
+		name, args = line[:i], strings.TrimSpace(line[i+1:])
+	}
+	f := splitArgs(args)
+	switch name {
+	case "+CMTI", "+CDSI":
+		if len(f) == 2 {
+			if n, err := strconv.Atoi(f[1]); err == nil {
+				ev.Type = EventSMS
+				ev.SMS = &SMSNotice{Storage: f[0], Index: n}
+			}
+		}
+	case "+CUSD":
+		if len(f) > 0 {
+			if n, err := strconv.Atoi(f[0]); err == nil {
+				ev.Type = EventUSSD
+				ev.USSD = &USSDReply{Status: n, DCS: -1}
+				if len(f) > 1 {
+					ev.USSD.Text = f[1]
+				}
+				if len(f) > 2 {
+					if dcs, err := strconv.Atoi(f[2]); err == nil {
+						ev.USSD.DCS = dcs
+					}
+				}
+			}
+		}
+	case "+CREG", "+CGREG":
+		if len(f) > 0 {
+			if n, err := strconv.Atoi(f[0]); err == nil {
+				ev.Type = EventRegistration
+				ev.Registration = &Registration{Status: n}
+				if len(f) > 2 {
+					ev.Registration.LAC, ev.Registration.CellID = f[1], f[2]
+				}
+			}
+		}
+	case "RING", "+CRING":
+		ev.Type = EventRing
+	case "+CLIP":
+		if len(f) > 0 {
+			ev.Type = EventCaller
+			ev.Caller = f[0]
+		}
+	case "^BOOT":
+		ev.Type = EventBoot
+	case "^RSSI":
+		if n, err := strconv.Atoi(args); err == nil {
+			ev.Type = EventRSSI
+			ev.RSSI = &n
+		}
+	}
+	return ev, true
+}
+
+// splitArgs splits the comma separated arguments of a result code, the quotes
+// around strings are removed and commas inside them are kept.
+func splitArgs(s string) []string {
+	if s == "" {
+		return nil
+	}
+	var f []string
+	var cur []byte
+	quoted := false
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"':
+			quoted = !quoted
+		case c == ',' && !quoted:
+			f = append(f, strings.TrimSpace(string(cur)))
+			cur = cur[:0]
+		default:
+			cur = append(cur, c)
+		}
+	}
+	return append(f, strings.TrimSpace(string(cur)))
+}
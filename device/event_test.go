@@ -0,0 +1,79 @@
+package device
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseEvent(t *testing.T) {
+	sample := []struct {
+		line, typ string
+		check     func(Event) bool
+	}{
+		{`+CMTI: "SM",3`, EventSMS, func(ev Event) bool { return ev.SMS.Storage == "SM" && ev.SMS.Index == 3 }},
+		{`+CUSD: 0,"Salio lako ni 1,000 TZS",15`, EventUSSD, func(ev Event) bool {
+			return ev.USSD.Status == 0 && ev.USSD.Text == "Salio lako ni 1,000 TZS" && ev.USSD.DCS == 15
+		}},
+		{`+CUSD: 4`, EventUSSD, func(ev Event) bool { return ev.USSD.Status == 4 && ev.USSD.DCS == -1 }},
+		{`+CREG: 1,"00A1","1B2C"`, EventRegistration, func(ev Event) bool {
+			return ev.Registration.Status == 1 && ev.Registration.LAC == "00A1" && ev.Registration.CellID == "1B2C"
+		}},
+		{`RING`, EventRing, nil},
+		{`+CLIP: "+255700000001",145,,,,0`, EventCaller, func(ev Event) bool { return ev.Caller == "+255700000001" }},
+		{`^BOOT:12345,0,0,0,75`, EventBoot, nil},
+		{`^RSSI:17`, EventRSSI, func(ev Event) bool { return *ev.RSSI == 17 }},
+		{`^MODE:5,4`, EventOther, nil},
+	}
+	for _, v := range sample {
+		ev, ok := ParseEvent(v.line)
+		if !ok || ev.Type != v.typ {
+			t.Errorf("%s: expected %s got %+v", v.line, v.typ, ev)
+			continue
+		}
+		if v.check != nil && !v.check(ev) {
+			t.Errorf("%s: unexpected %+v", v.line, ev)
+		}
+	}
+	for _, line := range []string{"OK", "+CSQ: 18,99", "356789012345678"} {
+		if _, ok := ParseEvent(line); ok {
+			t.Errorf("%s: expected no event", line)
+		}
+	}
+}
+
+func TestManagerEvents(t *testing.T) {
+	e := NewEmulator("356789012345678", "640050123456789")
+	e.ReadTimeout = 10 * time.Millisecond
+	m := New()
+	m.Open = e.Open
+	events, cancel := m.Subscribe()
+	defer cancel()
+	err := m.AddPort("/dev/ttyUSB0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = m.RemoveDevice("/dev/ttyUSB0") }()
+	next := func() Event {
+		select {
+		case ev := <-events:
+			return ev
+		case <-time.After(time.Second):
+			t.Fatal("no event")
+		}
+		return Event{}
+	}
+	if ev := next(); ev.Type != EventAdd || ev.IMEI != "356789012345678" {
+		t.Errorf("expected the modem to be added got %+v", ev)
+	}
+	e.Deliver("+255700000001", "hello")
+	if ev := next(); ev.Type != EventSMS || ev.IMEI != "356789012345678" || ev.SMS.Index != 1 {
+		t.Errorf("expected the incoming message got %+v", ev)
+	}
+	e.Unsolicited(`+CREG: 5,"00A1","1B2C"`)
+	if ev := next(); ev.Type != EventRegistration {
+		t.Errorf("expected the registration got %+v", ev)
+	}
+	if mods := m.Modems(); mods[0].Registration != 5 {
+		t.Errorf("expected the modem to be roaming got %+v", mods[0])
+	}
+}
@@ -0,0 +1,163 @@
+package device
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// probe asks the modem for what does not change while it is plugged in, the
+// hardware, the firmware and the SIM, and turns on the reporting of the
+// location area and cell with the network registration.
+func (m *Manager) probe(mod *Modem) {
+	if mod.conn == nil {
+		return
+	}
+	run := func(cmd string) (*Response, error) {
+		return mod.conn.Do(context.Background(), Low, cmd)
+	}
+	var manufacturer, model, firmware, iccid string
+	if r, err := run("AT+CGMI"); err == nil {
+		manufacturer = infoValue(r, "+CGMI:")
+	}
+	if r, err := run("AT+CGMM"); err == nil {
+		model = infoValue(r, "+CGMM:")
+	}
+	if r, err := run("AT+CGMR"); err == nil {
+		firmware = infoValue(r, "+CGMR:")
+	}
+	if r, err := run("AT+CCID"); err == nil {
+		iccid = parseICCID(r)
+	}
+	if iccid == "" {
+		if r, err := run("AT^ICCID?"); err == nil {
+			iccid = parseICCID(r)
+		}
+	}
+	_, _ = run("AT+CREG=2")
+	_, _ = run("AT+CGREG=2")
+	m.mu.Lock()
+	mod.Manufacturer = manufacturer
+	mod.Model = model
+	mod.Firmware = firmware
+	mod.ICCID = iccid
+	m.mu.Unlock()
+}
+
+// refresh queries the volatile state of the modem, the SIM, the operator, the
+// signal and the registrations.
+func (m *Manager) refresh(mod *Modem) {
+	run := func(cmd string) (*Response, error) {
+		return mod.conn.Do(context.Background(), Low, cmd)
+	}
+	signal := -1
+	var reg, greg Registration
+	var operator, pin string
+	if r, err := run("AT+CPIN?"); err == nil {
+		pin = infoValue(r, "+CPIN:")
+	} else if e, ok := err.(*ModemError); ok {
+		pin = e.Text()
+	}
+	if r, err := run("AT+CSQ"); err == nil {
+		signal = parseCSQ([]byte(r.String()))
+	}
+	reg = parseRegistration(run("AT+CREG?"))
+	greg = parseRegistration(run("AT+CGREG?"))
+	if r, err := run("AT+COPS?"); err == nil {
+		operator = parseCOPS(r)
+	}
+	m.mu.Lock()
+	mod.PIN = pin
+	mod.Signal = signal
+	mod.DBM = rssiDBM(signal)
+	mod.Registration = reg.Status
+	mod.GPRSRegistration = greg.Status
+	mod.LAC, mod.CellID = reg.LAC, reg.CellID
+	if mod.LAC == "" {
+		mod.LAC, mod.CellID = greg.LAC, greg.CellID
+	}
+	mod.Operator = operator
+	mod.Updated = time.Now()
+	snapshot := *mod
+	m.mu.Unlock()
+	if m.OnRefresh != nil {
+		m.OnRefresh(snapshot)
+	}
+}
+
+// rssiDBM converts the rssi of AT+CSQ to dBm, it is nil when the signal is
+// not known. 0 is -113 dBm or less and 31 is -51 dBm or more.
+func rssiDBM(rssi int) *int {
+	if rssi < 0 || rssi > 31 {
+		return nil
+	}
+	dbm := -113 + 2*rssi
+	return &dbm
+}
+
+// infoValue returns the first line of the answer without prefix, some modems
+// answer AT+CGMI with +CGMI: huawei and others with huawei.
+func infoValue(r *Response, prefix string) string {
+	return strings.Trim(strings.TrimSpace(strings.TrimPrefix(r.Value(), prefix)), `"`)
+}
+
+// parseICCID returns the ICCID of the SIM answered to AT+CCID or AT^ICCID?.
+// Huawei modems give the digits of ^ICCID swapped by pairs like they are
+// stored on the SIM, which is seen from the leading 98 instead of 89.
+func parseICCID(r *Response) string {
+	s := r.Value()
+	swapped := strings.HasPrefix(s, "^ICCID:")
+	for _, p := range []string{"+CCID:", "^ICCID:", "+ICCID:"} {
+		s = strings.TrimPrefix(s, p)
+	}
+	s = strings.Trim(strings.TrimSpace(s), `"`)
+	if swapped && strings.HasPrefix(s, "98") {
+		b := []byte(s)
+		for i := 0; i+1 < len(b); i += 2 {
+			b[i], b[i+1] = b[i+1], b[i]
+		}
+		s = strings.TrimRight(string(b), "F")
+	}
+	if !isNumber(s) {
+		return ""
+	}
+	return s
+}
+
+// parseRegistration returns the registration answered to AT+CREG? or
+// AT+CGREG?, like +CREG: 2,1,"00A1","1B2C". The status is -1 when the command
+// failed.
+func parseRegistration(r *Response, err error) Registration {
+	reg := Registration{Status: -1}
+	if err != nil {
+		return reg
+	}
+	s := r.Value()
+	i := strings.IndexRune(s, ':')
+	if i == -1 {
+		return reg
+	}
+	f := splitArgs(strings.TrimSpace(s[i+1:]))
+	if len(f) < 2 {
+		return reg
+	}
+	n, err := strconv.Atoi(f[1])
+	if err != nil {
+		return reg
+	}
+	reg.Status = n
+	if len(f) > 3 {
+		reg.LAC, reg.CellID = f[2], f[3]
+	}
+	return reg
+}
+
+// parseCOPS returns the operator answered to AT+COPS?, +COPS: 0,0,"Vodacom",2.
+func parseCOPS(r *Response) string {
+	f := splitArgs(strings.TrimSpace(strings.TrimPrefix(r.Value(), "+COPS:")))
+	if len(f) < 3 {
+		return ""
+	}
+	return f[2]
+}
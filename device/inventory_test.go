@@ -0,0 +1,79 @@
+package device
+
+import (
+	"testing"
+
+	"github.com/tarm/serial"
+)
+
+func TestParseInventory(t *testing.T) {
+	iccid := []struct {
+		line, expect string
+	}{
+		{"+CCID: 8925500000000000017", "8925500000000000017"},
+		{`+CCID: "8925500000000000017"`, "8925500000000000017"},
+		{"^ICCID: 985250000000000010F7", "8925050000000000017"},
+		{"8925500000000000017", "8925500000000000017"},
+		{"+CCID: ERROR", ""},
+	}
+	for _, v := range iccid {
+		if s := parseICCID(&Response{Lines: []string{v.line}}); s != v.expect {
+			t.Errorf("%s: expected %q got %q", v.line, v.expect, s)
+		}
+	}
+	reg := parseRegistration(&Response{Lines: []string{`+CGREG: 2,5,"00A1","1B2C"`}}, nil)
+	if reg.Status != 5 || reg.LAC != "00A1" || reg.CellID != "1B2C" {
+		t.Errorf("unexpected registration %+v", reg)
+	}
+	if reg := parseRegistration(&Response{Lines: []string{"+CREG: 0,1"}}, nil); reg.Status != 1 || reg.LAC != "" {
+		t.Errorf("unexpected registration %+v", reg)
+	}
+	if reg := parseRegistration(nil, ErrTimeout); reg.Status != -1 {
+		t.Errorf("expected an unknown registration got %+v", reg)
+	}
+	if s := parseCOPS(&Response{Lines: []string{`+COPS: 0,0,"Vodacom TZ",2`}}); s != "Vodacom TZ" {
+		t.Errorf("unexpected operator %q", s)
+	}
+	for rssi, expect := range map[int]int{0: -113, 18: -77, 31: -51} {
+		if dbm := rssiDBM(rssi); dbm == nil || *dbm != expect {
+			t.Errorf("%d: expected %d dBm got %v", rssi, expect, dbm)
+		}
+	}
+	if dbm := rssiDBM(99); dbm != nil {
+		t.Errorf("expected an unknown signal got %d", *dbm)
+	}
+}
+
+func TestManagerInventory(t *testing.T) {
+	e := NewEmulator("356789012345678", "640050123456789")
+	e.Operator = "Vodacom TZ"
+	m := New()
+	m.Open = func(cfg *serial.Config) (Port, error) { return e, nil }
+	err := m.AddPort("/dev/ttyUSB0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mod, ok := m.Modem("356789012345678")
+	if !ok {
+		t.Fatal("expected the modem")
+	}
+	if mod.Manufacturer != "huawei" || mod.Model != "E173" || mod.Firmware != e.Firmware || mod.ICCID != "8925640050123456789" {
+		t.Errorf("unexpected hardware %+v", mod)
+	}
+	if mod.PIN != "READY" || mod.Operator != "Vodacom TZ" || mod.DBM == nil || *mod.DBM != -77 {
+		t.Errorf("unexpected state %+v", mod)
+	}
+	if mod.Registration != 1 || mod.GPRSRegistration != 1 || mod.LAC != "00A1" || mod.CellID != "1B2C" {
+		t.Errorf("unexpected registration %+v", mod)
+	}
+	if mod.Updated.IsZero() {
+		t.Error("expected the refresh time")
+	}
+
+	e.Signal, e.Registration = 99, 5
+	m.Refresh()
+	mod, _ = m.Modem("356789012345678")
+	if mod.DBM != nil || mod.Registration != 5 {
+		t.Errorf("expected the refreshed state got %+v", mod)
+	}
+}
@@ -0,0 +1,29 @@
+package device
+
+import (
+	"io"
+
+	"github.com/tarm/serial"
+)
+
+// Port is the serial line to a modem. *serial.Port implements it, the
+// Emulator stands in for it when there is no hardware.
+type Port interface {
+	io.ReadWriteCloser
+
+	// Flush discards the data written but not transmitted and the data
+	// received but not read.
+	Flush() error
+}
+
+// Opener opens the port described by cfg.
+type Opener func(cfg *serial.Config) (Port, error)
+
+// openSerial is the Opener used unless one is set on the Manager.
+func openSerial(cfg *serial.Config) (Port, error) {
+	p, err := serial.OpenPort(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
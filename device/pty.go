@@ -0,0 +1,153 @@
+package device
+
+import (
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// VirtualModem is an Emulator behind a pseudo terminal. The slave side at Path
+// is a tty like the ones of the dongles, so it goes through the same code as a
+// real modem, symlinks included.
+type VirtualModem struct {
+	Emulator *Emulator
+
+	master *os.File
+	// slave is kept open so the master does not fail with EIO each time the
+	// manager closes the tty.
+	slave *os.File
+	path  string
+	quit  chan struct{}
+	wg    sync.WaitGroup
+}
+
+// NewVirtualModem creates a pty pair and starts answering the commands written
+// to it with e.
+func NewVirtualModem(e *Emulator) (*VirtualModem, error) {
+	master, path, err := openPty()
+	if err != nil {
+		return nil, err
+	}
+	slave, err := os.OpenFile(path, os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		_ = master.Close()
+		return nil, err
+	}
+	err = makeRaw(slave.Fd())
+	if err != nil {
+		_ = slave.Close()
+		_ = master.Close()
+		return nil, err
+	}
+	v := &VirtualModem{
+		Emulator: e,
+		master:   master,
+		slave:    slave,
+		path:     path,
+		quit:     make(chan struct{}),
+	}
+	v.wg.Add(2)
+	go v.input()
+	go v.output()
+	return v, nil
+}
+
+// Path returns the tty of the modem, like /dev/pts/3.
+func (v *VirtualModem) Path() string {
+	return v.path
+}
+
+// Close stops the modem and removes its pty.
+func (v *VirtualModem) Close() error {
+	close(v.quit)
+	err := v.master.Close()
+	v.wg.Wait()
+	if serr := v.slave.Close(); err == nil {
+		err = serr
+	}
+	return err
+}
+
+// input passes what is written to the tty to the emulator.
+func (v *VirtualModem) input() {
+	defer v.wg.Done()
+	buf := make([]byte, 256)
+	for {
+		n, err := v.master.Read(buf)
+		if n > 0 {
+			_, _ = v.Emulator.Write(buf[:n])
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// output passes what the emulator answers to the tty. The emulator reads time
+// out so quit is checked regularly.
+func (v *VirtualModem) output() {
+	defer v.wg.Done()
+	buf := make([]byte, 256)
+	for {
+		select {
+		case <-v.quit:
+			return
+		default:
+		}
+		n, _ := v.Emulator.Read(buf)
+		if n == 0 {
+			continue
+		}
+		if _, err := v.master.Write(buf[:n]); err != nil {
+			return
+		}
+	}
+}
+
+// openPty opens a new pseudo terminal master and returns it with the path of
+// its slave. The master is opened non blocking so closing it stops a pending
+// Read.
+func openPty() (*os.File, string, error) {
+	fd, err := syscall.Open("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, "", err
+	}
+	var n uint32
+	err = ioctl(uintptr(fd), syscall.TIOCGPTN, uintptr(unsafe.Pointer(&n)))
+	if err == nil {
+		var unlock int32
+		err = ioctl(uintptr(fd), syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock)))
+	}
+	if err != nil {
+		_ = syscall.Close(fd)
+		return nil, "", err
+	}
+	return os.NewFile(uintptr(fd), "/dev/ptmx"), "/dev/pts/" + strconv.Itoa(int(n)), nil
+}
+
+// makeRaw turns off the line discipline of the tty fd, so the bytes go through
+// untouched as they do on a serial line.
+func makeRaw(fd uintptr) error {
+	var t syscall.Termios
+	err := ioctl(fd, syscall.TCGETS, uintptr(unsafe.Pointer(&t)))
+	if err != nil {
+		return err
+	}
+	t.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP |
+		syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+	t.Oflag &^= syscall.OPOST
+	t.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	t.Cflag &^= syscall.CSIZE | syscall.PARENB
+	t.Cflag |= syscall.CS8
+	return ioctl(fd, syscall.TCSETS, uintptr(unsafe.Pointer(&t)))
+}
+
+func ioctl(fd, req, arg uintptr) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, arg)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
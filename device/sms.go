@@ -0,0 +1,214 @@
+package device
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/FarmRadioHangar/fessboxconfig/sms"
+)
+
+// SMS is a text message stored in the SIM of a modem. The parts of a
+// concatenated message are put together, Indexes are where they are stored.
+type SMS struct {
+	Indexes []int     `json:"indexes"`
+	Status  string    `json:"status"`
+	Number  string    `json:"number"`
+	Time    time.Time `json:"time"`
+	Text    string    `json:"text"`
+
+	// Complete is false while some parts of a concatenated message have not
+	// come in yet.
+	Complete bool `json:"complete"`
+}
+
+// smsStatuses are the statuses of the stored messages as listed by AT+CMGL in
+// PDU mode.
+var smsStatuses = []string{"unread", "read", "unsent", "sent"}
+
+// concatRef numbers the concatenated messages sent by fconf.
+var concatRef uint32
+
+// SendSMS sends msg with the modem with the given IMEI and returns
+// the references given by the network. A text too long for one message is
+// sent as a concatenated message, there is then a reference per part.
+func (m *Manager) SendSMS(ctx context.Context, imei string, msg sms.Message) ([]int, error) {
+	c, err := m.conn(imei)
+	if err != nil {
+		return nil, err
+	}
+	msg.Type = sms.Submit
+	parts, err := sms.Split(msg, int(atomic.AddUint32(&concatRef, 1)&0xff))
+	if err != nil {
+		return nil, err
+	}
+	var refs []int
+	for _, p := range parts {
+		pdu, err := p.Encode()
+		if err != nil {
+			return refs, err
+		}
+		cmd := "AT+CMGS=" + strconv.Itoa(sms.Length(pdu))
+		r, err := c.inPDU(ctx, Normal, cmd, strings.ToUpper(hex.EncodeToString(pdu)))
+		if err != nil {
+			return refs, err
+		}
+		ref, _ := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(r.Value(), "+CMGS:")))
+		refs = append(refs, ref)
+	}
+	return refs, nil
+}
+
+// Inbox returns the messages stored in the SIM of the modem with the given
+// IMEI, oldest first. Listing them marks the unread ones as read.
+func (m *Manager) Inbox(ctx context.Context, imei string) ([]SMS, error) {
+	c, err := m.conn(imei)
+	if err != nil {
+		return nil, err
+	}
+	r, err := c.inPDU(ctx, Normal, "AT+CMGL=4", "")
+	if err != nil {
+		return nil, err
+	}
+	return parseStored(r.Lines, "+CMGL:", true), nil
+}
+
+// ReadSMS returns the message stored at index in the SIM of the modem with the
+// given IMEI. It is one part when the message is concatenated.
+func (m *Manager) ReadSMS(ctx context.Context, imei string, index int) (*SMS, error) {
+	c, err := m.conn(imei)
+	if err != nil {
+		return nil, err
+	}
+	r, err := c.inPDU(ctx, Normal, "AT+CMGR="+strconv.Itoa(index), "")
+	if err != nil {
+		return nil, err
+	}
+	list := parseStored(r.Lines, "+CMGR:", false)
+	if len(list) == 0 {
+		return nil, errors.New("no message at index " + strconv.Itoa(index))
+	}
+	list[0].Indexes = []int{index}
+	return &list[0], nil
+}
+
+// DeleteSMS deletes the message stored at index in the SIM of the modem with
+// the given IMEI.
+func (m *Manager) DeleteSMS(ctx context.Context, imei string, index int) error {
+	c, err := m.conn(imei)
+	if err != nil {
+		return err
+	}
+	_, err = c.Do(ctx, Normal, "AT+CMGD="+strconv.Itoa(index))
+	return err
+}
+
+// conn returns the connection of the modem with the given IMEI.
+func (m *Manager) conn(imei string) (*Conn, error) {
+	mod, ok := m.getModem(imei)
+	if !ok {
+		return nil, ErrNoModem
+	}
+	if mod.conn == nil {
+		return nil, errors.New("modem " + imei + " has no connection")
+	}
+	return mod.conn, nil
+}
+
+// stored is a message listed by AT+CMGL or read by AT+CMGR.
+type stored struct {
+	index  int
+	status string
+	msg    *sms.Message
+}
+
+// parseStored returns the messages of the lines answered to AT+CMGL or AT+CMGR
+// in PDU mode, a line with prefix followed by a line with the PDU. With
+// index the line starts with the index of the message, as done by AT+CMGL.
+// The messages that can not be decoded are left out.
+func parseStored(lines []string, prefix string, index bool) []SMS {
+	var list []stored
+	for i := 0; i+1 < len(lines); i++ {
+		if !strings.HasPrefix(lines[i], prefix) {
+			continue
+		}
+		f := splitArgs(strings.TrimSpace(strings.TrimPrefix(lines[i], prefix)))
+		pdu, err := hex.DecodeString(lines[i+1])
+		if err != nil || len(f) < 2 {
+			continue
+		}
+		i++
+		s := stored{index: -1}
+		if index {
+			s.index, _ = strconv.Atoi(f[0])
+			f = f[1:]
+		}
+		if n, err := strconv.Atoi(f[0]); err == nil && n >= 0 && n < len(smsStatuses) {
+			s.status = smsStatuses[n]
+		}
+		s.msg, err = sms.Decode(pdu)
+		if err != nil {
+			continue
+		}
+		list = append(list, s)
+	}
+	return joinStored(list)
+}
+
+// joinStored puts the parts of the concatenated messages together, the
+// message takes the place of its first part.
+func joinStored(list []stored) []SMS {
+	type key struct {
+		number     string
+		ref, total int
+	}
+	var groups [][]stored
+	pos := make(map[key]int)
+	for _, s := range list {
+		c := s.msg.Concat
+		if c == nil {
+			groups = append(groups, []stored{s})
+			continue
+		}
+		k := key{s.msg.Number, c.Ref, c.Total}
+		if i, ok := pos[k]; ok {
+			groups[i] = append(groups[i], s)
+			continue
+		}
+		pos[k] = len(groups)
+		groups = append(groups, []stored{s})
+	}
+	out := make([]SMS, len(groups))
+	for i, g := range groups {
+		out[i] = smsOf(g)
+	}
+	return out
+}
+
+// smsOf returns the message made of the parts.
+func smsOf(parts []stored) SMS {
+	msgs := make([]*sms.Message, len(parts))
+	s := SMS{Status: parts[0].status}
+	for i, p := range parts {
+		msgs[i] = p.msg
+		if p.index >= 0 {
+			s.Indexes = append(s.Indexes, p.index)
+		}
+		if p.status == "unread" {
+			s.Status = p.status
+		}
+	}
+	sort.Ints(s.Indexes)
+	msg, ok := sms.Join(msgs)
+	s.Number, s.Time, s.Text, s.Complete = msg.Number, msg.Time, msg.Text, ok
+	if msg.Text == "" && len(msg.Data) > 0 {
+		s.Text = fmt.Sprintf("%X", msg.Data)
+	}
+	return s
+}
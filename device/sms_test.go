@@ -0,0 +1,93 @@
+package device
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/FarmRadioHangar/fessboxconfig/sms"
+)
+
+func TestManagerSMS(t *testing.T) {
+	e := NewEmulator("356789012345678", "640050123456789")
+	m := New()
+	m.Open = e.Open
+	err := m.AddPort("/dev/ttyUSB0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = m.RemoveDevice("/dev/ttyUSB0") }()
+	ctx := context.Background()
+
+	long := strings.Repeat("Habari za asubuhi ", 10)
+	refs, err := m.SendSMS(ctx, "356789012345678", sms.Message{Number: "+255700000001", Text: long})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent := e.Sent()
+	if len(refs) != 2 || len(sent) != 2 || sent[0].Number != "+255700000001" || sent[0].Text+sent[1].Text != long {
+		t.Errorf("expected the text in two parts got %v %+v", refs, sent)
+	}
+	if _, err := m.SendSMS(ctx, "356789012345670", sms.Message{Number: "1", Text: "hi"}); err != ErrNoModem {
+		t.Errorf("expected an unknown modem got %v", err)
+	}
+
+	e.Deliver("+255700000002", "Salio lako ni TZS 1,000")
+	e.Deliver("+255700000003", strings.Repeat("ж", 100))
+	inbox, err := m.Inbox(ctx, "356789012345678")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inbox) != 2 {
+		t.Fatalf("expected two messages got %+v", inbox)
+	}
+	if v := inbox[0]; v.Text != "Salio lako ni TZS 1,000" || v.Status != "unread" || v.Number != "+255700000002" || !v.Complete {
+		t.Errorf("unexpected first message %+v", v)
+	}
+	if v := inbox[1]; v.Text != strings.Repeat("ж", 100) || len(v.Indexes) != 2 || !v.Complete {
+		t.Errorf("expected the parts to be joined got %+v", v)
+	}
+
+	// another client switching to text mode between the commands
+	c, err := m.conn("356789012345678")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			_, _ = c.Do(ctx, Normal, "AT+CMGF=1")
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		list, err := m.Inbox(ctx, "356789012345678")
+		if err != nil || len(list) != 2 {
+			t.Errorf("%d: expected the inbox in PDU mode got %+v %v", i, list, err)
+			break
+		}
+	}
+	close(stop)
+	<-done
+
+	v, err := m.ReadSMS(ctx, "356789012345678", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Status != "read" || v.Text != "Salio lako ni TZS 1,000" {
+		t.Errorf("unexpected message %+v", v)
+	}
+	err = m.DeleteSMS(ctx, "356789012345678", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.ReadSMS(ctx, "356789012345678", 1); err == nil {
+		t.Error("expected the message to be deleted")
+	}
+}
@@ -0,0 +1,299 @@
+package device
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf16"
+
+	"github.com/FarmRadioHangar/fessboxconfig/sms"
+)
+
+// ussdTimeout is how long a USSD session waiting for an answer is kept open
+// before it is cancelled, the networks drop them after a minute or so anyway.
+const ussdTimeout = 45 * time.Second
+
+// ussdDCS is the data coding scheme of the requests, GSM 7 bit with no
+// language given.
+const ussdDCS = 15
+
+// ErrUSSDBusy is returned by USSDIfIdle when the modem is in a USSD session.
+var ErrUSSDBusy = errors.New("a USSD session is running on the modem")
+
+// ussdSession is the USSD session of a modem. mu is held while a request waits
+// for its reply, since a modem has a single session. gen counts the replies so
+// a timer firing late does not cancel the session that followed. open is 1
+// while the network waits for an answer and pending counts the requests
+// running or waiting for mu, both are read without mu by USSDBusy.
+type ussdSession struct {
+	mu      sync.Mutex
+	open    int32
+	pending int32
+	gen     int
+	timer   *time.Timer
+}
+
+func (s *ussdSession) setOpen(open bool) {
+	var v int32
+	if open {
+		v = 1
+	}
+	atomic.StoreInt32(&s.open, v)
+}
+
+// USSD sends the USSD code, like *150#, with the modem with the given IMEI
+// and waits for the reply of the network. When the reply has status 1 the
+// session stays open and the next call sends the answer, like a choice in a
+// menu. The session is cancelled if no answer comes within USSDTimeout.
+func (m *Manager) USSD(ctx context.Context, imei, code string) (*USSDReply, error) {
+	return m.ussdRequest(ctx, imei, code, false)
+}
+
+// USSDIfIdle is like USSD but starts a new session only, it returns
+// ErrUSSDBusy instead of sending the code while another request runs or the
+// network waits for an answer in the session of the modem.
+func (m *Manager) USSDIfIdle(ctx context.Context, imei, code string) (*USSDReply, error) {
+	return m.ussdRequest(ctx, imei, code, true)
+}
+
+func (m *Manager) ussdRequest(ctx context.Context, imei, code string, idle bool) (*USSDReply, error) {
+	c, err := m.conn(imei)
+	if err != nil {
+		return nil, err
+	}
+	s := m.session(imei)
+	if idle {
+		if !atomic.CompareAndSwapInt32(&s.pending, 0, 1) {
+			return nil, ErrUSSDBusy
+		}
+	} else {
+		atomic.AddInt32(&s.pending, 1)
+	}
+	defer atomic.AddInt32(&s.pending, -1)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// open only changes with mu held, a request that came in after the check
+	// above may have opened a menu in the meantime.
+	if idle && atomic.LoadInt32(&s.open) == 1 {
+		return nil, ErrUSSDBusy
+	}
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	events, cancel := m.Subscribe()
+	defer cancel()
+	arg, err := encodeUSSD(code, m.packedUSSD(imei))
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.Do(ctx, High, fmt.Sprintf("AT+CUSD=1,%q,%d", arg, ussdDCS))
+	if err != nil {
+		s.setOpen(false)
+		return nil, err
+	}
+	reply := func(r *USSDReply) *USSDReply {
+		s.setOpen(r.Status == 1)
+		s.gen++
+		if r.Status == 1 {
+			gen := s.gen
+			s.timer = time.AfterFunc(m.ussdTimeout(), func() { m.expireUSSD(imei, s, gen) })
+		}
+		return r
+	}
+	// some modems send the reply before the OK, it is then part of the
+	// response instead of an unsolicited line.
+	for _, line := range resp.Lines {
+		if !strings.HasPrefix(line, "+CUSD:") {
+			continue
+		}
+		if ev, ok := ParseEvent(line); ok && ev.USSD != nil {
+			ev.IMEI = imei
+			ev.USSD.Text = decodeUSSD(ev.USSD.Text, ev.USSD.DCS, m.packedUSSD(imei))
+			m.publish(ev)
+			return reply(ev.USSD), nil
+		}
+	}
+	deadline := time.NewTimer(Timeout("AT+CUSD"))
+	defer deadline.Stop()
+	for {
+		select {
+		case ev := <-events:
+			if ev.Type != EventUSSD || ev.IMEI != imei || ev.USSD == nil {
+				continue
+			}
+			return reply(ev.USSD), nil
+		case <-deadline.C:
+			abortUSSD(c, s)
+			return nil, ErrTimeout
+		case <-ctx.Done():
+			abortUSSD(c, s)
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// abortUSSD cancels the session s when its reply did not come, the network
+// would otherwise keep it open until it gives up.
+func abortUSSD(c *Conn, s *ussdSession) {
+	s.setOpen(false)
+	_, _ = c.Do(context.Background(), Normal, "AT+CUSD=2")
+}
+
+// CancelUSSD ends the USSD session of the modem with the given IMEI.
+func (m *Manager) CancelUSSD(ctx context.Context, imei string) error {
+	c, err := m.conn(imei)
+	if err != nil {
+		return err
+	}
+	s := m.session(imei)
+	atomic.AddInt32(&s.pending, 1)
+	defer atomic.AddInt32(&s.pending, -1)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	s.setOpen(false)
+	_, err = c.Do(ctx, High, "AT+CUSD=2")
+	return err
+}
+
+// USSDBusy returns true while a USSD request is running with the modem with
+// the given IMEI, or the network waits for an answer in its session.
+func (m *Manager) USSDBusy(imei string) bool {
+	m.mu.RLock()
+	s, ok := m.ussd[imei]
+	m.mu.RUnlock()
+	return ok && (atomic.LoadInt32(&s.pending) > 0 || atomic.LoadInt32(&s.open) == 1)
+}
+
+// expireUSSD cancels the session s of the modem if it is still waiting for the
+// answer to reply gen, and tells the subscribers it ended.
+func (m *Manager) expireUSSD(imei string, s *ussdSession, gen int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if atomic.LoadInt32(&s.open) == 0 || s.gen != gen {
+		return
+	}
+	s.setOpen(false)
+	if c, err := m.conn(imei); err == nil {
+		_, _ = c.Do(context.Background(), Normal, "AT+CUSD=2")
+	}
+	m.publish(Event{
+		Type: EventUSSD,
+		IMEI: imei,
+		Time: time.Now(),
+		USSD: &USSDReply{Status: 2, Text: "the session timed out", DCS: -1},
+	})
+}
+
+// session returns the USSD session of the modem.
+func (m *Manager) session(imei string) *ussdSession {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.ussd[imei]
+	if !ok {
+		s = &ussdSession{}
+		m.ussd[imei] = s
+	}
+	return s
+}
+
+func (m *Manager) ussdTimeout() time.Duration {
+	if m.USSDTimeout > 0 {
+		return m.USSDTimeout
+	}
+	return ussdTimeout
+}
+
+// packedUSSD returns true if the modem takes and gives the USSD strings as
+// packed GSM 7 bit in hex, which the Huawei modems do.
+func (m *Manager) packedUSSD(imei string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	mod, ok := m.modems[imei]
+	return ok && strings.Contains(strings.ToLower(mod.Manufacturer), "huawei")
+}
+
+// encodeUSSD returns the USSD string to give to AT+CUSD. When packed the
+// septets are packed and written in hex, a carriage return fills the last
+// octet if it has room for a whole septet so it is not read as an @.
+func encodeUSSD(code string, packed bool) (string, error) {
+	septets, ok := sms.GSM7Septets(code)
+	if !ok {
+		return "", fmt.Errorf("%q has characters missing from the GSM 7 bit alphabet", code)
+	}
+	if !packed {
+		return code, nil
+	}
+	if len(septets)%8 == 7 {
+		septets = append(septets, '\r')
+	}
+	return strings.ToUpper(hex.EncodeToString(sms.Pack(septets))), nil
+}
+
+// decodeUSSD returns the text of a USSD string given with the data coding
+// scheme dcs of 3GPP TS 23.038. UCS-2 strings are in hex, and so are the GSM 7
+// bit ones of the modems giving them packed.
+func decodeUSSD(s string, dcs int, packed bool) string {
+	switch ussdAlphabet(dcs) {
+	case "ucs2":
+		b, err := hex.DecodeString(s)
+		if err != nil || len(b)%2 != 0 {
+			return s
+		}
+		u := make([]uint16, len(b)/2)
+		for i := range u {
+			u[i] = uint16(b[2*i])<<8 | uint16(b[2*i+1])
+		}
+		if dcs == 0x11 && len(u) >= 2 {
+			// the language comes first
+			u = u[2:]
+		}
+		return string(utf16.Decode(u))
+	case "8bit":
+		if b, err := hex.DecodeString(s); err == nil {
+			return string(b)
+		}
+		return s
+	}
+	if !packed {
+		return s
+	}
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return s
+	}
+	septets := sms.Unpack(b, len(b)*8/7)
+	if n := len(septets); n > 0 && n%8 == 0 && (septets[n-1] == '\r' || septets[n-1] == 0) {
+		// the padding of the last octet, some networks leave it zero
+		septets = septets[:n-1]
+	}
+	return sms.GSM7Text(septets)
+}
+
+// ussdAlphabet returns the alphabet of the data coding scheme of a USSD
+// string, gsm7, 8bit or ucs2. A missing scheme is GSM 7 bit.
+func ussdAlphabet(dcs int) string {
+	switch {
+	case dcs < 0:
+		return "gsm7"
+	case dcs == 0x11:
+		return "ucs2"
+	case dcs&0xc0 == 0x40:
+		switch (dcs >> 2) & 0x03 {
+		case 1:
+			return "8bit"
+		case 2:
+			return "ucs2"
+		}
+	case dcs&0xf0 == 0xf0 && dcs&0x04 != 0:
+		return "8bit"
+	}
+	return "gsm7"
+}
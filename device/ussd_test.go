@@ -0,0 +1,210 @@
+package device
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestEncodeUSSD(t *testing.T) {
+	sample := []struct {
+		code   string
+		packed bool
+		expect string
+	}{
+		{"*100#", true, "AA180C3602"},
+		{"*100#", false, "*100#"},
+		{"1", true, "31"},
+		// seven septets leave room for a carriage return
+		{"*123*1#", true, "AA986CA68A8D1A"},
+	}
+	for _, v := range sample {
+		s, err := encodeUSSD(v.code, v.packed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s != v.expect {
+			t.Errorf("%q: expected %s got %s", v.code, v.expect, s)
+		}
+		if v.packed {
+			if d := decodeUSSD(s, 15, true); d != v.code {
+				t.Errorf("%s: expected %q got %q", s, v.code, d)
+			}
+		}
+	}
+	if _, err := encodeUSSD("*100#ж", true); err == nil {
+		t.Error("expected an error for a character missing from the alphabet")
+	}
+}
+
+func TestDecodeUSSD(t *testing.T) {
+	sample := []struct {
+		s      string
+		dcs    int
+		packed bool
+		expect string
+	}{
+		{"Salio 1000", 15, false, "Salio 1000"},
+		{"Salio 1000", -1, false, "Salio 1000"},
+		{"AA180C3602", 15, true, "*100#"},
+		{"AA180C3602", 15, false, "AA180C3602"},
+		{"0042006100720061006B0061", 72, false, "Baraka"},
+		{"0042006100720061006B0061", 72, true, "Baraka"},
+		{"0073007700420061", 0x11, false, "Ba"},
+		{"48656C6C6F", 68, false, "Hello"},
+		{"not hex", 72, false, "not hex"},
+	}
+	for _, v := range sample {
+		if d := decodeUSSD(v.s, v.dcs, v.packed); d != v.expect {
+			t.Errorf("%s/%d: expected %q got %q", v.s, v.dcs, v.expect, d)
+		}
+	}
+}
+
+func TestManagerUSSD(t *testing.T) {
+	e := NewEmulator("356789012345678", "640050123456789")
+	e.USSD = map[string]string{
+		"*150#":     "Salio lako ni TZS 1,000",
+		"*149#":     "1. Salio\n2. Vifurushi",
+		"*149#>1":   "Salio lako ni TZS 1,000",
+		"*149#>2":   "1. Siku\n2. Wiki",
+		"*149#>2>2": "Umejiunga na kifurushi cha wiki",
+		"*102#":     "Баланс 100",
+	}
+	m := New()
+	m.Open = e.Open
+	m.USSDTimeout = 300 * time.Millisecond
+	err := m.AddPort("/dev/ttyUSB0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = m.RemoveDevice("/dev/ttyUSB0") }()
+	ctx := context.Background()
+	imei := "356789012345678"
+
+	r, err := m.USSD(ctx, imei, "*150#")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Status != 0 || r.Text != "Salio lako ni TZS 1,000" {
+		t.Errorf("unexpected reply %+v", r)
+	}
+	r, err = m.USSD(ctx, imei, "*102#")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Text != "Баланс 100" || r.DCS != 72 {
+		t.Errorf("expected the UCS-2 reply decoded got %+v", r)
+	}
+	r, err = m.USSD(ctx, imei, "*999#")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Status != 4 {
+		t.Errorf("expected an unsupported reply got %+v", r)
+	}
+
+	for i, v := range []struct {
+		code   string
+		status int
+		text   string
+	}{
+		{"*149#", 1, "1. Salio\n2. Vifurushi"},
+		{"2", 1, "1. Siku\n2. Wiki"},
+		{"2", 0, "Umejiunga na kifurushi cha wiki"},
+	} {
+		r, err = m.USSD(ctx, imei, v.code)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Status != v.status || r.Text != v.text {
+			t.Errorf("%d: expected %d %q got %+v", i, v.status, v.text, r)
+		}
+	}
+
+	events, cancel := m.Subscribe()
+	defer cancel()
+	r, err = m.USSD(ctx, imei, "*149#")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Status != 1 {
+		t.Fatalf("expected the menu to stay open got %+v", r)
+	}
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case ev := <-events:
+			if ev.Type != EventUSSD || ev.USSD.Status != 2 {
+				continue
+			}
+		case <-timeout:
+			t.Fatal("expected the session to time out")
+		}
+		break
+	}
+	r, err = m.USSD(ctx, imei, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Status != 4 {
+		t.Errorf("expected the answer to come after the session ended got %+v", r)
+	}
+
+	_, err = m.USSD(ctx, imei, "*149#")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.CancelUSSD(ctx, imei)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err = m.USSD(ctx, imei, "*150#")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Status != 0 {
+		t.Errorf("expected a new session after the cancel got %+v", r)
+	}
+	if _, err := m.USSD(ctx, "356789012345670", "*150#"); err != ErrNoModem {
+		t.Errorf("expected an unknown modem got %v", err)
+	}
+
+	// the emulator is a Huawei, it takes and gives packed strings
+	packed := func(s string) string {
+		v, err := encodeUSSD(s, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	e.Reply(fmt.Sprintf("AT+CUSD=1,%q,15", packed("*160#")), fmt.Sprintf("+CUSD: 0,%q,15", packed("Salio lako ni TZS 500")), "OK")
+	r, err = m.USSD(ctx, imei, "*160#")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Status != 0 || r.Text != "Salio lako ni TZS 500" {
+		t.Errorf("expected the reply sent before the OK got %+v", r)
+	}
+
+	e.Reply(fmt.Sprintf("AT+CUSD=1,%q,15", packed("*161#")), "OK")
+	e.Reply("AT+CUSD=2", "OK", fmt.Sprintf("+CUSD: 2,%q,15", packed("Imesitishwa")))
+	short, stop := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer stop()
+	if _, err := m.USSD(short, imei, "*161#"); err != context.DeadlineExceeded {
+		t.Errorf("expected the request to be cancelled got %v", err)
+	}
+	timeout = time.After(2 * time.Second)
+	for {
+		select {
+		case ev := <-events:
+			if ev.Type != EventUSSD || ev.USSD.Text != "Imesitishwa" {
+				continue
+			}
+		case <-timeout:
+			t.Fatal("expected the session of a cancelled request to be ended")
+		}
+		break
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/FarmRadioHangar/fessboxconfig/device"
+)
+
+// check is the result of a single diagnostic test.
+type check struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+func newCheck(name string, err error) check {
+	if err != nil {
+		return check{Name: name, Detail: err.Error()}
+	}
+	return check{Name: name, OK: true}
+}
+
+// report is the outcome of all the diagnostic tests, OK is true only when every
+// check passed.
+type report struct {
+	OK     bool      `json:"ok"`
+	Time   time.Time `json:"time"`
+	Checks []check   `json:"checks"`
+}
+
+// Healthz reports that the process is up and serving requests.
+func (ww *web) Healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintln(w, "ok")
+}
+
+// Readyz reports whether fconf can do its job, that is the asterisk
+// configuration can be reached and, with autodetect on, the modems are being
+// watched.
+func (ww *web) Readyz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	err := checkAccess(ww.cfg.AsteriskConfig)
+	if err == nil && ww.cfg.Autodetect {
+		err = ww.checkMonitor()
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, err)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// Diagnostics serves a report of everything that is broken on the box. The
+// report is json unless the query has format=text, which gives one line per
+// check for reading from a terminal.
+func (ww *web) Diagnostics(w http.ResponseWriter, r *http.Request) {
+	rep := ww.diagnose()
+	if r.URL.Query().Get("format") == "text" {
+		w.Header().Set("Content-Type", "text/plain")
+		for _, c := range rep.Checks {
+			status := "OK  "
+			if !c.OK {
+				status = "FAIL"
+			}
+			fmt.Fprintf(w, "%s %s", status, c.Name)
+			if c.Detail != "" {
+				fmt.Fprintf(w, ": %s", c.Detail)
+			}
+			fmt.Fprintln(w)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(rep)
+}
+
+func (ww *web) diagnose() *report {
+	rep := &report{Time: time.Now()}
+	rep.Checks = append(rep.Checks, newCheck("asterisk config dir "+ww.cfg.AsteriskConfig, checkDir(ww.cfg.AsteriskConfig)))
+	for _, name := range ww.files.List() {
+		rep.Checks = append(rep.Checks, newCheck("parse "+name, ww.files.Check(name)))
+	}
+	if ww.cfg.Autodetect {
+		rep.Checks = append(rep.Checks, newCheck("udev monitor", ww.checkMonitor()))
+	}
+	if ww.manager != nil {
+		rep.Checks = append(rep.Checks, ww.checkModems()...)
+		var stale error
+		if links := device.StaleSymlinks(); len(links) > 0 {
+			stale = fmt.Errorf("%v point to missing ttys", links)
+		}
+		rep.Checks = append(rep.Checks, newCheck("stale symlinks in /dev", stale))
+	}
+	rep.OK = true
+	for _, c := range rep.Checks {
+		rep.OK = rep.OK && c.OK
+	}
+	return rep
+}
+
+// checkModems checks every modem at once since a modem that does not answer
+// takes a while to time out.
+func (ww *web) checkModems() []check {
+	modems := ww.manager.Modems()
+	checks := make([]check, 2*len(modems))
+	var wg sync.WaitGroup
+	for i, m := range modems {
+		wg.Add(1)
+		go func(i int, m device.Modem) {
+			defer wg.Done()
+			checks[2*i] = newCheck(fmt.Sprintf("modem %s on %s answers AT", m.IMEI, m.Path), ww.manager.Ping(m.IMEI))
+			checks[2*i+1] = newCheck(fmt.Sprintf("modem %s symlinks", m.IMEI), m.CheckSymlinks())
+		}(i, m)
+	}
+	wg.Wait()
+	return checks
+}
+
+func (ww *web) checkMonitor() error {
+	if ww.manager == nil {
+		return fmt.Errorf("autodetect is on but the device manager is not running")
+	}
+	if !ww.manager.MonitorAlive() {
+		return fmt.Errorf("udev monitor last seen at %s", ww.manager.LastBeat().Format(time.RFC3339))
+	}
+	return nil
+}
+
+// accessWrite and accessSearch are W_OK and X_OK of access(2), which syscall
+// has no names for.
+const (
+	accessWrite  = 0x2
+	accessSearch = 0x1
+)
+
+// checkAccess makes sure dir is a directory the files can be written in,
+// without writing anything so it is cheap enough for every probe.
+func checkAccess(dir string) error {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	err = syscall.Access(dir, accessWrite|accessSearch)
+	if err != nil {
+		return &os.PathError{Op: "access", Path: dir, Err: err}
+	}
+	return nil
+}
+
+// checkDir makes sure dir can be listed and written to.
+func checkDir(dir string) error {
+	_, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, ".fconf-check")
+	if err != nil {
+		return err
+	}
+	_ = f.Close()
+	return os.Remove(f.Name())
+}
@@ -0,0 +1,307 @@
+// Package history keeps the signal and the network registration of the modems
+// over time.
+//
+// Samples are stored one json object per line in a file per day, named after
+// the day in UTC like 2026-10-19.log. Retention is done by deleting the files
+// of the days that are too old, the files are otherwise never rewritten.
+package history
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dayLayout names the file of each day.
+const dayLayout = "2006-01-02"
+
+// Sample is the state of a modem at one point in time. Signal is the rssi of
+// AT+CSQ, from 0 to 31 or 99 when unknown, and the registrations are the
+// statuses of AT+CREG? and AT+CGREG?. All are -1 when the modem did not
+// answer.
+type Sample struct {
+	Time             time.Time `json:"time"`
+	IMEI             string    `json:"imei"`
+	Signal           int       `json:"signal"`
+	DBM              *int      `json:"dbm,omitempty"`
+	Registration     int       `json:"registration"`
+	GPRSRegistration int       `json:"gprs_registration"`
+}
+
+// Registered returns true if the modem was registered to its home network or
+// roaming.
+func (s *Sample) Registered() bool {
+	return s.Registration == 1 || s.Registration == 5
+}
+
+// Store is the history of the modems backed by a directory.
+//
+// It is safe to use in multiple goroutines.
+type Store struct {
+	dir       string
+	retention time.Duration
+
+	mu  sync.Mutex
+	day string
+	f   *os.File
+}
+
+// Open opens the history in dir, creating the directory if it does not exist.
+// The samples older than retention are deleted as the days go by.
+func Open(dir string, retention time.Duration) (*Store, error) {
+	if retention <= 0 {
+		return nil, errors.New("history: retention must be positive")
+	}
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	s := &Store{dir: dir, retention: retention}
+	return s, s.Prune(time.Now())
+}
+
+// Record appends the sample to the history. The time is set to now if it is
+// missing.
+func (s *Store) Record(v Sample) error {
+	if v.Time.IsZero() {
+		v.Time = time.Now()
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	day := v.Time.UTC().Format(dayLayout)
+	if day != s.day || s.f == nil {
+		if day > s.day {
+			// a new day, the oldest one may have expired
+			_ = s.prune(v.Time)
+		}
+		err = s.open(day)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = s.f.Write(b)
+	return err
+}
+
+// open makes the file of day the one written to, s.mu must be held.
+func (s *Store) open(day string) error {
+	if s.f != nil {
+		_ = s.f.Close()
+		s.f = nil
+	}
+	f, err := os.OpenFile(filepath.Join(s.dir, day+".log"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	s.day, s.f = day, f
+	return nil
+}
+
+// Prune deletes the days that ended more than the retention before now.
+func (s *Store) Prune(now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.prune(now)
+}
+
+func (s *Store) prune(now time.Time) error {
+	days, err := s.days()
+	if err != nil {
+		return err
+	}
+	oldest := now.Add(-s.retention).UTC().Format(dayLayout)
+	for _, day := range days {
+		if day >= oldest {
+			break
+		}
+		if day == s.day && s.f != nil {
+			_ = s.f.Close()
+			s.f, s.day = nil, ""
+		}
+		err = os.Remove(filepath.Join(s.dir, day+".log"))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// days returns the days in the history, oldest first.
+func (s *Store) days() ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(s.dir, "*.log"))
+	if err != nil {
+		return nil, err
+	}
+	var days []string
+	for _, f := range files {
+		day := strings.TrimSuffix(filepath.Base(f), ".log")
+		if _, err := time.Parse(dayLayout, day); err == nil {
+			days = append(days, day)
+		}
+	}
+	sort.Strings(days)
+	return days, nil
+}
+
+// Query returns the samples of the modem with the imei taken from from to to,
+// both included, oldest first.
+func (s *Store) Query(imei string, from, to time.Time) ([]Sample, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	days, err := s.days()
+	if err != nil {
+		return nil, err
+	}
+	first, last := from.UTC().Format(dayLayout), to.UTC().Format(dayLayout)
+	var list []Sample
+	for _, day := range days {
+		if day < first || day > last {
+			continue
+		}
+		list, err = readDay(filepath.Join(s.dir, day+".log"), list, func(v *Sample) bool {
+			return v.IMEI == imei && !v.Time.Before(from) && !v.Time.After(to)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.SliceStable(list, func(i, j int) bool { return list[i].Time.Before(list[j].Time) })
+	return list, nil
+}
+
+// readDay appends the samples of the file matching keep to list. Lines that
+// can not be read, like the last one after a crash, are skipped.
+func readDay(path string, list []Sample, keep func(*Sample) bool) ([]Sample, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return list, nil
+		}
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var v Sample
+		if err := json.Unmarshal(sc.Bytes(), &v); err != nil {
+			continue
+		}
+		if keep(&v) {
+			list = append(list, v)
+		}
+	}
+	return list, sc.Err()
+}
+
+// Close closes the file of the current day.
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Close()
+	s.f, s.day = nil, ""
+	return err
+}
+
+// Stat is the minimum, average and maximum of the values in a Point.
+type Stat struct {
+	Min float64 `json:"min"`
+	Avg float64 `json:"avg"`
+	Max float64 `json:"max"`
+}
+
+// Point sums up the samples taken during a step.
+type Point struct {
+	// Time is the start of the step.
+	Time    time.Time `json:"time"`
+	Samples int       `json:"samples"`
+
+	// Signal is the rssi and DBM the signal in dBm, they are missing when the
+	// signal was never known during the step.
+	Signal *Stat `json:"signal,omitempty"`
+	DBM    *Stat `json:"dbm,omitempty"`
+
+	// Registered is the share of the samples where the modem was registered,
+	// from 0 to 1.
+	Registered float64 `json:"registered"`
+}
+
+// Downsample sums up the samples, sorted by time, in steps starting at from.
+// The steps without samples are left out so gaps show where the modem was
+// gone. A step of zero gives a point per sample.
+func Downsample(samples []Sample, from time.Time, step time.Duration) []Point {
+	var points []Point
+	var signal, dbm, registered []float64
+	flush := func() {
+		p := &points[len(points)-1]
+		p.Signal, p.DBM = stat(signal), stat(dbm)
+		if p.Samples > 0 {
+			p.Registered = sum(registered) / float64(p.Samples)
+		}
+		signal, dbm, registered = signal[:0], dbm[:0], registered[:0]
+	}
+	for _, v := range samples {
+		start := v.Time
+		if step > 0 {
+			start = from.Add(v.Time.Sub(from) / step * step)
+		}
+		if len(points) == 0 || step == 0 || !points[len(points)-1].Time.Equal(start) {
+			if len(points) > 0 {
+				flush()
+			}
+			points = append(points, Point{Time: start})
+		}
+		points[len(points)-1].Samples++
+		if v.Signal >= 0 && v.Signal <= 31 {
+			signal = append(signal, float64(v.Signal))
+		}
+		if v.DBM != nil {
+			dbm = append(dbm, float64(*v.DBM))
+		}
+		if v.Registered() {
+			registered = append(registered, 1)
+		}
+	}
+	if len(points) > 0 {
+		flush()
+	}
+	return points
+}
+
+func stat(values []float64) *Stat {
+	if len(values) == 0 {
+		return nil
+	}
+	s := &Stat{Min: values[0], Max: values[0]}
+	for _, v := range values {
+		if v < s.Min {
+			s.Min = v
+		}
+		if v > s.Max {
+			s.Max = v
+		}
+	}
+	s.Avg = sum(values) / float64(len(values))
+	return s
+}
+
+func sum(values []float64) float64 {
+	var n float64
+	for _, v := range values {
+		n += v
+	}
+	return n
+}
@@ -0,0 +1,88 @@
+package history
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fconf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	s, err := Open(dir, 48*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = s.Close() }()
+	day := time.Date(2026, 10, 17, 23, 0, 0, 0, time.UTC)
+	for i := 0; i < 4; i++ {
+		for _, imei := range []string{"356789012345678", "354369047238739"} {
+			err = s.Record(Sample{Time: day.Add(time.Duration(i) * time.Hour), IMEI: imei, Signal: 10 + i, Registration: 1})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	list, err := s.Query("356789012345678", day, day.Add(2*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 3 || list[0].Signal != 10 || list[2].Signal != 12 {
+		t.Errorf("expected three samples over two days got %+v", list)
+	}
+
+	err = s.Prune(day.Add(72 * time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "2026-10-17.log")); !os.IsNotExist(err) {
+		t.Error("expected the oldest day to be removed")
+	}
+	list, _ = s.Query("356789012345678", day, day.Add(4*time.Hour))
+	if len(list) != 3 {
+		t.Errorf("expected the samples of the next day to be kept got %+v", list)
+	}
+	err = s.Record(Sample{Time: day.Add(4 * time.Hour), IMEI: "356789012345678", Signal: 99, Registration: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list, _ = s.Query("356789012345678", day, day.Add(4*time.Hour)); len(list) != 4 {
+		t.Errorf("expected writing after the prune to work got %+v", list)
+	}
+}
+
+func TestDownsample(t *testing.T) {
+	from := time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC)
+	dbm := func(n int) *int { return &n }
+	samples := []Sample{
+		{Time: from.Add(1 * time.Minute), Signal: 10, DBM: dbm(-93), Registration: 1},
+		{Time: from.Add(4 * time.Minute), Signal: 20, DBM: dbm(-73), Registration: 5},
+		{Time: from.Add(9 * time.Minute), Signal: 99, Registration: 2},
+		{Time: from.Add(20 * time.Minute), Signal: 18, DBM: dbm(-77), Registration: 1},
+	}
+	points := Downsample(samples, from, 5*time.Minute)
+	if len(points) != 3 {
+		t.Fatalf("expected 3 points got %+v", points)
+	}
+	p := points[0]
+	if !p.Time.Equal(from) || p.Samples != 2 || *p.Signal != (Stat{Min: 10, Avg: 15, Max: 20}) || p.Registered != 1 {
+		t.Errorf("unexpected first point %+v", p)
+	}
+	if *p.DBM != (Stat{Min: -93, Avg: -83, Max: -73}) {
+		t.Errorf("unexpected dBm %+v", *p.DBM)
+	}
+	if p := points[1]; !p.Time.Equal(from.Add(5*time.Minute)) || p.Signal != nil || p.Registered != 0 {
+		t.Errorf("expected a point without signal got %+v", p)
+	}
+	if p := points[2]; !p.Time.Equal(from.Add(20 * time.Minute)) {
+		t.Errorf("expected the gap to be left out got %+v", p)
+	}
+	if points := Downsample(samples, from, 0); len(points) != 4 {
+		t.Errorf("expected a point per sample got %+v", points)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/FarmRadioHangar/fessboxconfig/systemd"
+)
+
+// listeners opens the tcp listener on Host and Port, and the unix socket when
+// it is configured. When fconf is socket activated by systemd the passed
+// sockets are used instead.
+func listeners(cfg *Config) ([]net.Listener, error) {
+	if len(systemd.Files()) > 0 {
+		return systemd.Listeners()
+	}
+	addr := net.JoinHostPort(cfg.Host, strconv.FormatInt(cfg.Port, 10))
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	ls := []net.Listener{l}
+	if cfg.UnixSocket != "" {
+		u, err := listenUnix(cfg.UnixSocket)
+		if err != nil {
+			_ = l.Close()
+			return nil, err
+		}
+		ls = append(ls, u)
+	}
+	return ls, nil
+}
+
+// listenUnix listens on the unix socket path. A stale socket left behind by a
+// previous run is removed first.
+func listenUnix(path string) (net.Listener, error) {
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		_ = os.Remove(path)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	err = os.Chmod(path, 0660)
+	if err != nil {
+		_ = l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// serveListener serves s on l. The tcp listeners use TLS when a certificate is
+// configured, unix sockets are always plain http since they never leave the box.
+func serveListener(cfg *Config, s *http.Server, l net.Listener) error {
+	if l.Addr().Network() == "unix" {
+		log.Printf(" starting server on  unix:%s\n", l.Addr())
+		return s.Serve(l)
+	}
+	if cfg.TLSCert != "" {
+		log.Printf(" starting server on  https://%s\n", l.Addr())
+		return s.ServeTLS(l, cfg.TLSCert, cfg.TLSKey)
+	}
+	log.Printf(" starting server on  http://%s\n", l.Addr())
+	return s.Serve(l)
+}
+
+// ensureCert makes sure the certificate and key files configured for TLS exist.
+// If both are missing a self signed certificate is generated for the host name
+// of the box.
+func ensureCert(cfg *Config) error {
+	if cfg.TLSCert == "" && cfg.TLSKey == "" {
+		return nil
+	}
+	if cfg.TLSCert == "" || cfg.TLSKey == "" {
+		return fmt.Errorf("both tls_cert and tls_key are needed for https")
+	}
+	_, certErr := os.Stat(cfg.TLSCert)
+	_, keyErr := os.Stat(cfg.TLSKey)
+	switch {
+	case certErr == nil && keyErr == nil:
+		return nil
+	case os.IsNotExist(certErr) && os.IsNotExist(keyErr):
+		log.Printf("generating self signed certificate %s\n", cfg.TLSCert)
+		return selfSignedCert(cfg.TLSCert, cfg.TLSKey, cfg.Host)
+	case certErr != nil:
+		return certErr
+	}
+	return keyErr
+}
+
+// selfSignedCert writes a new self signed certificate and its private key to
+// certFile and keyFile. The certificate is valid for localhost, the host name
+// of the box and host.
+func selfSignedCert(certFile, keyFile, host string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	name, _ := os.Hostname()
+	tpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"fconf"}, CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("::1")},
+	}
+	for _, h := range []string{name, host} {
+		if h == "" {
+			continue
+		}
+		if ip := net.ParseIP(h); ip != nil {
+			tpl.IPAddresses = append(tpl.IPAddresses, ip)
+			continue
+		}
+		tpl.DNSNames = append(tpl.DNSNames, h)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	err = writePEM(keyFile, "EC PRIVATE KEY", keyDer, 0600)
+	if err != nil {
+		return err
+	}
+	return writePEM(certFile, "CERTIFICATE", der, 0644)
+}
+
+func writePEM(path, typ string, der []byte, mode os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	err = pem.Encode(f, &pem.Block{Type: typ, Bytes: der})
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -3,19 +3,30 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"flag"
-	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"sort"
+	"sync"
 	"syscall"
+	"time"
 
+	"github.com/FarmRadioHangar/fessboxconfig/ami"
+	"github.com/FarmRadioHangar/fessboxconfig/asterisk"
+	"github.com/FarmRadioHangar/fessboxconfig/audit"
+	"github.com/FarmRadioHangar/fessboxconfig/auth"
+	"github.com/FarmRadioHangar/fessboxconfig/balance"
 	"github.com/FarmRadioHangar/fessboxconfig/device"
+	"github.com/FarmRadioHangar/fessboxconfig/history"
 	"github.com/FarmRadioHangar/fessboxconfig/parser"
+	"github.com/FarmRadioHangar/fessboxconfig/systemd"
 	"github.com/gernest/hot"
 	"github.com/gorilla/mux"
 )
@@ -28,70 +39,240 @@ type Config struct {
 	TemplatesDir   string `json:"templates_dir"`
 	AsteriskConfig string `json:"asterisk_config_dir"`
 	Autodetect     bool   `json:"autodetect"`
+
+	// ReloadCommand is the shell command that is run after a configuration
+	// file is written or a changeset is committed. Nothing is run when it is
+	// empty.
+	ReloadCommand string `json:"reload_command"`
+
+	// ManagedFiles are the files in AsteriskConfig that can be accessed through
+	// the API, and ReadOnlyFiles are the ones among them that can not be
+	// changed.
+	ManagedFiles  []string `json:"managed_files"`
+	ReadOnlyFiles []string `json:"read_only_files"`
+
+	// UsersFile is the json file with the users who can log into the API.
+	UsersFile string `json:"users_file"`
+
+	// AuditLog is the file where changes to the configuration and devices are
+	// recorded.
+	AuditLog string `json:"audit_log"`
+
+	// TLSCert and TLSKey are the certificate and private key used to serve
+	// https. A self signed pair is generated when both files are missing.
+	TLSCert string `json:"tls_cert"`
+	TLSKey  string `json:"tls_key"`
+
+	// UnixSocket is an optional path to a unix socket to also listen on.
+	UnixSocket string `json:"unix_socket"`
+
+	// AMIAddress is the host:port of the asterisk manager interface. When it
+	// is set chan_dongle is reloaded over AMI after every successful write
+	// instead of running ReloadCommand.
+	AMIAddress  string `json:"ami_address"`
+	AMIUsername string `json:"ami_username"`
+	AMISecret   string `json:"ami_secret"`
+
+	// ReloadWhen is when chan_dongle restarts the devices after a reload, one
+	// of "now", "gracefully" or "when convenient". It can be overridden with
+	// the reload query parameter of the write requests.
+	ReloadWhen string `json:"reload_when"`
+
+	// VerifyTimeout is how many seconds the devices changed by a write are
+	// given to come back over AMI before the write is rolled back. Zero turns
+	// the check off.
+	VerifyTimeout int64 `json:"verify_timeout"`
+
+	// AdoptPattern names the dongle.conf sections created for new modems,
+	// {imei}, {imsi} and {n} are replaced by the identities of the modem and
+	// the lowest free number. AdoptContext and AdoptGroup are set in the new
+	// sections when they are not empty.
+	AdoptPattern string `json:"adopt_pattern"`
+	AdoptContext string `json:"adopt_context"`
+	AdoptGroup   string `json:"adopt_group"`
+
+	// AutoAdopt creates the section as soon as a modem without one is plugged
+	// in.
+	AutoAdopt bool `json:"auto_adopt"`
+
+	// ModemRefresh is how many seconds apart the signal, the registration
+	// and the SIM state of the modems are queried.
+	ModemRefresh int64 `json:"modem_refresh"`
+
+	// HistoryDir is where the signal and registration of the modems are
+	// kept, sampled every ModemRefresh seconds. HistoryRetention is how many
+	// days of samples are kept. An empty HistoryDir turns the history off.
+	HistoryDir       string `json:"history_dir"`
+	HistoryRetention int64  `json:"history_retention"`
+
+	// BalanceChecks are the USSD codes checking the airtime of the SIMs of
+	// each operator, picked by the start of the IMSI. The checks run every
+	// BalanceInterval hours and the balances are kept in BalanceLog, an
+	// empty BalanceLog only keeps the last one of each modem in memory.
+	BalanceChecks   []balance.Check `json:"balance_checks"`
+	BalanceInterval int64           `json:"balance_interval"`
+	BalanceLog      string          `json:"balance_log"`
+
+	// MetricsToken lets a scraper read /metrics with it as a bearer token
+	// instead of the password of a viewer, which is slow to check on every
+	// scrape. Empty, only viewers can read the metrics.
+	MetricsToken string `json:"metrics_token"`
+
+	// VirtualModems are the emulated modems created in dev mode, each one is
+	// given as IMEI:IMSI. Two modems are made up when the list is empty.
+	VirtualModems []string `json:"virtual_modems"`
 }
 
+// defaultConfig returns the built in settings, they are overridden by the
+// configuration file, the environment and the command line.
 func defaultConfig() *Config {
 	return &Config{
-		Port:           8080,
-		Host:           "",
-		StaticDir:      "static",
-		TemplatesDir:   "templates",
-		AsteriskConfig: "/etc/asterisk",
-		Autodetect:     true,
+		Port:             8080,
+		Host:             "",
+		StaticDir:        "static",
+		TemplatesDir:     "templates",
+		AsteriskConfig:   "/etc/asterisk",
+		Autodetect:       true,
+		ReloadCommand:    `asterisk -rx "core reload"`,
+		ManagedFiles:     []string{"dongle.conf", "extensions.conf"},
+		ReadOnlyFiles:    []string{},
+		UsersFile:        "/etc/fconf/users.json",
+		AuditLog:         "/var/log/fconf-audit.log",
+		ReloadWhen:       ami.WhenConvenient,
+		VerifyTimeout:    60,
+		AdoptPattern:     asterisk.DefaultPattern,
+		ModemRefresh:     60,
+		HistoryDir:       "/var/lib/fconf/history",
+		HistoryRetention: 30,
+		BalanceInterval:  24,
+		BalanceLog:       "/var/lib/fconf/balance.log",
 	}
 }
 
 func main() {
 	c := flag.String("c", "etc/fconf.json", "path to the configuration file")
 	dev := flag.Bool("dev", false, "set true if running in dev mode")
+	loader := &configLoader{}
+	loader.registerFlags(flag.CommandLine)
 	flag.Parse()
-	b, err := ioutil.ReadFile(*c)
+	loader.path = *c
+	flag.Visit(func(f *flag.Flag) {
+		loader.required = loader.required || f.Name == "c"
+	})
+	cfg, src, err := loader.load()
 	if err != nil {
 		log.Fatal(err)
 	}
-	cfg := &Config{}
-	err = json.Unmarshal(b, cfg)
+	if isCommand(flag.Arg(0)) {
+		err = runCommand(cfg, src, flag.Args())
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	users, err := auth.Open(cfg.UsersFile)
 	if err != nil {
 		log.Fatal(err)
 	}
-	var manager *device.Manager
-	if cfg.Autodetect {
-		manager = device.New()
-		manager.Init()
+	if users.Len() == 0 {
+		log.Printf("no users in %s, add one with: fconf -c %s user add NAME admin\n", cfg.UsersFile, *c)
 	}
+	var tmp string
 	if *dev {
-		cfg.AsteriskConfig = "sample"
-		tmp, err := ioutil.TempDir("", "fconf")
+		tmp, err = ioutil.TempDir("", "fconf")
 		if err != nil {
 			log.Fatal(err)
 		}
-		c := make(chan os.Signal, 1)
-		signal.Notify(c, syscall.SIGTERM, syscall.SIGINT)
-		go func(dir string) {
-		END:
-			for {
-				select {
-				case <-c:
-					log.Println("removing ", dir)
-					_ = os.RemoveAll(dir)
-					if cfg.Autodetect {
-						manager.Close()
-					}
-					os.Exit(0)
-					break END
-				}
-			}
-		}(tmp)
-		cfg.AsteriskConfig = tmp
 		err = copyFiles(tmp, "sample")
 		if err != nil {
 			log.Fatal(err)
 		}
+		devConfig(cfg, tmp)
+	}
+	auditLog, err := audit.Open(cfg.AuditLog)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var hist *history.Store
+	if cfg.HistoryDir != "" {
+		hist, err = history.Open(cfg.HistoryDir, time.Duration(cfg.HistoryRetention)*24*time.Hour)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	var bal *balance.Store
+	if cfg.BalanceLog != "" {
+		bal, err = balance.Open(cfg.BalanceLog)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	a := newApp(loader, tmp, users, auditLog, hist, bal)
+	err = a.start(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	notify(systemd.Ready)
+	var watchdog <-chan time.Time
+	if d, ok := systemd.WatchdogInterval(); ok {
+		t := time.NewTicker(d)
+		defer t.Stop()
+		watchdog = t.C
+	}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP, syscall.SIGTERM, syscall.SIGINT)
+	for {
+		select {
+		case <-watchdog:
+			a.watchdog()
+		case s := <-sig:
+			if s == syscall.SIGHUP {
+				log.Println("reloading ", *c)
+				notify(systemd.Reloading)
+				err = a.reload()
+				if err != nil {
+					log.Println(err)
+				}
+				notify(systemd.Ready)
+				continue
+			}
+			log.Println("shutting down")
+			notify(systemd.Stopping)
+			a.shutdown()
+			if tmp != "" {
+				log.Println("removing ", tmp)
+				_ = os.RemoveAll(tmp)
+			}
+			return
+		case err := <-a.errs:
+			a.shutdown()
+			log.Fatal(err)
+		}
+	}
+}
+
+// devConfig points every file fconf writes into the temporary directory dir,
+// which holds a copy of the sample configuration files.
+//
+// There is usually no asterisk to reload in development so the reload command
+// is dropped, AMI is kept to allow testing against a fake manager interface.
+func devConfig(cfg *Config, dir string) {
+	cfg.AsteriskConfig = dir
+	cfg.ReloadCommand = ""
+	cfg.AuditLog = filepath.Join(dir, "audit.log")
+	if cfg.HistoryDir != "" {
+		cfg.HistoryDir = filepath.Join(dir, "history")
+	}
+	if cfg.BalanceLog != "" {
+		cfg.BalanceLog = filepath.Join(dir, "balance.log")
+	}
+	if cfg.TLSCert != "" {
+		cfg.TLSCert = filepath.Join(dir, "cert.pem")
+		cfg.TLSKey = filepath.Join(dir, "key.pem")
+	}
+	if cfg.UnixSocket != "" {
+		cfg.UnixSocket = filepath.Join(dir, "fconf.sock")
 	}
-	s := newServer(cfg)
-	s.HandleFunc("/serial/list", manager.List).Methods("GET")
-	log.Printf(" starting server on  localhost:%d\n", cfg.Port)
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", cfg.Port), s))
 }
 
 //copyFiles copies files from src to dst, directories are ignored
@@ -119,11 +300,54 @@ func copyFiles(dst, src string) error {
 
 //newServer returns a http.Handler with all the routes for configuring supported
 //devices registered.
-func newServer(c *Config) *mux.Router {
+//
+// Every route except the home page, login and the health checks requires a
+// user from users with the role needed for the route.
+func newServer(c *Config, users *auth.Store, auditLog *audit.Log, hist *history.Store, bal *balances, manager *device.Manager, st *stats) *mux.Router {
 	s := mux.NewRouter()
-	w := newWeb(c)
-	s.HandleFunc("/config/{filename}", w.Dongle).Methods("GET")
-	s.HandleFunc("/config/{filename}", w.UpdateDongle).Methods("POST")
+	s.Use(st.instrument)
+	w := newWeb(c, auditLog)
+	w.history = hist
+	w.balances = bal
+	w.manager = manager
+	w.stats = st
+	viewer := func(h http.HandlerFunc) http.HandlerFunc { return users.Require(auth.Viewer, h) }
+	operator := func(h http.HandlerFunc) http.HandlerFunc { return users.Require(auth.Operator, h) }
+	admin := func(h http.HandlerFunc) http.HandlerFunc { return users.Require(auth.Admin, h) }
+	s.HandleFunc("/healthz", w.Healthz).Methods("GET")
+	s.HandleFunc("/readyz", w.Readyz).Methods("GET")
+	s.HandleFunc("/diagnostics", viewer(w.Diagnostics)).Methods("GET")
+	s.HandleFunc("/metrics", withToken(c.MetricsToken, st.reg.ServeHTTP, viewer(st.reg.ServeHTTP))).Methods("GET")
+	s.HandleFunc("/serial/list", viewer(w.SerialList)).Methods("GET")
+	s.HandleFunc("/serial/updates", viewer(w.SerialUpdates)).Methods("GET")
+	s.HandleFunc("/serial/{imei}", viewer(w.SerialModem)).Methods("GET")
+	s.HandleFunc("/serial/{imei}/at", admin(w.SerialCommand)).Methods("POST")
+	s.HandleFunc("/serial/{imei}/history", viewer(w.SerialHistory)).Methods("GET")
+	s.HandleFunc("/serial/{imei}/balance", viewer(w.Balance)).Methods("GET")
+	s.HandleFunc("/serial/{imei}/balance", operator(w.CheckBalance)).Methods("POST")
+	s.HandleFunc("/serial/{imei}/sms", operator(w.Inbox)).Methods("GET")
+	s.HandleFunc("/serial/{imei}/sms", operator(w.SendSMS)).Methods("POST")
+	s.HandleFunc("/serial/{imei}/sms/{index}", operator(w.ReadSMS)).Methods("GET")
+	s.HandleFunc("/serial/{imei}/sms/{index}", operator(w.DeleteSMS)).Methods("DELETE")
+	s.HandleFunc("/serial/{imei}/ussd", operator(w.USSD)).Methods("POST")
+	s.HandleFunc("/serial/{imei}/ussd/ws", operator(w.USSDSocket)).Methods("GET")
+	s.HandleFunc("/login", users.LoginHandler).Methods("POST")
+	s.HandleFunc("/logout", users.LogoutHandler).Methods("POST")
+	s.HandleFunc("/users", admin(users.UsersHandler)).Methods("GET")
+	s.HandleFunc("/users", admin(users.AddUserHandler)).Methods("POST")
+	s.HandleFunc("/users/{name}", admin(removeUser(users))).Methods("DELETE")
+	s.HandleFunc("/audit", viewer(auditLog.Handler)).Methods("GET")
+	s.HandleFunc("/config/dongle/reconcile", viewer(w.Reconcile)).Methods("GET")
+	s.HandleFunc("/config/dongle/reconcile", operator(w.ApplyReconcile)).Methods("POST")
+	s.HandleFunc("/config/{filename}", viewer(w.Dongle)).Methods("GET")
+	s.HandleFunc("/config/dongle/adopt/{imei}", operator(w.AdoptModem)).Methods("POST")
+	s.HandleFunc("/config/{filename}", operator(w.UpdateDongle)).Methods("POST")
+	s.HandleFunc("/changeset", operator(w.NewChangeset)).Methods("POST")
+	s.HandleFunc("/changeset/{id}", operator(w.Changeset)).Methods("GET")
+	s.HandleFunc("/changeset/{id}", operator(w.DiscardChangeset)).Methods("DELETE")
+	s.HandleFunc("/changeset/{id}/validate", operator(w.ValidateChangeset)).Methods("POST")
+	s.HandleFunc("/changeset/{id}/commit", operator(w.CommitChangeset)).Methods("POST")
+	s.HandleFunc("/changeset/{id}/{filename}", operator(w.StageChangeset)).Methods("POST")
 	//s.PathPrefix("/static/").
 	//Handler(http.StripPrefix("/static/", http.FileServer(http.Dir(c.StaticDir))))
 	s.HandleFunc("/", w.Home)
@@ -140,14 +364,33 @@ func newServer(c *Config) *mux.Router {
 // application process. The auto reloading of templates is disabled in
 // production.
 type web struct {
-	cfg *Config
-	tpl *hot.Template
+	cfg      *Config
+	tpl      *hot.Template
+	files    *asterisk.Files
+	audit    *audit.Log
+	history  *history.Store
+	balances *balances
+	manager  *device.Manager
+	stats    *stats
+
+	mu      sync.Mutex
+	changes map[string]*asterisk.Changeset
+	dongles dongleCache
 }
 
 //newWeb intialises and returns a new instance of *web, the templates are loaded
 //and if dev mode is set to true then auto reload is enabled.
-func newWeb(cfg *Config) *web {
-	return &web{cfg: cfg}
+func newWeb(cfg *Config, auditLog *audit.Log) *web {
+	return &web{
+		cfg:   cfg,
+		audit: auditLog,
+		files: &asterisk.Files{
+			Dir:      cfg.AsteriskConfig,
+			Managed:  cfg.ManagedFiles,
+			ReadOnly: cfg.ReadOnlyFiles,
+		},
+		changes: make(map[string]*asterisk.Changeset),
+	}
 }
 
 //Home serves the home page
@@ -166,9 +409,13 @@ type errMSG struct {
 func (ww *web) Dongle(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	file := vars["filename"] + ".conf"
-	fName := filepath.Join(ww.cfg.AsteriskConfig, file)
 	enc := json.NewEncoder(w)
 	w.Header().Set("Content-Type", "application/json")
+	fName, err := ww.files.Path(file)
+	if err != nil {
+		writeFileError(w, err)
+		return
+	}
 
 	f, err := os.Open(fName)
 	if err != nil {
@@ -180,12 +427,14 @@ func (ww *web) Dongle(w http.ResponseWriter, r *http.Request) {
 	p, err := parser.NewParser(f)
 	if err != nil {
 		log.Println(err)
+		ww.parseError(file)
 		_ = enc.Encode(&errMSG{"trouble scanning dongle configuration"})
 		return
 	}
 	ast, err := p.Parse()
 	if err != nil {
 		log.Println(err)
+		ww.parseError(file)
 		_ = enc.Encode(&errMSG{"trouble parsing dongle configuration"})
 		return
 	}
@@ -195,19 +444,30 @@ func (ww *web) Dongle(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-//UpdateDongle updates the dongle documentation file, via a json object. This
-//doesnot do verification of the object sent with the request.
-//
-// The received json is loaded into ast and writen to the dongle configuration
-// file directly.
+//UpdateDongle updates the dongle documentation file, via a json object.
 //
-// TODO(gernest) do some kind of verification?
+// The received json is loaded into ast, checked like a changeset and written
+// to the dongle configuration file. Asterisk is then reloaded and the changed
+// devices are watched, the previous file is put back if they do not come back.
+// The response is the report of the apply.
 func (ww *web) UpdateDongle(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
+	vars := mux.Vars(r)
+	file := vars["filename"] + ".conf"
+	fName, err := ww.writable(r, file)
+	if err != nil {
+		writeFileError(w, err)
+		return
+	}
+	reloader, err := ww.reloader(r, []string{file})
+	if err != nil {
+		writeFileError(w, err)
+		return
+	}
 	ast := &parser.Ast{}
 	src := &bytes.Buffer{}
 	enc := json.NewEncoder(w)
-	_, err := io.Copy(src, r.Body)
+	_, err = io.Copy(src, r.Body)
 	if err != nil {
 		_ = enc.Encode(&errMSG{Message: "trouble reading request body"})
 		return
@@ -217,17 +477,333 @@ func (ww *web) UpdateDongle(w http.ResponseWriter, r *http.Request) {
 		_ = enc.Encode(&errMSG{Message: "trouble loading request body"})
 		return
 	}
-	vars := mux.Vars(r)
-	file := vars["filename"] + ".conf"
-	fName := filepath.Join(ww.cfg.AsteriskConfig, file)
-	info, err := os.Stat(fName)
+	defer asterisk.Lock(ww.cfg.AsteriskConfig)()
+	before, err := ioutil.ReadFile(fName)
 	if err != nil {
 		log.Println(err)
 		_ = enc.Encode(&errMSG{"trouble opening dongle configuration"})
 		return
 	}
-	dst := &bytes.Buffer{}
-	parser.PrintAst(dst, ast)
-	_ = ioutil.WriteFile(fName, dst.Bytes(), info.Mode())
-	_, _ = io.Copy(w, src)
+	c := asterisk.NewChangeset(ww.cfg.AsteriskConfig)
+	err = c.Stage(file, ast)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = enc.Encode(&errMSG{err.Error()})
+		return
+	}
+	report, err := c.Apply(reloader, ww.verifier())
+	after, _ := c.Staged(file)
+	ww.record(r, audit.ConfigWrite, file, before, after, err)
+	writeApplyResult(w, report, err)
+}
+
+// record adds a change to a configuration file made by the request r to the
+// audit log.
+func (ww *web) record(r *http.Request, action, file string, before, after []byte, err error) {
+	if ww.stats != nil {
+		ww.stats.write(file, err)
+	}
+	e := audit.Entry{Action: action, Target: file}
+	e.Before, e.After = asterisk.Diff(before, after)
+	ww.recordEntry(r, e, err)
+}
+
+// recordEntry adds e to the audit log with the user and the address of the
+// request r.
+func (ww *web) recordEntry(r *http.Request, e audit.Entry, err error) {
+	if ww.audit == nil {
+		return
+	}
+	e.Source = remoteIP(r)
+	if u, ok := auth.UserFrom(r); ok {
+		e.User = u.Name
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	if err := ww.audit.Record(e); err != nil {
+		log.Println(err)
+	}
+}
+
+// parseError counts a configuration file that could not be parsed.
+func (ww *web) parseError(file string) {
+	if ww.stats != nil {
+		ww.stats.parseErrors.With(file).Inc()
+	}
+}
+
+// remoteIP returns the ip address of the client that sent r.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// changesetTTL is how long a changeset that is neither committed nor discarded
+// is kept, and maxChangesets how many can be open at once.
+const (
+	changesetTTL  = 24 * time.Hour
+	maxChangesets = 64
+)
+
+// pruneChangesets drops the changesets opened longer than changesetTTL ago and
+// the oldest ones when there are maxChangesets, ww.mu must be held.
+func (ww *web) pruneChangesets(now time.Time) {
+	var open []*asterisk.Changeset
+	for id, c := range ww.changes {
+		if now.Sub(c.Created) > changesetTTL {
+			c.Discard()
+			delete(ww.changes, id)
+			continue
+		}
+		open = append(open, c)
+	}
+	sort.Slice(open, func(i, j int) bool { return open[i].Created.Before(open[j].Created) })
+	for ; len(open) >= maxChangesets; open = open[1:] {
+		open[0].Discard()
+		delete(ww.changes, open[0].ID)
+	}
+}
+
+// NewChangeset opens a new changeset. The returned json object has the id of
+// the changeset which is used to stage files and to commit them. A changeset
+// is dropped a day after it was opened, or earlier to make room when too many
+// are open.
+func (ww *web) NewChangeset(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	c := asterisk.NewChangeset(ww.cfg.AsteriskConfig)
+	ww.mu.Lock()
+	ww.pruneChangesets(c.Created)
+	ww.changes[c.ID] = c
+	ww.mu.Unlock()
+	_ = json.NewEncoder(w).Encode(c)
+}
+
+// getChangeset returns the changeset with the id in the request url. An error
+// message is written to w if there is no such changeset.
+func (ww *web) getChangeset(w http.ResponseWriter, r *http.Request) (*asterisk.Changeset, bool) {
+	id := mux.Vars(r)["id"]
+	ww.mu.Lock()
+	ww.pruneChangesets(time.Now())
+	c, ok := ww.changes[id]
+	ww.mu.Unlock()
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(&errMSG{"changeset not found"})
+	}
+	return c, ok
+}
+
+// Changeset serves the names of the files staged in a changeset.
+func (ww *web) Changeset(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	c, ok := ww.getChangeset(w, r)
+	if !ok {
+		return
+	}
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":      c.ID,
+		"created": c.Created,
+		"files":   c.Files(),
+	})
+}
+
+// StageChangeset adds a configuration file to a changeset. The request body is
+// the same json object accepted by UpdateDongle.
+func (ww *web) StageChangeset(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	c, ok := ww.getChangeset(w, r)
+	if !ok {
+		return
+	}
+	file := mux.Vars(r)["filename"] + ".conf"
+	if _, err := ww.writable(r, file); err != nil {
+		writeFileError(w, err)
+		return
+	}
+	src := &bytes.Buffer{}
+	_, err := io.Copy(src, r.Body)
+	if err != nil {
+		_ = enc.Encode(&errMSG{Message: "trouble reading request body"})
+		return
+	}
+	ast := &parser.Ast{}
+	err = ast.LoadJSON(src.Bytes())
+	if err != nil {
+		_ = enc.Encode(&errMSG{Message: "trouble loading request body"})
+		return
+	}
+	err = c.Stage(file, ast)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = enc.Encode(&errMSG{err.Error()})
+		return
+	}
+	_ = enc.Encode(map[string]interface{}{"id": c.ID, "files": c.Files()})
+}
+
+// ValidateChangeset checks the staged files together with the files already on
+// disk without writing anything.
+func (ww *web) ValidateChangeset(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	c, ok := ww.getChangeset(w, r)
+	if !ok {
+		return
+	}
+	writeChangesetResult(w, c.Validate())
+}
+
+// CommitChangeset writes all the staged files and reloads asterisk once. The
+// changeset is closed when this succeeds, it stays open when the files were
+// rolled back so it can be fixed and committed again. The configuration lock
+// is held until the devices were verified or the files rolled back.
+func (ww *web) CommitChangeset(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	c, ok := ww.getChangeset(w, r)
+	if !ok {
+		return
+	}
+	defer asterisk.Lock(ww.cfg.AsteriskConfig)()
+	before := make(map[string][]byte)
+	for _, name := range c.Files() {
+		if p, err := ww.files.Path(name); err == nil {
+			before[name], _ = ioutil.ReadFile(p)
+		}
+	}
+	reloader, err := ww.reloader(r, c.Files())
+	if err != nil {
+		writeFileError(w, err)
+		return
+	}
+	report, err := c.Apply(reloader, ww.verifier())
+	for _, name := range c.Files() {
+		after, _ := c.Staged(name)
+		ww.record(r, audit.ChangesetCommit, name, before[name], after, err)
+	}
+	if c.Closed() {
+		ww.mu.Lock()
+		delete(ww.changes, c.ID)
+		ww.mu.Unlock()
+	}
+	writeApplyResult(w, report, err)
+}
+
+// DiscardChangeset drops a changeset and everything staged in it.
+func (ww *web) DiscardChangeset(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	c, ok := ww.getChangeset(w, r)
+	if !ok {
+		return
+	}
+	c.Discard()
+	ww.mu.Lock()
+	delete(ww.changes, c.ID)
+	ww.mu.Unlock()
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"id": c.ID, "discarded": true})
+}
+
+// writeApplyResult responds with the report of an apply. A rollback is a
+// conflict with the running system while other failures keep the responses of
+// writeChangesetResult.
+func writeApplyResult(w http.ResponseWriter, report *asterisk.Report, err error) {
+	if err == nil || report != nil && report.RolledBack {
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusConflict)
+		}
+		_ = json.NewEncoder(w).Encode(report)
+		return
+	}
+	writeChangesetResult(w, err)
+}
+
+func writeChangesetResult(w http.ResponseWriter, err error) {
+	enc := json.NewEncoder(w)
+	switch e := err.(type) {
+	case nil:
+		_ = enc.Encode(map[string]interface{}{"ok": true})
+	case *asterisk.ValidationError:
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		_ = enc.Encode(e)
+	default:
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		_ = enc.Encode(&errMSG{err.Error()})
+	}
+}
+
+// errForbidden is returned when the user's role does not allow changing a file.
+var errForbidden = errors.New("your role does not allow changing this file")
+
+// writable returns the path to the file name if the user who sent r is allowed
+// to change it. Operators can only change the dongle settings while admins can
+// change every file that is not read only.
+func (ww *web) writable(r *http.Request, name string) (string, error) {
+	p, err := ww.files.Writable(name)
+	if err != nil {
+		return "", err
+	}
+	u, ok := auth.UserFrom(r)
+	if !ok || (u.Role < auth.Admin && name != asterisk.DongleConf) {
+		return "", errForbidden
+	}
+	return p, nil
+}
+
+// errBadWhen is returned for an unknown value of the reload query parameter.
+var errBadWhen = errors.New("reload must be one of now, gracefully or when convenient")
+
+// reloader returns what tells asterisk about the files written by r. The
+// reload query parameter chooses when the devices restart.
+func (ww *web) reloader(r *http.Request, files []string) (asterisk.Reloader, error) {
+	when := r.URL.Query().Get("reload")
+	if when == "" {
+		when = ww.cfg.ReloadWhen
+	}
+	if !validWhen(when) {
+		return nil, errBadWhen
+	}
+	return reloaderFor(ww.cfg, when, files), nil
+}
+
+// reloaderFor returns what tells asterisk about the files. When AMI is
+// configured chan_dongle is reloaded through it, otherwise ReloadCommand is
+// run.
+func reloaderFor(cfg *Config, when string, files []string) asterisk.Reloader {
+	if cfg.AMIAddress == "" {
+		return asterisk.CommandReloader(cfg.ReloadCommand)
+	}
+	rl := &ami.Reloader{Config: amiConfig(cfg), When: when}
+	for _, name := range files {
+		rl.Dialplan = rl.Dialplan || name == asterisk.ExtensionsConf
+	}
+	return rl
+}
+
+// amiConfig returns how to reach the asterisk manager interface.
+func amiConfig(cfg *Config) ami.Config {
+	return ami.Config{
+		Addr:     cfg.AMIAddress,
+		Username: cfg.AMIUsername,
+		Secret:   cfg.AMISecret,
+	}
+}
+
+// writeFileError reports why a configuration file can not be accessed.
+func writeFileError(w http.ResponseWriter, err error) {
+	switch err {
+	case asterisk.ErrBadName, errBadWhen:
+		w.WriteHeader(http.StatusBadRequest)
+	case asterisk.ErrNotManaged, asterisk.ErrReadOnly, errForbidden:
+		w.WriteHeader(http.StatusForbidden)
+	default:
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		err = errors.New("trouble opening configuration file")
+	}
+	_ = json.NewEncoder(w).Encode(&errMSG{err.Error()})
 }
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/FarmRadioHangar/fessboxconfig/auth"
+	"github.com/gorilla/mux"
+)
+
+func TestStageChangeset(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fconf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	err = copyFiles(dir, "sample")
+	if err != nil {
+		t.Fatal(err)
+	}
+	users, err := auth.Open(filepath.Join(dir, "users.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = users.Add("admin", "secret", auth.Admin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := defaultConfig()
+	cfg.AsteriskConfig = dir
+	ww := newWeb(cfg, nil)
+	s := mux.NewRouter()
+	s.HandleFunc("/changeset", users.Require(auth.Operator, ww.NewChangeset)).Methods("POST")
+	s.HandleFunc("/changeset/{id}/{filename}", users.Require(auth.Operator, ww.StageChangeset)).Methods("POST")
+
+	r := httptest.NewRequest("POST", "/changeset", nil)
+	r.SetBasicAuth("admin", "secret")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	var c struct{ ID string }
+	err = json.NewDecoder(w.Body).Decode(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bodies := map[string]string{
+		"dongle.conf":     `{"general":{"interval":"15"},"airtel1":{"imei":"353220047976425","context":"from-trunk"}}`,
+		"extensions.conf": `{"general":{"static":"yes"},"from-trunk":{"include":"default"}}`,
+	}
+	for _, name := range cfg.ManagedFiles {
+		body := bytes.NewBufferString(bodies[name])
+		url := "/changeset/" + c.ID + "/" + strings.TrimSuffix(name, ".conf")
+		r := httptest.NewRequest("POST", url, body)
+		r.SetBasicAuth("admin", "secret")
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Errorf("staging %s: expected %d got %d %s", name, http.StatusOK, w.Code, w.Body)
+		}
+	}
+	if files := ww.changes[c.ID].Files(); len(files) != len(cfg.ManagedFiles) {
+		t.Errorf("expected all the managed files to be staged got %v", files)
+	}
+}
+
+func TestCheckAccess(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fconf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	if err := checkAccess(dir); err != nil {
+		t.Error(err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("expected nothing to be written got %v", files)
+	}
+	name := filepath.Join(dir, "dongle.conf")
+	err = ioutil.WriteFile(name, nil, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkAccess(name); err == nil {
+		t.Error("expected a file to fail")
+	}
+	if err := checkAccess(filepath.Join(dir, "missing")); err == nil {
+		t.Error("expected a missing directory to fail")
+	}
+}
@@ -0,0 +1,328 @@
+// Package metrics exposes counters, gauges and histograms in the Prometheus
+// text format.
+//
+// Only what fconf needs is implemented, metrics are registered once at startup
+// and the values are updated from any goroutine.
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefBuckets are the default histogram buckets in seconds, suited to request
+// latencies.
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Sample is a single value of a metric collected at scrape time.
+type Sample struct {
+	Labels []string
+	Value  float64
+}
+
+type family interface {
+	write(w io.Writer)
+}
+
+// Registry holds the metrics that are served together.
+//
+// It is safe to use in multiple goroutines.
+type Registry struct {
+	mu       sync.Mutex
+	families []family
+}
+
+// NewRegistry returns an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(f family) {
+	r.mu.Lock()
+	r.families = append(r.families, f)
+	r.mu.Unlock()
+}
+
+// Counter registers a counter with the given label names.
+func (r *Registry) Counter(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{vec: newVec(name, help, "counter", labels)}
+	r.register(c)
+	return c
+}
+
+// Gauge registers a gauge with the given label names.
+func (r *Registry) Gauge(name, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{vec: newVec(name, help, "gauge", labels)}
+	r.register(g)
+	return g
+}
+
+// Histogram registers a histogram with the given upper bounds and label names.
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{vec: newVec(name, help, "histogram", labels), buckets: buckets}
+	r.register(h)
+	return h
+}
+
+// GaugeFunc registers a gauge whose samples are returned by collect every time
+// the metrics are scraped. It suits values that are owned by something else,
+// like the state of the modems.
+func (r *Registry) GaugeFunc(name, help string, labels []string, collect func() []Sample) {
+	r.register(&gaugeFunc{vec: newVec(name, help, "gauge", labels), collect: collect})
+}
+
+// WriteTo writes all the metrics in the text exposition format.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	families := append([]family(nil), r.families...)
+	r.mu.Unlock()
+	buf := &bytes.Buffer{}
+	for _, f := range families {
+		f.write(buf)
+	}
+	return buf.WriteTo(w)
+}
+
+// ServeHTTP serves the metrics to a Prometheus scraper.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	_, _ = r.WriteTo(w)
+}
+
+type vec struct {
+	name, help, typ string
+	labels          []string
+	mu              sync.Mutex
+	values          map[string][]string
+}
+
+func newVec(name, help, typ string, labels []string) vec {
+	return vec{name: name, help: help, typ: typ, labels: labels, values: make(map[string][]string)}
+}
+
+// key returns the map key of the label values, and remembers the values.
+func (v *vec) key(values []string) string {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s has %d labels got %d values", v.name, len(v.labels), len(values)))
+	}
+	k := strings.Join(values, "\xff")
+	if _, ok := v.values[k]; !ok {
+		v.values[k] = append([]string(nil), values...)
+	}
+	return k
+}
+
+func (v *vec) header(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, v.help, v.name, v.typ)
+}
+
+func (v *vec) sortedKeys() []string {
+	var keys []string
+	for k := range v.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// labelPairs formats the labels with their values, extra is appended as is.
+func labelPairs(names, values []string, extra string) string {
+	var pairs []string
+	for i, n := range names {
+		pairs = append(pairs, n+`="`+escape(values[i])+`"`)
+	}
+	if extra != "" {
+		pairs = append(pairs, extra)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escape(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, "\n", `\n`, -1)
+	return strings.Replace(s, `"`, `\"`, -1)
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// CounterVec is a counter partitioned by labels.
+type CounterVec struct {
+	vec
+	counts map[string]float64
+}
+
+// Counter is a single counter of a CounterVec.
+type Counter struct {
+	v   *CounterVec
+	key string
+}
+
+// With returns the counter for the label values.
+func (c *CounterVec) With(values ...string) Counter {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return Counter{v: c, key: c.key(values)}
+}
+
+// Inc adds one to the counter.
+func (c Counter) Inc() {
+	c.Add(1)
+}
+
+// Add adds n to the counter.
+func (c Counter) Add(n float64) {
+	c.v.mu.Lock()
+	if c.v.counts == nil {
+		c.v.counts = make(map[string]float64)
+	}
+	c.v.counts[c.key] += n
+	c.v.mu.Unlock()
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.header(w)
+	for _, k := range c.sortedKeys() {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, labelPairs(c.labels, c.values[k], ""), formatFloat(c.counts[k]))
+	}
+}
+
+// GaugeVec is a gauge partitioned by labels.
+type GaugeVec struct {
+	vec
+	gauges map[string]float64
+}
+
+// Gauge is a single gauge of a GaugeVec.
+type Gauge struct {
+	v   *GaugeVec
+	key string
+}
+
+// With returns the gauge for the label values.
+func (g *GaugeVec) With(values ...string) Gauge {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return Gauge{v: g, key: g.key(values)}
+}
+
+// Set sets the value of the gauge.
+func (g Gauge) Set(n float64) {
+	g.v.mu.Lock()
+	if g.v.gauges == nil {
+		g.v.gauges = make(map[string]float64)
+	}
+	g.v.gauges[g.key] = n
+	g.v.mu.Unlock()
+}
+
+func (g *GaugeVec) write(w io.Writer) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.header(w)
+	for _, k := range g.sortedKeys() {
+		fmt.Fprintf(w, "%s%s %s\n", g.name, labelPairs(g.labels, g.values[k], ""), formatFloat(g.gauges[k]))
+	}
+}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// HistogramVec is a histogram partitioned by labels.
+type HistogramVec struct {
+	vec
+	buckets []float64
+	hists   map[string]*histogram
+}
+
+// Histogram is a single histogram of a HistogramVec.
+type Histogram struct {
+	v   *HistogramVec
+	key string
+}
+
+// With returns the histogram for the label values.
+func (h *HistogramVec) With(values ...string) Histogram {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return Histogram{v: h, key: h.key(values)}
+}
+
+// Observe adds a single observation to the histogram.
+func (h Histogram) Observe(n float64) {
+	h.v.mu.Lock()
+	defer h.v.mu.Unlock()
+	if h.v.hists == nil {
+		h.v.hists = make(map[string]*histogram)
+	}
+	hist, ok := h.v.hists[h.key]
+	if !ok {
+		hist = &histogram{counts: make([]uint64, len(h.v.buckets))}
+		h.v.hists[h.key] = hist
+	}
+	for i, b := range h.v.buckets {
+		if n <= b {
+			hist.counts[i]++
+		}
+	}
+	hist.count++
+	hist.sum += n
+}
+
+func (h *HistogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.header(w)
+	for _, k := range h.sortedKeys() {
+		hist, ok := h.hists[k]
+		if !ok {
+			continue
+		}
+		values := h.values[k]
+		for i, b := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelPairs(h.labels, values, `le="`+formatFloat(b)+`"`), hist.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelPairs(h.labels, values, `le="+Inf"`), hist.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, labelPairs(h.labels, values, ""), formatFloat(hist.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labelPairs(h.labels, values, ""), hist.count)
+	}
+}
+
+type gaugeFunc struct {
+	vec
+	collect func() []Sample
+}
+
+func (g *gaugeFunc) write(w io.Writer) {
+	g.header(w)
+	for _, s := range g.collect() {
+		if len(s.Labels) != len(g.labels) {
+			continue
+		}
+		fmt.Fprintf(w, "%s%s %s\n", g.name, labelPairs(g.labels, s.Labels, ""), formatFloat(s.Value))
+	}
+}
@@ -0,0 +1,55 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	c := r.Counter("fconf_requests_total", "Requests served.", "route", "code")
+	c.With("/config/{filename}", "200").Inc()
+	c.With("/config/{filename}", "200").Inc()
+	c.With("/serial/list", "500").Add(3)
+	g := r.Gauge("fconf_up", "Whether fconf is up.")
+	g.With().Set(1)
+	h := r.Histogram("fconf_latency_seconds", "Latency.", []float64{0.1, 1}, "route")
+	h.With("/a").Observe(0.05)
+	h.With("/a").Observe(0.5)
+	r.GaugeFunc("fconf_modem_present", "Modems.", []string{"imei"}, func() []Sample {
+		return []Sample{{Labels: []string{`35"3`}, Value: 1}}
+	})
+
+	buf := &bytes.Buffer{}
+	_, err := r.WriteTo(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []string{
+		"# TYPE fconf_requests_total counter",
+		`fconf_requests_total{route="/config/{filename}",code="200"} 2`,
+		`fconf_requests_total{route="/serial/list",code="500"} 3`,
+		"fconf_up 1",
+		"# TYPE fconf_latency_seconds histogram",
+		`fconf_latency_seconds_bucket{route="/a",le="0.1"} 1`,
+		`fconf_latency_seconds_bucket{route="/a",le="1"} 2`,
+		`fconf_latency_seconds_bucket{route="/a",le="+Inf"} 2`,
+		`fconf_latency_seconds_sum{route="/a"} 0.55`,
+		`fconf_latency_seconds_count{route="/a"} 2`,
+		`fconf_modem_present{imei="35\"3"} 1`,
+	}
+	out := buf.String()
+	for _, v := range expect {
+		if !strings.Contains(out, v+"\n") {
+			t.Errorf("expected %q in\n%s", v, out)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+		t.Errorf("wrong content type %s", w.Header().Get("Content-Type"))
+	}
+}
@@ -34,6 +34,11 @@ func (a *Ast) Section(name string) (*NodeSection, error) {
 	return nil, errors.New("section not found")
 }
 
+//Sections returns all the sections in the Ast in the order they were added.
+func (a *Ast) Sections() []*NodeSection {
+	return a.sections
+}
+
 //ToJSON marhalls *Ast to a json string and writes the result to dst
 func (a *Ast) ToJSON(dst io.Writer) error {
 	o := make(map[string]interface{})
@@ -98,6 +103,20 @@ type NodeSection struct {
 	values []*nodeIdent
 }
 
+//Name returns the name of the section.
+func (n *NodeSection) Name() string {
+	return n.name
+}
+
+//Keys returns the keys defined in the section in the order they appear.
+func (n *NodeSection) Keys() []string {
+	var keys []string
+	for _, v := range n.values {
+		keys = append(keys, v.key)
+	}
+	return keys
+}
+
 //Get access the key definition and returns its value or an error if the key is
 //not part of the section.
 func (n *NodeSection) Get(key string) (string, error) {
@@ -196,13 +215,14 @@ END:
 	return p.Ast, err
 }
 
+// next returns the next token, or an EOF token past the end of the input. The
+// position moves on in both cases so a rewind always undoes one next.
 func (p *Parser) next() *ast.Token {
-	if p.currPos >= len(p.tokens)-1 {
+	p.currPos++
+	if p.currPos > len(p.tokens) {
 		return &ast.Token{Type: ast.EOF}
 	}
-	t := p.tokens[p.currPos]
-	p.currPos++
-	return t
+	return p.tokens[p.currPos-1]
 }
 
 func (p *Parser) seek(at int) {
@@ -246,6 +266,9 @@ END:
 				p.rewind()
 				goto BEGIN
 			}
+			if n1.Type != ast.EOF {
+				p.rewind()
+			}
 			goto BEGIN
 		case ast.Ident:
 			p.rewind()
@@ -254,6 +277,10 @@ END:
 				break END
 			}
 		default:
+
+			// Leave the token for the caller, it is probably the start of the
+			// next section.
+			p.rewind()
 			break END
 		}
 	}
@@ -77,3 +77,61 @@ func TestParser(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestParseSections(t *testing.T) {
+	src := "\n[airtel1]\nimei=353220047976425\n\n[tigo1]\nimei=352215045819420\n\n"
+	p, err := NewParser(bytes.NewReader([]byte(src)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := p.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sample := []struct {
+		section, imei string
+	}{
+		{"airtel1", "353220047976425"},
+		{"tigo1", "352215045819420"},
+	}
+	for _, v := range sample {
+		sec, err := a.Section(v.section)
+		if err != nil {
+			t.Fatal(err)
+		}
+		imei, err := sec.Get("imei")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if imei != v.imei {
+			t.Errorf("expected %s got %s", v.imei, imei)
+		}
+	}
+}
+
+func TestParseEndOfInput(t *testing.T) {
+	for _, src := range []string{
+		"[airtel1]\nimei=353220047976425\n",
+		"[airtel1]\nimei=353220047976425",
+	} {
+		p, err := NewParser(bytes.NewReader([]byte(src)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		a, err := p.Parse()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sec, err := a.Section("airtel1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		imei, err := sec.Get("imei")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if imei != "353220047976425" {
+			t.Errorf("%q: expected 353220047976425 got %s", src, imei)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/FarmRadioHangar/fessboxconfig/asterisk"
+	"github.com/FarmRadioHangar/fessboxconfig/audit"
+)
+
+// reconcileAction is one of the actions offered by a reconciliation. Section
+// names the device to stop or rebind and IMEI the modem to adopt.
+type reconcileAction struct {
+	Action  string `json:"action"`
+	Section string `json:"section,omitempty"`
+	IMEI    string `json:"imei,omitempty"`
+	adoptRequest
+}
+
+// reconcile compares dongle.conf with the modems that are plugged in.
+func (ww *web) reconcile() (*asterisk.Reconciliation, []byte, error) {
+	src, err := ioutil.ReadFile(filepath.Join(ww.cfg.AsteriskConfig, asterisk.DongleConf))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+	var present []asterisk.Identity
+	for _, m := range plugged(ww.manager) {
+		present = append(present, asterisk.Identity{IMEI: m.IMEI, IMSI: m.IMSI})
+	}
+	r, err := asterisk.Reconcile(src, present)
+	return r, src, err
+}
+
+// Reconcile serves the devices in dongle.conf whose modem is gone, the modems
+// that have no device and the SIMs that moved to another modem, with the
+// action offered for each.
+func (ww *web) Reconcile(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	rec, _, err := ww.reconcile()
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(&errMSG{"trouble reconciling dongle configuration"})
+		return
+	}
+	_ = json.NewEncoder(w).Encode(rec)
+}
+
+// ApplyReconcile takes a json object with a list of actions, like
+//
+//	{"actions": [{"action": "stop", "section": "vodacom1"},
+//		{"action": "rebind", "section": "tigo1"},
+//		{"action": "adopt", "imei": "356789012345678", "context": "from-trunk"}]}
+//
+// and applies all of them to dongle.conf with a single reload.
+func (ww *web) ApplyReconcile(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	if _, err := ww.writable(r, asterisk.DongleConf); err != nil {
+		writeFileError(w, err)
+		return
+	}
+	reloader, err := ww.reloader(r, []string{asterisk.DongleConf})
+	if err != nil {
+		writeFileError(w, err)
+		return
+	}
+	var req struct {
+		Actions []reconcileAction `json:"actions"`
+	}
+	err = json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || len(req.Actions) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = enc.Encode(&errMSG{Message: "trouble loading request body"})
+		return
+	}
+	defer asterisk.Lock(ww.cfg.AsteriskConfig)()
+	rec, before, err := ww.reconcile()
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		_ = enc.Encode(&errMSG{"trouble reconciling dongle configuration"})
+		return
+	}
+	after, sections, err := ww.applyActions(rec, before, req.Actions)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = enc.Encode(&errMSG{err.Error()})
+		return
+	}
+	c := asterisk.NewChangeset(ww.cfg.AsteriskConfig)
+	err = c.StageRaw(asterisk.DongleConf, after)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = enc.Encode(&errMSG{err.Error()})
+		return
+	}
+	report, err := c.Apply(reloader, ww.verifier())
+	ww.record(r, audit.ConfigWrite, asterisk.DongleConf, before, after, err)
+	if err != nil {
+		writeApplyResult(w, report, err)
+		return
+	}
+	_ = enc.Encode(map[string]interface{}{"adopted": sections, "report": report})
+}
+
+// applyActions changes the dongle.conf src with the actions, it returns the
+// new content and the names of the sections created for adopted modems. Only
+// the actions offered by rec are taken, so a working device can not be stopped.
+func (ww *web) applyActions(rec *asterisk.Reconciliation, src []byte, actions []reconcileAction) ([]byte, []string, error) {
+	var sections []string
+	var err error
+	for _, a := range actions {
+		switch a.Action {
+		case asterisk.ActionStop, asterisk.ActionRebind:
+			if !rec.Offers(a.Action, a.Section) {
+				return nil, nil, fmt.Errorf("%s is not offered for [%s]", a.Action, a.Section)
+			}
+		case asterisk.ActionAdopt:
+			if !rec.Offers(a.Action, a.IMEI) {
+				return nil, nil, fmt.Errorf("%s is not offered for %s", a.Action, a.IMEI)
+			}
+		}
+		switch a.Action {
+		case asterisk.ActionStop:
+			src, err = asterisk.Stop(src, a.Section)
+		case asterisk.ActionRebind:
+			src, err = rec.Rebind(src, a.Section)
+		case asterisk.ActionAdopt:
+			m, ok := findModem(ww.manager, a.IMEI)
+			if !ok {
+				return nil, nil, fmt.Errorf("%s: %v", a.IMEI, errNoModem)
+			}
+			var name string
+			src, name, err = asterisk.Adopt(src, adoptionFor(ww.cfg, m, a.adoptRequest))
+			sections = append(sections, name)
+		default:
+			return nil, nil, fmt.Errorf("unknown action %q", a.Action)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return src, sections, nil
+}
@@ -5,6 +5,7 @@ SCRIPT_DIR=$PWD/scripts
 
 function install_systemd {
     cp -f $SCRIPT_DIR/fconf.service /lib/systemd/system/fconf.service
+    cp -f $SCRIPT_DIR/fconf.socket /lib/systemd/system/fconf.socket
     systemctl enable fconf || true
     systemctl daemon-reload || true
 }
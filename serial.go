@@ -0,0 +1,386 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/FarmRadioHangar/fessboxconfig/ami"
+	"github.com/FarmRadioHangar/fessboxconfig/asterisk"
+	"github.com/FarmRadioHangar/fessboxconfig/audit"
+	"github.com/FarmRadioHangar/fessboxconfig/device"
+	"github.com/FarmRadioHangar/fessboxconfig/history"
+	"github.com/gorilla/mux"
+)
+
+// serialStatus is a modem detected by fconf together with the state of the
+// chan_dongle device using the same IMEI. Either side is missing when only
+// fconf or only asterisk knows about the modem, a device chan_dongle has no
+// IMEI for is keyed by its section name.
+type serialStatus struct {
+	*device.Modem
+	Asterisk *ami.DongleDevice `json:"asterisk,omitempty"`
+
+	// Summary is a one line description of the asterisk side, for instance
+	// "airtel1: Free, RSSI 18, Airtel TZ".
+	Summary string `json:"summary,omitempty"`
+}
+
+// SerialList serves the detected modems keyed by IMEI. When AMI is configured
+// each modem also carries what chan_dongle reports for it, so the state, the
+// signal and the provider seen by asterisk are shown next to the SIM. The
+// chan_dongle devices without an IMEI are listed by their section name.
+func (ww *web) SerialList(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var modems []device.Modem
+	if ww.manager != nil {
+		modems = ww.manager.Modems()
+	}
+	var dongles []ami.DongleDevice
+	if ww.cfg.AMIAddress != "" {
+		var err error
+		dongles, err = ww.dongles.get(ww.cfg)
+		if err != nil {
+			// the modems fconf found are still worth showing
+			log.Println(err)
+		}
+	}
+	_ = json.NewEncoder(w).Encode(mergeStatus(modems, dongles))
+}
+
+// SerialModem serves the modem with the imei in the url like an entry of
+// SerialList.
+func (ww *web) SerialModem(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	imei := mux.Vars(r)["imei"]
+	var modems []device.Modem
+	if ww.manager != nil {
+		if m, ok := ww.manager.Modem(imei); ok {
+			modems = append(modems, m)
+		}
+	}
+	var dongles []ami.DongleDevice
+	if ww.cfg.AMIAddress != "" {
+		var err error
+		dongles, err = ww.dongles.get(ww.cfg)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+	s, ok := mergeStatus(modems, dongles)[imei]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(&errMSG{device.ErrNoModem.Error()})
+		return
+	}
+	_ = json.NewEncoder(w).Encode(s)
+}
+
+// maxPoints bounds the points served by SerialHistory.
+const maxPoints = 10000
+
+// SerialHistory serves the signal and the registration of the modem with the
+// imei in the url between the RFC 3339 timestamps from and to, the last day
+// by default. With step, a duration like 15m, the samples are summed up with
+// their minimum, average and maximum for each step. Without step there is a
+// point per sample, unless there are more than maxPoints samples; then a step
+// is picked so there are at most maxPoints.
+func (ww *web) SerialHistory(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	if ww.history == nil {
+		w.WriteHeader(http.StatusNotFound)
+		_ = enc.Encode(&errMSG{"the signal history is off"})
+		return
+	}
+	q := r.URL.Query()
+	to, from := time.Now(), time.Time{}
+	var step time.Duration
+	var err error
+	if v := q.Get("to"); v != "" {
+		to, err = time.Parse(time.RFC3339, v)
+	}
+	if v := q.Get("from"); v != "" && err == nil {
+		from, err = time.Parse(time.RFC3339, v)
+	}
+	if v := q.Get("step"); v != "" && err == nil {
+		step, err = time.ParseDuration(v)
+	}
+	if from.IsZero() {
+		from = to.Add(-24 * time.Hour)
+	}
+	switch {
+	case err != nil:
+	case step < 0 || !from.Before(to):
+		err = errors.New("expected from before to and a positive step")
+	case step > 0 && to.Sub(from)/step > maxPoints:
+		err = fmt.Errorf("more than %d steps between from and to", maxPoints)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = enc.Encode(&errMSG{err.Error()})
+		return
+	}
+	imei := mux.Vars(r)["imei"]
+	samples, err := ww.history.Query(imei, from, to)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		_ = enc.Encode(&errMSG{"trouble reading the signal history"})
+		return
+	}
+	if step == 0 && len(samples) > maxPoints {
+		// a whole number of seconds, rounded up
+		step = (to.Sub(from)/maxPoints + time.Second - 1).Truncate(time.Second)
+	}
+	points := history.Downsample(samples, from, step)
+	if points == nil {
+		points = []history.Point{}
+	}
+	_ = enc.Encode(map[string]interface{}{
+		"imei":   imei,
+		"from":   from,
+		"to":     to,
+		"step":   step.String(),
+		"points": points,
+	})
+}
+
+// SerialUpdates streams the events of the modems over a websocket: modems
+// plugged in or removed, incoming messages and calls, USSD replies and changes
+// of the network registration.
+func (ww *web) SerialUpdates(w http.ResponseWriter, r *http.Request) {
+	if ww.manager == nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(&errMSG{"device detection is off"})
+		return
+	}
+	ww.manager.Updates(w, r)
+}
+
+// SerialCommand takes a json object like {"command": "AT+COPS?"}, sends the
+// command to the modem with the imei in the url and serves its answer. The
+// command waits its turn behind the ones already sent to the modem, and is
+// recorded in the audit log.
+func (ww *web) SerialCommand(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	if ww.manager == nil {
+		w.WriteHeader(http.StatusNotFound)
+		_ = enc.Encode(&errMSG{"device detection is off"})
+		return
+	}
+	var req struct {
+		Command string `json:"command"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || !validCommand(req.Command) {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = enc.Encode(&errMSG{"expected a single AT command"})
+		return
+	}
+	imei := mux.Vars(r)["imei"]
+	resp, err := ww.manager.Command(r.Context(), imei, device.High, req.Command)
+	e := audit.Entry{Action: audit.ATCommand, Target: imei, Before: req.Command}
+	if resp != nil {
+		e.After = resp.String()
+	}
+	ww.recordEntry(r, e, err)
+	switch {
+	case err == device.ErrNoModem:
+		w.WriteHeader(http.StatusNotFound)
+	case err == device.ErrTimeout:
+		w.WriteHeader(http.StatusGatewayTimeout)
+	case resp == nil:
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	out := map[string]interface{}{"command": req.Command}
+	if resp != nil {
+		out["lines"], out["result"] = resp.Lines, resp.Result
+	}
+	if err != nil {
+		out["error"] = err.Error()
+	}
+	_ = enc.Encode(out)
+}
+
+// validCommand returns true if cmd is one AT command, a line break would let a
+// second command through.
+func validCommand(cmd string) bool {
+	return len(cmd) >= 2 && strings.EqualFold(cmd[:2], "AT") && !strings.ContainsAny(cmd, "\r\n\x1a\x1b")
+}
+
+func dongleDevices(cfg *Config) ([]ami.DongleDevice, error) {
+	c, err := amiConfig(cfg).Connect()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = c.Close() }()
+	return c.DongleDevices()
+}
+
+// dongleTTL is how long the chan_dongle devices read over AMI are reused by
+// the list requests, a page polling them would dial AMI every time otherwise.
+const dongleTTL = 5 * time.Second
+
+// dongleCache keeps the chan_dongle devices last read over AMI.
+type dongleCache struct {
+	mu   sync.Mutex
+	at   time.Time
+	list []ami.DongleDevice
+	err  error
+}
+
+// get returns the chan_dongle devices, read again when they are older than
+// dongleTTL. The requests coming in while they are read wait for them instead
+// of dialing AMI too.
+func (d *dongleCache) get(cfg *Config) ([]ami.DongleDevice, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if time.Since(d.at) < dongleTTL {
+		return d.list, d.err
+	}
+	d.list, d.err = dongleDevices(cfg)
+	d.at = time.Now()
+	return d.list, d.err
+}
+
+// mergeStatus matches the modems with the chan_dongle devices by IMEI. The
+// devices chan_dongle has no IMEI for, often the broken ones, are keyed by
+// their section name.
+func mergeStatus(modems []device.Modem, dongles []ami.DongleDevice) map[string]*serialStatus {
+	list := make(map[string]*serialStatus)
+	for i := range modems {
+		list[modems[i].IMEI] = &serialStatus{Modem: &modems[i]}
+	}
+	for i := range dongles {
+		d := &dongles[i]
+		key := d.IMEI
+		if key == "" {
+			key = d.Device
+		}
+		s, ok := list[key]
+		if !ok {
+			s = &serialStatus{}
+			list[key] = s
+		}
+		s.Asterisk = d
+		s.Summary = d.String()
+	}
+	return list
+}
+
+// badStates are the chan_dongle states of a device that is not usable.
+var badStates = map[string]bool{
+	"":                   true,
+	"Not connected":      true,
+	"Not initialized":    true,
+	"GSM not registered": true,
+}
+
+// verifyInterval is how often the devices are polled while waiting for them
+// to come back after a reload.
+const verifyInterval = 2 * time.Second
+
+// dongleVerifier waits for chan_dongle devices to be usable. It implements
+// asterisk.Verifier.
+type dongleVerifier struct {
+	devices  func() ([]ami.DongleDevice, error)
+	timeout  time.Duration
+	interval time.Duration
+}
+
+// verifier returns how the devices are checked after a reload, it is nil when
+// AMI or the check is turned off.
+func (ww *web) verifier() asterisk.Verifier {
+	return verifierFor(ww.cfg)
+}
+
+func verifierFor(cfg *Config) asterisk.Verifier {
+	if cfg.AMIAddress == "" || cfg.VerifyTimeout == 0 {
+		return nil
+	}
+	return &dongleVerifier{
+		devices:  func() ([]ami.DongleDevice, error) { return dongleDevices(cfg) },
+		timeout:  time.Duration(cfg.VerifyTimeout) * time.Second,
+		interval: verifyInterval,
+	}
+}
+
+// idleState is the chan_dongle state of a device that is usable and not in a
+// call.
+const idleState = "Free"
+
+// Before returns the state of the named devices before the reload.
+func (v *dongleVerifier) Before(names []string) []asterisk.DeviceState {
+	return v.poll(names)
+}
+
+// poll returns the state of the named devices, a device chan_dongle does not
+// list has an empty state.
+func (v *dongleVerifier) poll(names []string) []asterisk.DeviceState {
+	found := make(map[string]string)
+	list, err := v.devices()
+	if err != nil {
+		log.Println(err)
+	}
+	for _, d := range list {
+		found[d.Device] = d.State
+	}
+	states := make([]asterisk.DeviceState, len(names))
+	for i, name := range names {
+		state := found[name]
+		states[i] = asterisk.DeviceState{Device: name, State: state, OK: !badStates[state]}
+	}
+	return states
+}
+
+// Verify polls chan_dongle until every device has restarted and is usable, or
+// the timeout expires, and returns the last state seen of each device. A
+// device has restarted once it was seen not usable after the reload, or when
+// it was not usable before it, so its old state is never mistaken for the new
+// one.
+//
+// With reload_when set to gracefully or when convenient chan_dongle restarts a
+// device in a call only once the call is over. A device still busy in a call
+// it had before the reload is reported as pending and OK when the timeout
+// expires, so it is not rolled back while its restart is still to come, but
+// its new settings are not verified. A device that is free but was never seen
+// restarting is not OK.
+func (v *dongleVerifier) Verify(before []asterisk.DeviceState) []asterisk.DeviceState {
+	deadline := time.Now().Add(v.timeout)
+	names := make([]string, len(before))
+	restarted := make([]bool, len(before))
+	for i, d := range before {
+		names[i] = d.Device
+		restarted[i] = !d.OK
+	}
+	for {
+		time.Sleep(v.interval)
+		states := v.poll(names)
+		done := true
+		for i := range states {
+			s := &states[i]
+			if !s.OK {
+				restarted[i] = true
+			}
+			switch {
+			case restarted[i]:
+			case s.State != idleState:
+				s.Pending = true
+			default:
+				s.OK = false
+			}
+			done = done && s.OK && !s.Pending
+		}
+		if done || time.Now().After(deadline) {
+			return states
+		}
+	}
+}
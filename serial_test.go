@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/FarmRadioHangar/fessboxconfig/ami"
+	"github.com/FarmRadioHangar/fessboxconfig/asterisk"
+	"github.com/FarmRadioHangar/fessboxconfig/audit"
+	"github.com/FarmRadioHangar/fessboxconfig/device"
+	"github.com/FarmRadioHangar/fessboxconfig/history"
+	"github.com/gorilla/mux"
+)
+
+func TestMergeStatus(t *testing.T) {
+	modems := []device.Modem{
+		{IMEI: "356789012345678", IMSI: "640050123456789", Path: "/dev/ttyUSB1"},
+		{IMEI: "356789012345670", Path: "/dev/ttyUSB4"},
+	}
+	dongles := []ami.DongleDevice{
+		{Device: "airtel1", State: "Free", RSSI: 18, Provider: "Airtel TZ", IMEI: "356789012345678"},
+		{Device: "tigo1", State: "Not connected", IMEI: "356789012345679"},
+		{Device: "broken"},
+	}
+	list := mergeStatus(modems, dongles)
+	if len(list) != 4 {
+		t.Fatalf("expected 4 modems got %d", len(list))
+	}
+	s := list["356789012345678"]
+	if s.Modem == nil || s.Asterisk == nil || s.Summary != "airtel1: Free, RSSI 18, Airtel TZ" {
+		t.Errorf("expected both sides got %+v", s)
+	}
+	if s := list["356789012345670"]; s.Asterisk != nil {
+		t.Error("expected no asterisk device for a modem chan_dongle does not use")
+	}
+	if s := list["356789012345679"]; s.Modem != nil || s.Asterisk.Device != "tigo1" {
+		t.Errorf("expected only the asterisk side got %+v", s)
+	}
+	if s := list["broken"]; s == nil || s.Modem != nil || s.Asterisk.Device != "broken" {
+		t.Errorf("expected the device without an IMEI by its name got %+v", s)
+	}
+}
+
+func TestDongleVerifier(t *testing.T) {
+	var states []string
+	polls := 0
+	v := &dongleVerifier{
+		devices: func() ([]ami.DongleDevice, error) {
+			state := states[len(states)-1]
+			if polls < len(states) {
+				state = states[polls]
+			}
+			polls++
+			return []ami.DongleDevice{{Device: "airtel1", State: state}}, nil
+		},
+		timeout:  50 * time.Millisecond,
+		interval: time.Millisecond,
+	}
+	verify := func(s ...string) []asterisk.DeviceState {
+		states, polls = s, 0
+		return v.Verify(v.Before([]string{"airtel1"}))
+	}
+	got := verify("Free", "Free", "Not initialized", "Not initialized", "Free")
+	if len(got) != 1 || !got[0].OK || got[0].Pending || polls != 5 {
+		t.Errorf("expected airtel1 to come back after restarting got %+v after %d", got, polls)
+	}
+	got = verify("Free", "Free")
+	if got[0].OK {
+		t.Errorf("expected a device that did not restart to fail got %+v", got)
+	}
+	got = verify("Ring", "Ring")
+	if !got[0].OK || !got[0].Pending {
+		t.Errorf("expected a device in a call to be pending got %+v", got)
+	}
+	got = verify("", "Free")
+	if !got[0].OK || got[0].Pending || polls != 2 {
+		t.Errorf("expected a new device to be usable got %+v after %d", got, polls)
+	}
+	states, polls = []string{"Free"}, 0
+	got = v.Verify(v.Before([]string{"tigo1"}))
+	if got[0].OK || got[0].State != "" {
+		t.Errorf("expected a missing device to fail got %+v", got)
+	}
+}
+
+func TestSerialCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fconf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	l, err := audit.Open(filepath.Join(dir, "audit.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = l.Close() }()
+	m := device.New()
+	m.Open = device.NewEmulator("356789012345678", "640050123456789").Open
+	err = m.AddPort("/dev/ttyUSB0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ww := &web{cfg: defaultConfig(), manager: m, audit: l}
+	router := mux.NewRouter()
+	router.HandleFunc("/serial/{imei}/at", ww.SerialCommand)
+	run := func(imei, body string) (int, map[string]interface{}) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", "/serial/"+imei+"/at", strings.NewReader(body)))
+		var out map[string]interface{}
+		_ = json.NewDecoder(w.Body).Decode(&out)
+		return w.Code, out
+	}
+
+	code, out := run("356789012345678", `{"command":"AT+CSQ"}`)
+	if code != http.StatusOK || out["result"] != "OK" {
+		t.Errorf("expected the answer got %d %v", code, out)
+	}
+	if code, _ := run("356789012345678", `{"command":"AT+CSQ\rAT+CFUN=0"}`); code != http.StatusBadRequest {
+		t.Errorf("expected two commands to be refused got %d", code)
+	}
+	if code, _ := run("356789012345670", `{"command":"AT"}`); code != http.StatusNotFound {
+		t.Errorf("expected an unknown modem got %d", code)
+	}
+	entries, err := l.Query(&audit.Filter{Action: audit.ATCommand})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Before != "AT+CSQ" || !strings.Contains(entries[0].After, "+CSQ: 18,99") {
+		t.Errorf("unexpected audit entries %+v", entries)
+	}
+}
+
+func TestSerialModem(t *testing.T) {
+	m := device.New()
+	m.Open = device.NewEmulator("356789012345678", "640050123456789").Open
+	err := m.AddPort("/dev/ttyUSB0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ww := &web{cfg: defaultConfig(), manager: m}
+	router := mux.NewRouter()
+	router.HandleFunc("/serial/{imei}", ww.SerialModem)
+	get := func(imei string) (int, map[string]interface{}) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/serial/"+imei, nil))
+		var out map[string]interface{}
+		_ = json.NewDecoder(w.Body).Decode(&out)
+		return w.Code, out
+	}
+	code, out := get("356789012345678")
+	if code != http.StatusOK || out["model"] != "E173" || out["pin"] != "READY" || out["dbm"] != -77.0 {
+		t.Errorf("expected the modem got %d %v", code, out)
+	}
+	if code, _ := get("356789012345670"); code != http.StatusNotFound {
+		t.Errorf("expected an unknown modem got %d", code)
+	}
+}
+
+func TestSerialHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fconf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	h, err := history.Open(dir, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = h.Close() }()
+	from := time.Now().Add(-time.Hour).Truncate(time.Minute)
+	for i, signal := range []int{10, 20, 99, 18} {
+		err = h.Record(history.Sample{Time: from.Add(time.Duration(i) * 10 * time.Minute), IMEI: "356789012345678", Signal: signal, Registration: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	ww := &web{cfg: defaultConfig(), history: h}
+	router := mux.NewRouter()
+	router.HandleFunc("/serial/{imei}/history", ww.SerialHistory)
+	get := func(query string) (int, []history.Point) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/serial/356789012345678/history?"+query, nil))
+		var out struct {
+			Points []history.Point `json:"points"`
+		}
+		_ = json.NewDecoder(w.Body).Decode(&out)
+		return w.Code, out.Points
+	}
+	code, points := get("")
+	if code != http.StatusOK || len(points) != 4 {
+		t.Errorf("expected every sample of the last day got %d %+v", code, points)
+	}
+	code, points = get("from=" + from.Format(time.RFC3339) + "&step=30m")
+	if code != http.StatusOK || len(points) != 2 || points[0].Samples != 3 || points[0].Signal.Max != 20 {
+		t.Errorf("expected two steps got %d %+v", code, points)
+	}
+	if code, _ := get("step=1s&from=2020-01-01T00:00:00Z"); code != http.StatusBadRequest {
+		t.Errorf("expected too many steps to be refused got %d", code)
+	}
+	if code, _ := get("from=yesterday"); code != http.StatusBadRequest {
+		t.Errorf("expected a bad timestamp to be refused got %d", code)
+	}
+
+	start := time.Now().Add(-3 * time.Hour)
+	for i := 0; i <= maxPoints; i++ {
+		err = h.Record(history.Sample{Time: start.Add(time.Duration(i) * time.Second), IMEI: "356789012345679", Signal: 15, Registration: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/serial/356789012345679/history", nil))
+	var out struct {
+		Step   string          `json:"step"`
+		Points []history.Point `json:"points"`
+	}
+	_ = json.NewDecoder(w.Body).Decode(&out)
+	if w.Code != http.StatusOK || out.Step != "9s" || len(out.Points) == 0 || len(out.Points) > maxPoints {
+		t.Errorf("expected the samples summed up in steps got %d %s %d points", w.Code, out.Step, len(out.Points))
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/FarmRadioHangar/fessboxconfig/audit"
+	"github.com/FarmRadioHangar/fessboxconfig/device"
+	"github.com/FarmRadioHangar/fessboxconfig/sms"
+	"github.com/gorilla/mux"
+)
+
+// smsRequest is the body of a request to send a text message. Class is from
+// 0 to 3 and Validity a duration like 24h, both are optional.
+type smsRequest struct {
+	Number   string `json:"number"`
+	Text     string `json:"text"`
+	Class    *int   `json:"class"`
+	Validity string `json:"validity"`
+}
+
+// message returns the message to send, or an error saying what is wrong with
+// the request.
+func (req *smsRequest) message() (sms.Message, error) {
+	msg := sms.Message{Type: sms.Submit, Number: req.Number, Text: req.Text}
+	if req.Number == "" || req.Text == "" {
+		return msg, errors.New("expected a number and a text")
+	}
+	if c := req.Class; c != nil {
+		if *c < 0 || *c > 3 {
+			return msg, fmt.Errorf("class must be from 0 to 3, got %d", *c)
+		}
+		msg.Class = sms.Class0 + sms.Class(*c)
+	}
+	if req.Validity != "" {
+		d, err := time.ParseDuration(req.Validity)
+		if err != nil || d <= 0 {
+			return msg, fmt.Errorf("validity must be a positive duration like 24h, got %q", req.Validity)
+		}
+		msg.Validity = d
+	}
+	_, err := sms.Split(msg, 0)
+	return msg, err
+}
+
+// SendSMS takes a json object like {"number": "+255700000001", "text": "Habari"}
+// and sends the text with the modem with the imei in the url. It serves the
+// references of the parts sent, and records the message in the audit log.
+func (ww *web) SendSMS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	if ww.manager == nil {
+		w.WriteHeader(http.StatusNotFound)
+		_ = enc.Encode(&errMSG{"device detection is off"})
+		return
+	}
+	var req smsRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = enc.Encode(&errMSG{"expected a json object with a number and a text"})
+		return
+	}
+	msg, err := req.message()
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = enc.Encode(&errMSG{err.Error()})
+		return
+	}
+	imei := mux.Vars(r)["imei"]
+	refs, err := ww.manager.SendSMS(r.Context(), imei, msg)
+	ww.recordEntry(r, audit.Entry{
+		Action: audit.SMSSend,
+		Target: imei,
+		After:  req.Number,
+	}, err)
+	if err != nil {
+		modemError(w, err)
+		return
+	}
+	_ = enc.Encode(map[string][]int{"references": refs})
+}
+
+// Inbox serves the text messages stored in the SIM of the modem with the imei
+// in the url, the parts of the long messages put together.
+func (ww *web) Inbox(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if ww.manager == nil {
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(&errMSG{"device detection is off"})
+		return
+	}
+	list, err := ww.manager.Inbox(r.Context(), mux.Vars(r)["imei"])
+	if err != nil {
+		modemError(w, err)
+		return
+	}
+	if list == nil {
+		list = []device.SMS{}
+	}
+	_ = json.NewEncoder(w).Encode(list)
+}
+
+// ReadSMS serves the text message stored at the index in the url.
+func (ww *web) ReadSMS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	index, err := strconv.Atoi(mux.Vars(r)["index"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = enc.Encode(&errMSG{"the index must be a number"})
+		return
+	}
+	if ww.manager == nil {
+		w.WriteHeader(http.StatusNotFound)
+		_ = enc.Encode(&errMSG{"device detection is off"})
+		return
+	}
+	v, err := ww.manager.ReadSMS(r.Context(), mux.Vars(r)["imei"], index)
+	if err != nil {
+		modemError(w, err)
+		return
+	}
+	_ = enc.Encode(v)
+}
+
+// DeleteSMS deletes the text message stored at the index in the url, with the
+// other parts of the message when it is a long one. The deletion is recorded
+// in the audit log.
+func (ww *web) DeleteSMS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	index, err := strconv.Atoi(mux.Vars(r)["index"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = enc.Encode(&errMSG{"the index must be a number"})
+		return
+	}
+	if ww.manager == nil {
+		w.WriteHeader(http.StatusNotFound)
+		_ = enc.Encode(&errMSG{"device detection is off"})
+		return
+	}
+	imei := mux.Vars(r)["imei"]
+	list, err := ww.manager.Inbox(r.Context(), imei)
+	if err != nil {
+		modemError(w, err)
+		return
+	}
+	indexes := []int{index}
+	e := audit.Entry{Action: audit.SMSDelete, Target: imei}
+	for _, v := range list {
+		for _, i := range v.Indexes {
+			if i == index {
+				indexes = v.Indexes
+				e.Before = v.Number
+			}
+		}
+	}
+	for _, i := range indexes {
+		err = ww.manager.DeleteSMS(r.Context(), imei, i)
+		if err != nil {
+			break
+		}
+	}
+	ww.recordEntry(r, e, err)
+	if err != nil {
+		modemError(w, err)
+		return
+	}
+	_ = enc.Encode(map[string][]int{"deleted": indexes})
+}
+
+// modemError writes the error of a modem with a status telling whether the
+// modem is unknown, too slow or refused.
+func modemError(w http.ResponseWriter, err error) {
+	switch err {
+	case device.ErrNoModem:
+		w.WriteHeader(http.StatusNotFound)
+	case device.ErrTimeout:
+		w.WriteHeader(http.StatusGatewayTimeout)
+	case device.ErrUSSDBusy:
+		w.WriteHeader(http.StatusConflict)
+	default:
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	_ = json.NewEncoder(w).Encode(&errMSG{err.Error()})
+}
@@ -0,0 +1,125 @@
+package sms
+
+import "unicode/utf8"
+
+// escape switches to the extension table for the next septet.
+const escape = 0x1b
+
+// gsm7 is the GSM 7 bit default alphabet of 3GPP TS 23.038, the septet is the
+// index. The escape septet is kept as a space, it never decodes on its own.
+var gsm7 = [128]rune{
+	'@', '£', '$', '¥', 'è', 'é', 'ù', 'ì', 'ò', 'Ç', '\n', 'Ø', 'ø', '\r', 'Å', 'å',
+	'Δ', '_', 'Φ', 'Γ', 'Λ', 'Ω', 'Π', 'Ψ', 'Σ', 'Θ', 'Ξ', ' ', 'Æ', 'æ', 'ß', 'É',
+	' ', '!', '"', '#', '¤', '%', '&', '\'', '(', ')', '*', '+', ',', '-', '.', '/',
+	'0', '1', '2', '3', '4', '5', '6', '7', '8', '9', ':', ';', '<', '=', '>', '?',
+	'¡', 'A', 'B', 'C', 'D', 'E', 'F', 'G', 'H', 'I', 'J', 'K', 'L', 'M', 'N', 'O',
+	'P', 'Q', 'R', 'S', 'T', 'U', 'V', 'W', 'X', 'Y', 'Z', 'Ä', 'Ö', 'Ñ', 'Ü', '§',
+	'¿', 'a', 'b', 'c', 'd', 'e', 'f', 'g', 'h', 'i', 'j', 'k', 'l', 'm', 'n', 'o',
+	'p', 'q', 'r', 's', 't', 'u', 'v', 'w', 'x', 'y', 'z', 'ä', 'ö', 'ñ', 'ü', 'à',
+}
+
+// gsm7Ext is the default extension table, the characters that take an escape
+// septet followed by the key.
+var gsm7Ext = map[byte]rune{
+	0x0a: '\f',
+	0x14: '^',
+	0x28: '{',
+	0x29: '}',
+	0x2f: '\\',
+	0x3c: '[',
+	0x3d: '~',
+	0x3e: ']',
+	0x40: '|',
+	0x65: '€',
+}
+
+// The reverse tables, built from the ones above.
+var (
+	gsm7Index    = make(map[rune]byte)
+	gsm7ExtIndex = make(map[rune]byte)
+)
+
+func init() {
+	for i, r := range gsm7 {
+		if i != escape {
+			gsm7Index[r] = byte(i)
+		}
+	}
+	for k, r := range gsm7Ext {
+		gsm7ExtIndex[r] = k
+	}
+}
+
+// GSM7Septets returns the septets of text in the GSM 7 bit alphabet, ok is
+// false if text has characters missing from the alphabet and its extension
+// table.
+func GSM7Septets(text string) (septets []byte, ok bool) {
+	for _, r := range text {
+		if s, found := gsm7Index[r]; found {
+			septets = append(septets, s)
+			continue
+		}
+		if s, found := gsm7ExtIndex[r]; found {
+			septets = append(septets, escape, s)
+			continue
+		}
+		return nil, false
+	}
+	return septets, true
+}
+
+// GSM7Text returns the text of the septets. An escape followed by a septet
+// missing from the extension table gives the character of the default
+// alphabet as the standard asks.
+func GSM7Text(septets []byte) string {
+	b := make([]byte, 0, len(septets))
+	for i := 0; i < len(septets); i++ {
+		s := septets[i] & 0x7f
+		if s == escape && i+1 < len(septets) {
+			i++
+			next := septets[i] & 0x7f
+			if r, ok := gsm7Ext[next]; ok {
+				b = utf8.AppendRune(b, r)
+				continue
+			}
+			s = next
+		}
+		b = utf8.AppendRune(b, gsm7[s])
+	}
+	return string(b)
+}
+
+// Pack packs the septets eight per seven octets, the first one in the low bits
+// as done in the user data of a PDU.
+func Pack(septets []byte) []byte {
+	out := make([]byte, (len(septets)*7+7)/8)
+	for i, s := range septets {
+		s &= 0x7f
+		bit := i * 7
+		n, shift := bit/8, uint(bit%8)
+		out[n] |= s << shift
+		if shift > 1 {
+			out[n+1] |= s >> (8 - shift)
+		}
+	}
+	return out
+}
+
+// Unpack returns the first n septets packed in b, it stops early if b is too
+// short.
+func Unpack(b []byte, n int) []byte {
+	if max := len(b) * 8 / 7; n > max {
+		n = max
+	}
+	septets := make([]byte, n)
+	for i := range septets {
+		bit := i * 7
+		k, shift := bit/8, uint(bit%8)
+		v := b[k] >> shift
+		if shift > 1 {
+			v |= b[k+1] << (8 - shift)
+		}
+		septets[i] = v & 0x7f
+	}
+	return septets
+}
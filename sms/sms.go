@@ -0,0 +1,703 @@
+// Package sms encodes and decodes the PDUs of text messages as defined by 3GPP
+// TS 23.040, the form the modems take them in with AT+CMGF=0.
+//
+// A PDU starts with the address of the service centre followed by the TPDU,
+// an SMS-SUBMIT for the messages sent and an SMS-DELIVER for the ones
+// received. The text is in the GSM 7 bit alphabet when it fits, in UCS-2
+// otherwise, and long texts are sent as several concatenated messages.
+package sms
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// Type is the kind of a message, the message type indicator of the TPDU.
+type Type int
+
+// The types of messages.
+const (
+	Deliver Type = 0
+	Submit  Type = 1
+)
+
+// Encoding is the alphabet of the user data.
+type Encoding int
+
+// The encodings, Auto picks GSM7 when the text fits and UCS2 otherwise.
+const (
+	Auto Encoding = iota
+	GSM7
+	Data8
+	UCS2
+)
+
+// Class is the message class, Class0 messages are shown right away and not
+// stored, like flash messages.
+type Class int
+
+// The classes, NoClass leaves it to the phone.
+const (
+	NoClass Class = iota
+	Class0
+	Class1
+	Class2
+	Class3
+)
+
+// The lengths of the user data in octets, the text of one message fits in 160
+// GSM 7 bit characters or 70 UCS-2 ones.
+const (
+	maxUserData = 140
+	concatUDH   = 6
+)
+
+// ErrTooLong is returned when encoding a message whose text does not fit in
+// one PDU, Split cuts it in parts that do.
+var ErrTooLong = errors.New("sms: the text does not fit in one message")
+
+// Concat identifies a part of a concatenated message. Ref is the same for all
+// the parts, Seq counts from 1 to Total.
+type Concat struct {
+	Ref   int `json:"ref"`
+	Total int `json:"total"`
+	Seq   int `json:"seq"`
+}
+
+// Message is an SMS-SUBMIT or an SMS-DELIVER.
+type Message struct {
+	Type Type
+
+	// SMSC is the number of the service centre, empty for the one set in the
+	// SIM.
+	SMSC string
+
+	// Number is the recipient of a submit and the sender of a deliver. It
+	// starts with + when international, senders can also be names.
+	Number string
+
+	// Reference is the message reference of a submit, the modem sets it
+	// when it is 0.
+	Reference int
+
+	// Time is when the service centre got a deliver.
+	Time time.Time
+
+	// Validity is how long the service centre keeps trying to deliver a
+	// submit, 0 for its default. It is rounded up to the next value that can
+	// be encoded.
+	Validity time.Duration
+
+	// StatusReport asks for a status report of a submit.
+	StatusReport bool
+
+	Class    Class
+	Encoding Encoding
+	Concat   *Concat
+
+	// Text is the content, Data is used instead for 8 bit messages.
+	Text string
+	Data []byte
+}
+
+// Encode returns the PDU of the message, Encoding Auto is resolved for the
+// text. It fails with ErrTooLong if the text does not fit.
+func (m *Message) Encode() ([]byte, error) {
+	enc, ud, udl, err := m.userData()
+	if err != nil {
+		return nil, err
+	}
+	smsc, err := encodeSMSC(m.SMSC)
+	if err != nil {
+		return nil, err
+	}
+	b := append([]byte(nil), smsc...)
+	first := byte(m.Type)
+	if m.Concat != nil {
+		first |= 0x40
+	}
+	switch m.Type {
+	case Submit:
+		if m.Validity > 0 {
+			first |= 0x10
+		}
+		if m.StatusReport {
+			first |= 0x20
+		}
+		b = append(b, first, byte(m.Reference))
+	case Deliver:
+		// no more messages are waiting in the service centre
+		first |= 0x04
+		if m.StatusReport {
+			first |= 0x20
+		}
+		b = append(b, first)
+	default:
+		return nil, fmt.Errorf("sms: can not encode message type %d", m.Type)
+	}
+	addr, err := encodeAddress(m.Number)
+	if err != nil {
+		return nil, err
+	}
+	b = append(b, addr...)
+	b = append(b, 0, dcs(enc, m.Class))
+	switch m.Type {
+	case Submit:
+		if m.Validity > 0 {
+			b = append(b, relativeValidity(m.Validity))
+		}
+	case Deliver:
+		t := m.Time
+		if t.IsZero() {
+			t = time.Now()
+		}
+		b = append(b, encodeTime(t)...)
+	}
+	b = append(b, byte(udl))
+	return append(b, ud...), nil
+}
+
+// userData returns the encoding, the user data and its length, in septets for
+// GSM 7 bit and in octets otherwise.
+func (m *Message) userData() (Encoding, []byte, int, error) {
+	var header []byte
+	if c := m.Concat; c != nil {
+		if c.Ref > 0xff {
+			header = []byte{6, 0x08, 4, byte(c.Ref >> 8), byte(c.Ref), byte(c.Total), byte(c.Seq)}
+		} else {
+			header = []byte{5, 0x00, 3, byte(c.Ref), byte(c.Total), byte(c.Seq)}
+		}
+	}
+	enc := m.Encoding
+	var septets []byte
+	switch enc {
+	case Auto, GSM7:
+		var ok bool
+		septets, ok = GSM7Septets(m.Text)
+		switch {
+		case ok:
+			enc = GSM7
+		case enc == GSM7:
+			return enc, nil, 0, fmt.Errorf("sms: %q has characters missing from the GSM 7 bit alphabet", m.Text)
+		default:
+			enc = UCS2
+		}
+	}
+	switch enc {
+	case GSM7:
+		// the text starts on a septet boundary after the header
+		skip := (len(header)*8 + 6) / 7
+		if (skip+len(septets))*7 > maxUserData*8 {
+			return enc, nil, 0, ErrTooLong
+		}
+		ud := Pack(append(make([]byte, skip), septets...))
+		copy(ud, header)
+		return enc, ud, skip + len(septets), nil
+	case Data8:
+		ud := append(header, m.Data...)
+		if len(ud) > maxUserData {
+			return enc, nil, 0, ErrTooLong
+		}
+		return enc, ud, len(ud), nil
+	case UCS2:
+		ud := append(header, encodeUCS2(m.Text)...)
+		if len(ud) > maxUserData {
+			return enc, nil, 0, ErrTooLong
+		}
+		return enc, ud, len(ud), nil
+	}
+	return enc, nil, 0, fmt.Errorf("sms: unknown encoding %d", enc)
+}
+
+// dcs returns the data coding scheme of the general data coding group.
+func dcs(enc Encoding, class Class) byte {
+	var b byte
+	switch enc {
+	case Data8:
+		b = 0x04
+	case UCS2:
+		b = 0x08
+	}
+	if class != NoClass {
+		b |= 0x10 | byte(class-Class0)
+	}
+	return b
+}
+
+// Decode returns the message of the PDU, which starts with the service centre
+// like the PDUs listed by AT+CMGL.
+func Decode(pdu []byte) (*Message, error) {
+	r := &reader{b: pdu}
+	m := &Message{}
+	n := int(r.byte())
+	m.SMSC = decodeNumber(r.bytes(n))
+	first := r.byte()
+	m.Type = Type(first & 0x03)
+	if m.Type != Deliver && m.Type != Submit {
+		return nil, fmt.Errorf("sms: unsupported message type %d", m.Type)
+	}
+	m.StatusReport = first&0x20 != 0
+	if m.Type == Submit {
+		m.Reference = int(r.byte())
+	}
+	digits := int(r.byte())
+	toa := r.byte()
+	m.Number = decodeAddress(toa, digits, r.bytes((digits+1)/2))
+	r.byte() // protocol identifier
+	enc, class, err := decodeDCS(r.byte())
+	if err != nil {
+		return nil, err
+	}
+	m.Encoding, m.Class = enc, class
+	if m.Type == Submit {
+		switch (first >> 3) & 0x03 {
+		case 2:
+			m.Validity = decodeValidity(r.byte())
+		case 1, 3:
+			// enhanced and absolute validities are not kept
+			r.bytes(7)
+		}
+	} else {
+		m.Time = decodeTime(r.bytes(7))
+	}
+	udl := int(r.byte())
+	ud := r.rest()
+	if r.err != nil {
+		return nil, r.err
+	}
+	var skip int
+	if first&0x40 != 0 && len(ud) > 0 {
+		hl := int(ud[0]) + 1
+		if hl > len(ud) {
+			return nil, errors.New("sms: the user data header is too long")
+		}
+		m.Concat = decodeConcat(ud[1:hl])
+		skip = hl
+	}
+	switch enc {
+	case GSM7:
+		septets := Unpack(ud, udl)
+		h := (skip*8 + 6) / 7
+		if h > len(septets) {
+			h = len(septets)
+		}
+		m.Text = GSM7Text(septets[h:])
+	case UCS2:
+		if udl > len(ud) {
+			udl = len(ud)
+		}
+		m.Text = decodeUCS2(ud[skip:udl])
+	default:
+		if udl > len(ud) {
+			udl = len(ud)
+		}
+		m.Data = append([]byte(nil), ud[skip:udl]...)
+	}
+	return m, nil
+}
+
+// decodeDCS returns the encoding and the class of a data coding scheme.
+func decodeDCS(b byte) (Encoding, Class, error) {
+	class := NoClass
+	switch {
+	case b&0x80 == 0x00:
+		if b&0x20 != 0 {
+			return 0, 0, errors.New("sms: compressed messages are not supported")
+		}
+		if b&0x10 != 0 {
+			class = Class0 + Class(b&0x03)
+		}
+		switch (b >> 2) & 0x03 {
+		case 1:
+			return Data8, class, nil
+		case 2:
+			return UCS2, class, nil
+		}
+		return GSM7, class, nil
+	case b&0xf0 == 0xf0:
+		class = Class0 + Class(b&0x03)
+		if b&0x04 != 0 {
+			return Data8, class, nil
+		}
+		return GSM7, class, nil
+	case b&0xf0 == 0xe0:
+		// message waiting indication with UCS-2 text
+		return UCS2, class, nil
+	}
+	return GSM7, class, nil
+}
+
+// decodeConcat returns the concatenation found in the information elements of
+// a user data header.
+func decodeConcat(h []byte) *Concat {
+	for len(h) >= 2 {
+		id, n := h[0], int(h[1])
+		if 2+n > len(h) {
+			return nil
+		}
+		v := h[2 : 2+n]
+		switch {
+		case id == 0x00 && n == 3:
+			return &Concat{Ref: int(v[0]), Total: int(v[1]), Seq: int(v[2])}
+		case id == 0x08 && n == 4:
+			return &Concat{Ref: int(v[0])<<8 | int(v[1]), Total: int(v[2]), Seq: int(v[3])}
+		}
+		h = h[2+n:]
+	}
+	return nil
+}
+
+// Split returns the parts of m that each fit in one PDU, or m alone when it
+// fits. The parts share the concatenation reference ref, the text is cut so
+// escaped characters and surrogate pairs stay whole.
+func Split(m Message, ref int) ([]Message, error) {
+	m.Concat = nil
+	if _, err := m.Encode(); err != ErrTooLong {
+		if err != nil {
+			return nil, err
+		}
+		return []Message{m}, nil
+	}
+	enc := m.Encoding
+	if enc == Auto {
+		enc = UCS2
+		if _, ok := GSM7Septets(m.Text); ok {
+			enc = GSM7
+		}
+	}
+	header := concatUDH
+	if ref > 0xff {
+		header++
+	}
+	var chunks []string
+	var data [][]byte
+	switch enc {
+	case GSM7:
+		chunks = cut(m.Text, (maxUserData*8-((header*8+6)/7)*7)/7, func(r rune) int {
+			if _, ok := gsm7ExtIndex[r]; ok {
+				return 2
+			}
+			return 1
+		})
+	case UCS2:
+		chunks = cut(m.Text, (maxUserData-header)/2, func(r rune) int {
+			return len(utf16.Encode([]rune{r}))
+		})
+	case Data8:
+		for b := m.Data; len(b) > 0; {
+			n := maxUserData - header
+			if n > len(b) {
+				n = len(b)
+			}
+			data = append(data, b[:n])
+			b = b[n:]
+		}
+	}
+	total := len(chunks) + len(data)
+	if total > 0xff {
+		return nil, errors.New("sms: the text needs more than 255 messages")
+	}
+	parts := make([]Message, total)
+	for i := range parts {
+		p := m
+		p.Encoding = enc
+		p.Concat = &Concat{Ref: ref, Total: total, Seq: i + 1}
+		if chunks != nil {
+			p.Text = chunks[i]
+		} else {
+			p.Data = data[i]
+		}
+		parts[i] = p
+	}
+	return parts, nil
+}
+
+// cut cuts text in chunks of at most max units, size gives the units taken by
+// each character.
+func cut(text string, max int, size func(rune) int) []string {
+	var chunks []string
+	var b strings.Builder
+	n := 0
+	for _, r := range text {
+		s := size(r)
+		if n+s > max {
+			chunks = append(chunks, b.String())
+			b.Reset()
+			n = 0
+		}
+		b.WriteRune(r)
+		n += s
+	}
+	return append(chunks, b.String())
+}
+
+// Join puts the parts of a concatenated message back together, ok is false if
+// some parts are missing. The parts can be in any order, the first one gives
+// the fields other than the text.
+func Join(parts []*Message) (m *Message, ok bool) {
+	if len(parts) == 0 {
+		return nil, false
+	}
+	sorted := append([]*Message(nil), parts...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return seq(sorted[i]) < seq(sorted[j])
+	})
+	joined := *sorted[0]
+	joined.Text, joined.Data = "", nil
+	ok = true
+	for i, p := range sorted {
+		joined.Text += p.Text
+		joined.Data = append(joined.Data, p.Data...)
+		if p.Concat == nil || p.Concat.Seq != i+1 || p.Concat.Total != len(sorted) {
+			ok = false
+		}
+	}
+	if len(sorted) == 1 && sorted[0].Concat == nil {
+		ok = true
+	}
+	return &joined, ok
+}
+
+func seq(m *Message) int {
+	if m.Concat == nil {
+		return 0
+	}
+	return m.Concat.Seq
+}
+
+// Length returns the length of the TPDU of pdu in octets, the service centre
+// left out, as given to AT+CMGS.
+func Length(pdu []byte) int {
+	if len(pdu) == 0 {
+		return 0
+	}
+	return len(pdu) - 1 - int(pdu[0])
+}
+
+// encodeSMSC returns the service centre address with its length in octets.
+func encodeSMSC(number string) ([]byte, error) {
+	if number == "" {
+		return []byte{0}, nil
+	}
+	addr, err := encodeAddress(number)
+	if err != nil {
+		return nil, err
+	}
+	addr[0] = byte(len(addr) - 1)
+	return addr, nil
+}
+
+// encodeAddress returns the address of a number, its length in digits, its
+// type and its digits in swapped semi octets.
+func encodeAddress(number string) ([]byte, error) {
+	toa := byte(0x81)
+	if strings.HasPrefix(number, "+") {
+		toa = 0x91
+		number = number[1:]
+	}
+	if number == "" {
+		return nil, errors.New("sms: missing number")
+	}
+	b := []byte{byte(len(number)), toa}
+	for i := 0; i < len(number); i += 2 {
+		lo, err := semiOctet(number[i])
+		if err != nil {
+			return nil, err
+		}
+		hi := byte(0x0f)
+		if i+1 < len(number) {
+			hi, err = semiOctet(number[i+1])
+			if err != nil {
+				return nil, err
+			}
+		}
+		b = append(b, hi<<4|lo)
+	}
+	return b, nil
+}
+
+func semiOctet(c byte) (byte, error) {
+	switch {
+	case c >= '0' && c <= '9':
+		return c - '0', nil
+	case c == '*':
+		return 0x0a, nil
+	case c == '#':
+		return 0x0b, nil
+	}
+	return 0, fmt.Errorf("sms: %q is not a digit of a phone number", c)
+}
+
+// decodeAddress returns the number of an address, alphanumeric ones are in
+// GSM 7 bit.
+func decodeAddress(toa byte, digits int, b []byte) string {
+	if toa&0x70 == 0x50 {
+		return GSM7Text(Unpack(b, digits*4/7))
+	}
+	s := semiOctets(b)
+	if digits < len(s) {
+		s = s[:digits]
+	}
+	if toa&0x70 == 0x10 {
+		return "+" + s
+	}
+	return s
+}
+
+// decodeNumber returns the number of a service centre address, its type
+// followed by its digits.
+func decodeNumber(b []byte) string {
+	if len(b) == 0 {
+		return ""
+	}
+	s := strings.TrimRight(semiOctets(b[1:]), "F")
+	if b[0]&0x70 == 0x10 {
+		return "+" + s
+	}
+	return s
+}
+
+func semiOctets(b []byte) string {
+	const digits = "0123456789*#abcF"
+	s := make([]byte, 0, 2*len(b))
+	for _, v := range b {
+		s = append(s, digits[v&0x0f])
+		if v>>4 != 0x0f {
+			s = append(s, digits[v>>4])
+		}
+	}
+	return string(s)
+}
+
+// encodeTime returns the service centre time stamp of t, swapped semi octets
+// for the year, month, day, hours, minutes, seconds and the zone in quarters
+// of an hour.
+func encodeTime(t time.Time) []byte {
+	_, offset := t.Zone()
+	zone := offset / (15 * 60)
+	neg := zone < 0
+	if neg {
+		zone = -zone
+	}
+	b := []byte{
+		swapped(t.Year() % 100), swapped(int(t.Month())), swapped(t.Day()),
+		swapped(t.Hour()), swapped(t.Minute()), swapped(t.Second()), swapped(zone),
+	}
+	if neg {
+		b[6] |= 0x08
+	}
+	return b
+}
+
+func decodeTime(b []byte) time.Time {
+	if len(b) < 7 {
+		return time.Time{}
+	}
+	v := make([]int, 7)
+	for i, o := range b {
+		v[i] = int(o&0x0f)*10 + int(o>>4)
+	}
+	zone := int(b[6]&0x07)*10 + int(b[6]>>4)
+	if b[6]&0x08 != 0 {
+		zone = -zone
+	}
+	loc := time.FixedZone("", zone*15*60)
+	return time.Date(2000+v[0], time.Month(v[1]), v[2], v[3], v[4], v[5], 0, loc)
+}
+
+func swapped(n int) byte {
+	return byte(n%10)<<4 | byte(n/10)
+}
+
+// relativeValidity returns the relative validity period of d, the smallest
+// one that is not shorter.
+func relativeValidity(d time.Duration) byte {
+	const day = 24 * time.Hour
+	var n time.Duration
+	switch {
+	case d <= 12*time.Hour:
+		n = (d+5*time.Minute-1)/(5*time.Minute) - 1
+	case d <= day:
+		n = 143 + (d-12*time.Hour+30*time.Minute-1)/(30*time.Minute)
+	case d <= 30*day:
+		n = 166 + (d+day-1)/day
+	default:
+		n = 192 + (d+7*day-1)/(7*day)
+	}
+	if n < 0 {
+		n = 0
+	}
+	if n > 255 {
+		n = 255
+	}
+	return byte(n)
+}
+
+func decodeValidity(b byte) time.Duration {
+	const day = 24 * time.Hour
+	n := time.Duration(b)
+	switch {
+	case b <= 143:
+		return (n + 1) * 5 * time.Minute
+	case b <= 167:
+		return 12*time.Hour + (n-143)*30*time.Minute
+	case b <= 196:
+		return (n - 166) * day
+	}
+	return (n - 192) * 7 * day
+}
+
+func encodeUCS2(text string) []byte {
+	u := utf16.Encode([]rune(text))
+	b := make([]byte, 0, 2*len(u))
+	for _, v := range u {
+		b = append(b, byte(v>>8), byte(v))
+	}
+	return b
+}
+
+func decodeUCS2(b []byte) string {
+	u := make([]uint16, len(b)/2)
+	for i := range u {
+		u[i] = uint16(b[2*i])<<8 | uint16(b[2*i+1])
+	}
+	return string(utf16.Decode(u))
+}
+
+// reader reads the fields of a PDU, reading past its end sets err.
+type reader struct {
+	b   []byte
+	err error
+}
+
+func (r *reader) byte() byte {
+	b := r.bytes(1)
+	if len(b) == 0 {
+		return 0
+	}
+	return b[0]
+}
+
+func (r *reader) bytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n > len(r.b) {
+		r.err = errors.New("sms: the pdu is too short")
+		r.b = nil
+		return nil
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
+
+func (r *reader) rest() []byte {
+	b := r.b
+	r.b = nil
+	return b
+}
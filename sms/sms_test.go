@@ -0,0 +1,168 @@
+package sms
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestEncodeSubmit(t *testing.T) {
+	m := &Message{Type: Submit, Number: "+46708251358", Validity: 4 * 24 * time.Hour, Text: "hellohello"}
+	pdu, err := m.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := "0011000B916407281553F80000AA0AE8329BFD4697D9EC37"
+	if s := strings.ToUpper(hex.EncodeToString(pdu)); s != expect {
+		t.Errorf("expected %s got %s", expect, s)
+	}
+	if n := Length(pdu); n != 23 {
+		t.Errorf("expected a tpdu of 23 octets got %d", n)
+	}
+	d, err := Decode(pdu)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Type != Submit || d.Number != "+46708251358" || d.Validity != 4*24*time.Hour || d.Text != "hellohello" {
+		t.Errorf("unexpected message %+v", d)
+	}
+}
+
+func TestDecodeDeliver(t *testing.T) {
+	m, err := Decode(unhex(t, "07911326040000F0040B911346610089F60000208062917314800CC8F71D14969741F977FD07"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Type != Deliver || m.SMSC != "+31624000000" || m.Number != "+31641600986" || m.Text != "How are you?" {
+		t.Errorf("unexpected message %+v", m)
+	}
+	when := time.Date(2002, 8, 26, 19, 37, 41, 0, time.FixedZone("", 2*3600))
+	if !m.Time.Equal(when) {
+		t.Errorf("expected %v got %v", when, m.Time)
+	}
+
+	// an alphanumeric sender with a UCS-2 text
+	m, err = Decode(unhex(t, "07915892000000F0040CD0C7F7FBCC2E03000841101121235300084F60597D4E16754C"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Number != "Google" || m.Encoding != UCS2 || m.Text != "你好世界" {
+		t.Errorf("unexpected message %+v", m)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	when := time.Date(2026, 10, 19, 9, 12, 3, 0, time.FixedZone("", -3*3600))
+	sample := []Message{
+		{Type: Deliver, SMSC: "+255754000000", Number: "+255700000001", Time: when, Text: "Salio: 1,000 TZS [ok] €5 {x} ~^|\\"},
+		{Type: Deliver, Number: "0700000001", Time: when, Class: Class0, Text: "flash"},
+		{Type: Deliver, Number: "+255700000001", Time: when, Text: "Habari 😀 ça va"},
+		{Type: Submit, Number: "+255700000001", Reference: 7, StatusReport: true, Validity: 30 * time.Minute, Class: Class1, Text: "hi"},
+		{Type: Submit, Number: "*150#", Encoding: Data8, Data: []byte{0, 1, 2, 0xff}},
+		{Type: Submit, Number: "+255700000001", Encoding: GSM7, Concat: &Concat{Ref: 300, Total: 2, Seq: 2}, Text: "part two"},
+	}
+	for _, m := range sample {
+		pdu, err := m.Encode()
+		if err != nil {
+			t.Fatalf("%+v: %v", m, err)
+		}
+		d, err := Decode(pdu)
+		if err != nil {
+			t.Fatalf("%+v: %v", m, err)
+		}
+		if m.Encoding == Auto {
+			d.Encoding = Auto
+		}
+		if d.Type != m.Type || d.SMSC != m.SMSC || d.Number != m.Number || d.Text != m.Text ||
+			!bytes.Equal(d.Data, m.Data) || d.Class != m.Class || d.Encoding != m.Encoding ||
+			d.Reference != m.Reference || d.StatusReport != m.StatusReport || d.Validity != m.Validity {
+			t.Errorf("expected %+v got %+v", m, d)
+		}
+		if m.Type == Deliver && !d.Time.Equal(m.Time) {
+			t.Errorf("expected %v got %v", m.Time, d.Time)
+		}
+		if (m.Concat == nil) != (d.Concat == nil) || m.Concat != nil && *m.Concat != *d.Concat {
+			t.Errorf("expected %+v got %+v", m.Concat, d.Concat)
+		}
+	}
+}
+
+func TestSplit(t *testing.T) {
+	long := strings.Repeat("hello world ", 20)
+	parts, err := Split(Message{Type: Submit, Number: "+255700000001", Text: long}, 0xcc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parts) != 2 || len(parts[0].Text) != 153 {
+		t.Fatalf("expected 153 characters in the first of two parts got %d parts", len(parts))
+	}
+	var decoded []*Message
+	for _, p := range parts {
+		pdu, err := p.Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.Concat.Seq == 1 {
+			// the header 050003CC0201 and a bit of padding before the h
+			if ud := pdu[len(pdu)-140:]; !bytes.Equal(ud[:7], []byte{5, 0, 3, 0xcc, 2, 1, 0xd0}) {
+				t.Errorf("unexpected user data %X", ud[:7])
+			}
+		}
+		d, err := Decode(pdu)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded = append([]*Message{d}, decoded...)
+	}
+	m, ok := Join(decoded)
+	if !ok || m.Text != long {
+		t.Errorf("expected the text back got %v %q", ok, m.Text)
+	}
+	if _, ok := Join(decoded[:1]); ok {
+		t.Error("expected a missing part to be seen")
+	}
+
+	// an escaped character is not cut in two
+	parts, _ = Split(Message{Type: Submit, Number: "1", Text: strings.Repeat("a", 152) + "€" + strings.Repeat("b", 10)}, 1)
+	if len(parts) != 2 || parts[0].Text != strings.Repeat("a", 152) {
+		t.Errorf("expected the euro sign in the second part got %+v", parts)
+	}
+	parts, _ = Split(Message{Type: Submit, Number: "1", Text: strings.Repeat("ж", 100)}, 1)
+	if len(parts) != 2 || parts[0].Encoding != UCS2 || len([]rune(parts[0].Text)) != 67 {
+		t.Errorf("expected 67 characters in the first UCS-2 part got %+v", parts)
+	}
+	parts, _ = Split(Message{Type: Submit, Number: "1", Text: "short"}, 1)
+	if len(parts) != 1 || parts[0].Concat != nil {
+		t.Errorf("expected a short text in one message got %+v", parts)
+	}
+	if _, err := (&Message{Type: Submit, Number: "1", Text: strings.Repeat("a", 161)}).Encode(); err != ErrTooLong {
+		t.Errorf("expected ErrTooLong got %v", err)
+	}
+}
+
+func TestPack(t *testing.T) {
+	septets, ok := GSM7Septets("hellohello")
+	if !ok {
+		t.Fatal("expected the text to fit the alphabet")
+	}
+	packed := Pack(septets)
+	if s := strings.ToUpper(hex.EncodeToString(packed)); s != "E8329BFD4697D9EC37" {
+		t.Errorf("unexpected packing %s", s)
+	}
+	if s := GSM7Text(Unpack(packed, len(septets))); s != "hellohello" {
+		t.Errorf("unexpected unpacking %q", s)
+	}
+	if _, ok := GSM7Septets("привет"); ok {
+		t.Error("expected cyrillic to be missing from the alphabet")
+	}
+}
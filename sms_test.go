@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/FarmRadioHangar/fessboxconfig/audit"
+	"github.com/FarmRadioHangar/fessboxconfig/device"
+	"github.com/gorilla/mux"
+)
+
+func TestSMSRequest(t *testing.T) {
+	class := 4
+	sample := []struct {
+		req smsRequest
+		ok  bool
+	}{
+		{smsRequest{Number: "+255700000001", Text: "Habari"}, true},
+		{smsRequest{Number: "+255700000001", Text: "Habari", Validity: "12h"}, true},
+		{smsRequest{Number: "+255700000001"}, false},
+		{smsRequest{Number: "+255 700", Text: "Habari"}, false},
+		{smsRequest{Number: "+255700000001", Text: "Habari", Class: &class}, false},
+		{smsRequest{Number: "+255700000001", Text: "Habari", Validity: "soon"}, false},
+	}
+	for _, v := range sample {
+		if _, err := v.req.message(); (err == nil) != v.ok {
+			t.Errorf("%+v: expected ok=%v got %v", v.req, v.ok, err)
+		}
+	}
+}
+
+func TestSMS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fconf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	l, err := audit.Open(filepath.Join(dir, "audit.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = l.Close() }()
+	e := device.NewEmulator("356789012345678", "640050123456789")
+	m := device.New()
+	m.Open = e.Open
+	err = m.AddPort("/dev/ttyUSB0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ww := &web{cfg: defaultConfig(), manager: m, audit: l}
+	router := mux.NewRouter()
+	router.HandleFunc("/serial/{imei}/sms", ww.Inbox).Methods("GET")
+	router.HandleFunc("/serial/{imei}/sms", ww.SendSMS).Methods("POST")
+	router.HandleFunc("/serial/{imei}/sms/{index}", ww.DeleteSMS).Methods("DELETE")
+	do := func(method, path, body string, out interface{}) int {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		_ = json.NewDecoder(w.Body).Decode(out)
+		return w.Code
+	}
+
+	var sent map[string][]int
+	code := do("POST", "/serial/356789012345678/sms", `{"number":"+255700000001","text":"Habari"}`, &sent)
+	if code != http.StatusOK || len(sent["references"]) != 1 || e.Sent()[0].Text != "Habari" {
+		t.Errorf("expected the message to be sent got %d %v", code, sent)
+	}
+	if code := do("POST", "/serial/356789012345670/sms", `{"number":"1","text":"hi"}`, &sent); code != http.StatusNotFound {
+		t.Errorf("expected an unknown modem got %d", code)
+	}
+
+	e.Deliver("+255700000002", strings.Repeat("Habari za asubuhi ", 10))
+	var inbox []device.SMS
+	if code := do("GET", "/serial/356789012345678/sms", "", &inbox); code != http.StatusOK || len(inbox) != 1 {
+		t.Fatalf("expected one message got %d %+v", code, inbox)
+	}
+	var deleted map[string][]int
+	code = do("DELETE", "/serial/356789012345678/sms/2", "", &deleted)
+	if code != http.StatusOK || len(deleted["deleted"]) != 2 {
+		t.Errorf("expected both parts to be deleted got %d %v", code, deleted)
+	}
+	inbox = nil
+	if do("GET", "/serial/356789012345678/sms", "", &inbox); len(inbox) != 0 {
+		t.Errorf("expected an empty inbox got %+v", inbox)
+	}
+	entries, err := l.Query(&audit.Filter{Target: "356789012345678"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Action != audit.SMSSend || entries[1].Action != audit.SMSDelete {
+		t.Fatalf("unexpected audit entries %+v", entries)
+	}
+	if entries[0].After != "+255700000001" || entries[1].Before != "+255700000002" {
+		t.Errorf("expected only the numbers in the audit log got %+v", entries)
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/FarmRadioHangar/fessboxconfig/device"
+	"github.com/FarmRadioHangar/fessboxconfig/metrics"
+	"github.com/gorilla/mux"
+)
+
+// stats are the metrics served on /metrics. They are created once so that the
+// counters are kept across reloads of the configuration.
+type stats struct {
+	reg         *metrics.Registry
+	requests    *metrics.CounterVec
+	latency     *metrics.HistogramVec
+	writes      *metrics.CounterVec
+	parseErrors *metrics.CounterVec
+	commands    *metrics.CounterVec
+
+	mu      sync.Mutex
+	manager *device.Manager
+	// seen are the IMEIs of all the modems detected since fconf started, so
+	// the ones that are gone are reported as absent instead of disappearing.
+	seen map[string]bool
+}
+
+func newStats() *stats {
+	reg := metrics.NewRegistry()
+	s := &stats{
+		reg: reg,
+		requests: reg.Counter("fconf_http_requests_total",
+			"HTTP requests served by route, method and status code.", "route", "method", "code"),
+		latency: reg.Histogram("fconf_http_request_duration_seconds",
+			"Time taken to serve HTTP requests by route and method.", metrics.DefBuckets, "route", "method"),
+		writes: reg.Counter("fconf_config_writes_total",
+			"Writes of configuration files by file and result.", "file", "result"),
+		parseErrors: reg.Counter("fconf_config_parse_errors_total",
+			"Configuration files that could not be parsed by file.", "file"),
+		commands: reg.Counter("fconf_modem_at_commands_total",
+			"AT commands sent to the modems by IMEI and result.", "imei", "result"),
+		seen: make(map[string]bool),
+	}
+	reg.GaugeFunc("fconf_modem_present",
+		"Whether the modem is plugged in, 1 if it is and 0 if it was seen before but is gone.",
+		[]string{"imei"}, s.present)
+	reg.GaugeFunc("fconf_modem_signal_rssi",
+		"Signal quality of the modem as reported by AT+CSQ, 99 when not known.",
+		[]string{"imei"}, s.modemValue(func(m device.Modem) int { return m.Signal }))
+	reg.GaugeFunc("fconf_modem_registration_state",
+		"Network registration status of the modem as reported by AT+CREG?, 1 is home and 5 is roaming.",
+		[]string{"imei"}, s.modemValue(func(m device.Modem) int { return m.Registration }))
+	return s
+}
+
+// setManager sets the device manager whose modems are reported. m can be nil
+// when autodetect is off.
+func (s *stats) setManager(m *device.Manager) {
+	s.mu.Lock()
+	s.manager = m
+	s.mu.Unlock()
+	if m != nil {
+		m.OnCommand = s.command
+	}
+}
+
+func (s *stats) modems() []device.Modem {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.manager == nil {
+		return nil
+	}
+	list := s.manager.Modems()
+	for _, v := range list {
+		s.seen[v.IMEI] = true
+	}
+	return list
+}
+
+func (s *stats) present() []metrics.Sample {
+	up := make(map[string]bool)
+	for _, v := range s.modems() {
+		up[v.IMEI] = true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var samples []metrics.Sample
+	for imei := range s.seen {
+		value := 0.0
+		if up[imei] {
+			value = 1
+		}
+		samples = append(samples, metrics.Sample{Labels: []string{imei}, Value: value})
+	}
+	return samples
+}
+
+// modemValue returns a collector for the value of the modems returned by f,
+// modems that were not queried yet are left out.
+func (s *stats) modemValue(f func(device.Modem) int) func() []metrics.Sample {
+	return func() []metrics.Sample {
+		var samples []metrics.Sample
+		for _, v := range s.modems() {
+			if n := f(v); n >= 0 {
+				samples = append(samples, metrics.Sample{Labels: []string{v.IMEI}, Value: float64(n)})
+			}
+		}
+		return samples
+	}
+}
+
+func (s *stats) command(imei, cmd string, err error) {
+	s.commands.With(imei, result(err)).Inc()
+}
+
+// write counts a write of the configuration file name.
+func (s *stats) write(name string, err error) {
+	s.writes.With(name, result(err)).Inc()
+}
+
+func result(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
+
+// instrument is a mux middleware counting the requests and their latency by
+// the template of the matched route, which keeps the number of series bounded.
+func (s *stats) instrument(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := "unknown"
+		if cr := mux.CurrentRoute(r); cr != nil {
+			if tpl, err := cr.GetPathTemplate(); err == nil {
+				route = tpl
+			}
+		}
+		start := time.Now()
+		rw := &statusWriter{ResponseWriter: w, code: http.StatusOK}
+		h.ServeHTTP(rw, r)
+		s.latency.With(route, r.Method).Observe(time.Since(start).Seconds())
+		s.requests.With(route, r.Method, strconv.Itoa(rw.code)).Inc()
+	})
+}
+
+// statusWriter remembers the status code of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	code int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	w.code = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Hijack lets the websocket handlers take over the connection.
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("the connection can not be hijacked")
+	}
+	w.code = http.StatusSwitchingProtocols
+	return h.Hijack()
+}
+
+// withToken serves the requests with token as their bearer token with h and
+// the others with fallback. An empty token matches no request.
+func withToken(token string, h, fallback http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if token != "" && strings.HasPrefix(auth, "Bearer ") &&
+			subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(token)) == 1 {
+			h(w, r)
+			return
+		}
+		fallback(w, r)
+	}
+}
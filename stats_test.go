@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestStats(t *testing.T) {
+	st := newStats()
+	s := mux.NewRouter()
+	s.Use(st.instrument)
+	s.HandleFunc("/config/{filename}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	})
+	for _, name := range []string{"dongle", "extensions"} {
+		s.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/config/"+name, nil))
+	}
+	st.write("dongle.conf", nil)
+	st.write("dongle.conf", errors.New("disk full"))
+	st.setManager(nil)
+
+	buf := &bytes.Buffer{}
+	_, err := st.reg.WriteTo(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []string{
+		`fconf_http_requests_total{route="/config/{filename}",method="POST",code="403"} 2`,
+		`fconf_http_request_duration_seconds_count{route="/config/{filename}",method="POST"} 2`,
+		`fconf_config_writes_total{file="dongle.conf",result="failure"} 1`,
+		`fconf_config_writes_total{file="dongle.conf",result="success"} 1`,
+	}
+	out := buf.String()
+	for _, v := range expect {
+		if !strings.Contains(out, v+"\n") {
+			t.Errorf("expected %q in\n%s", v, out)
+		}
+	}
+}
+
+func TestWithToken(t *testing.T) {
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+	denied := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusUnauthorized) }
+	for _, v := range []struct {
+		token, auth string
+		code        int
+	}{
+		{"6f1c2d9e8b7a4f30", "Bearer 6f1c2d9e8b7a4f30", http.StatusOK},
+		{"6f1c2d9e8b7a4f30", "Bearer 6f1c2d9e8b7a4f31", http.StatusUnauthorized},
+		{"6f1c2d9e8b7a4f30", "6f1c2d9e8b7a4f30", http.StatusUnauthorized},
+		{"", "Bearer ", http.StatusUnauthorized},
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/metrics", nil)
+		r.Header.Set("Authorization", v.auth)
+		withToken(v.token, ok, denied)(w, r)
+		if w.Code != v.code {
+			t.Errorf("%q with %q: expected %d got %d", v.token, v.auth, v.code, w.Code)
+		}
+	}
+}
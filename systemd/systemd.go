@@ -0,0 +1,120 @@
+// Package systemd implements the parts of the systemd service protocol used by
+// fconf: readiness and watchdog notifications, and socket activation.
+//
+// Everything is a no-op when fconf is not started by systemd.
+package systemd
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Notification states understood by systemd.
+const (
+	Ready     = "READY=1"
+	Reloading = "RELOADING=1"
+	Stopping  = "STOPPING=1"
+	Watchdog  = "WATCHDOG=1"
+)
+
+// listenFdsStart is the first file descriptor passed by socket activation.
+const listenFdsStart = 3
+
+// Notify sends state to the service manager. It returns false without an error
+// when there is no service manager listening, which is the case when fconf is
+// not run by systemd or the unit is not Type=notify.
+func Notify(state string) (bool, error) {
+	name := os.Getenv("NOTIFY_SOCKET")
+	if name == "" {
+		return false, nil
+	}
+	addr := &net.UnixAddr{Name: name, Net: "unixgram"}
+	if name[0] == '@' {
+		// abstract namespace socket
+		addr.Name = "\x00" + name[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, addr)
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = conn.Close() }()
+	_, err = conn.Write([]byte(state))
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// WatchdogInterval returns how often WATCHDOG=1 should be sent. This is half of
+// the WatchdogSec of the unit so that a single late ping does not get fconf
+// killed. ok is false when the watchdog is not enabled for this process.
+func WatchdogInterval() (d time.Duration, ok bool) {
+	usec := os.Getenv("WATCHDOG_USEC")
+	if usec == "" {
+		return 0, false
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(usec, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, false
+	}
+	return time.Duration(n) * time.Microsecond / 2, true
+}
+
+var (
+	activated     []*os.File
+	activatedOnce sync.Once
+)
+
+// Files returns the sockets passed to fconf by socket activation. The files
+// are kept open for the life of the process so listeners can be created from
+// them again after a reload.
+func Files() []*os.File {
+	activatedOnce.Do(func() {
+		activated = files(os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS"))
+		_ = os.Unsetenv("LISTEN_PID")
+		_ = os.Unsetenv("LISTEN_FDS")
+		_ = os.Unsetenv("LISTEN_FDNAMES")
+	})
+	return activated
+}
+
+func files(pid, fds string) []*os.File {
+	if pid != strconv.Itoa(os.Getpid()) {
+		return nil
+	}
+	n, err := strconv.Atoi(fds)
+	if err != nil || n <= 0 {
+		return nil
+	}
+	var list []*os.File
+	for fd := listenFdsStart; fd < listenFdsStart+n; fd++ {
+		syscall.CloseOnExec(fd)
+		list = append(list, os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd)))
+	}
+	return list
+}
+
+// Listeners returns new listeners for the sockets passed by socket activation.
+// The returned listeners can be closed without closing the activated sockets.
+func Listeners() ([]net.Listener, error) {
+	var ls []net.Listener
+	for _, f := range Files() {
+		l, err := net.FileListener(f)
+		if err != nil {
+			for _, v := range ls {
+				_ = v.Close()
+			}
+			return nil, errors.New("systemd: " + f.Name() + " is not a stream socket: " + err.Error())
+		}
+		ls = append(ls, l)
+	}
+	return ls, nil
+}
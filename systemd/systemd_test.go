@@ -0,0 +1,80 @@
+package systemd
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestNotify(t *testing.T) {
+	_ = os.Unsetenv("NOTIFY_SOCKET")
+	sent, err := Notify(Ready)
+	if sent || err != nil {
+		t.Errorf("expected a no-op without NOTIFY_SOCKET got %v %v", sent, err)
+	}
+
+	dir, err := ioutil.TempDir("", "fconf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	name := filepath.Join(dir, "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+	_ = os.Setenv("NOTIFY_SOCKET", name)
+	defer func() { _ = os.Unsetenv("NOTIFY_SOCKET") }()
+
+	sent, err = Notify(Ready)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sent {
+		t.Error("expected the notification to be sent")
+	}
+	buf := make([]byte, 64)
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != Ready {
+		t.Errorf("expected %s got %s", Ready, buf[:n])
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	defer func() {
+		_ = os.Unsetenv("WATCHDOG_USEC")
+		_ = os.Unsetenv("WATCHDOG_PID")
+	}()
+	_ = os.Unsetenv("WATCHDOG_USEC")
+	if _, ok := WatchdogInterval(); ok {
+		t.Error("expected the watchdog to be off")
+	}
+	_ = os.Setenv("WATCHDOG_USEC", "30000000")
+	_ = os.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	d, ok := WatchdogInterval()
+	if !ok || d != 15*time.Second {
+		t.Errorf("expected 15s got %v %v", d, ok)
+	}
+	_ = os.Setenv("WATCHDOG_PID", "1")
+	if _, ok := WatchdogInterval(); ok {
+		t.Error("expected the watchdog of another process to be ignored")
+	}
+}
+
+func TestFiles(t *testing.T) {
+	if f := files("1", "2"); f != nil {
+		t.Error("expected the sockets of another process to be ignored")
+	}
+	if f := files(strconv.Itoa(os.Getpid()), "0"); f != nil {
+		t.Error("expected no sockets")
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+
+	"github.com/FarmRadioHangar/fessboxconfig/audit"
+	"github.com/FarmRadioHangar/fessboxconfig/device"
+	"github.com/FarmRadioHangar/fessboxconfig/sms"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+// maxUSSD is the longest USSD string in characters.
+const maxUSSD = 182
+
+var upgrader = websocket.Upgrader{}
+
+// ussdRequest is a step of a USSD session, a code like *150# or the answer to
+// the menu sent by the network. Cancel ends the session instead.
+type ussdRequest struct {
+	Code   string `json:"code"`
+	Cancel bool   `json:"cancel"`
+}
+
+// valid returns an error saying what is wrong with the request.
+func (req *ussdRequest) valid() error {
+	if req.Cancel {
+		return nil
+	}
+	if req.Code == "" {
+		return errors.New("expected a code")
+	}
+	septets, ok := sms.GSM7Septets(req.Code)
+	if !ok {
+		return fmt.Errorf("%q has characters missing from the GSM 7 bit alphabet", req.Code)
+	}
+	if len(septets) > maxUSSD {
+		return fmt.Errorf("the code is longer than %d characters", maxUSSD)
+	}
+	return nil
+}
+
+// ussdReply is the reply of the network served to the clients, Open is true
+// while the network waits for an answer.
+type ussdReply struct {
+	Status int    `json:"status"`
+	Text   string `json:"text"`
+	Open   bool   `json:"open"`
+}
+
+func ussdReplyOf(r *device.USSDReply) ussdReply {
+	return ussdReply{Status: r.Status, Text: r.Text, Open: r.Status == 1}
+}
+
+// ussd runs the request with the modem with the given imei and records the
+// code in the audit log, the reply is left out as viewers can read the log.
+// The reply is nil when the session was cancelled.
+func (ww *web) ussd(r *http.Request, imei string, req ussdRequest) (*device.USSDReply, error) {
+	e := audit.Entry{Action: audit.USSD, Target: imei, Before: req.Code}
+	if req.Cancel {
+		e.Before = "cancel"
+		err := ww.manager.CancelUSSD(r.Context(), imei)
+		ww.recordEntry(r, e, err)
+		return nil, err
+	}
+	reply, err := ww.manager.USSD(r.Context(), imei, req.Code)
+	ww.recordEntry(r, e, err)
+	return reply, err
+}
+
+// USSD takes a json object like {"code": "*150#"}, sends the code with the
+// modem with the imei in the url and serves the reply of the network. While
+// the reply is open the next request answers it, {"cancel": true} ends the
+// session. Every step is recorded in the audit log.
+func (ww *web) USSD(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	if ww.manager == nil {
+		w.WriteHeader(http.StatusNotFound)
+		_ = enc.Encode(&errMSG{"device detection is off"})
+		return
+	}
+	var req ussdRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = enc.Encode(&errMSG{"expected a json object with a code"})
+		return
+	}
+	if err := req.valid(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = enc.Encode(&errMSG{err.Error()})
+		return
+	}
+	reply, err := ww.ussd(r, mux.Vars(r)["imei"], req)
+	if err != nil {
+		modemError(w, err)
+		return
+	}
+	if reply == nil {
+		_ = enc.Encode(ussdReply{Status: 2})
+		return
+	}
+	_ = enc.Encode(ussdReplyOf(reply))
+}
+
+// USSDSocket runs a USSD session over a websocket for the interactive menus.
+// The client sends the same json objects as to USSD, and gets every reply of
+// the network for the modem with the imei in the url, including the end of a
+// session that timed out. Errors are sent as {"error": "..."}.
+func (ww *web) USSDSocket(w http.ResponseWriter, r *http.Request) {
+	if ww.manager == nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(&errMSG{"device detection is off"})
+		return
+	}
+	imei := mux.Vars(r)["imei"]
+	if _, ok := ww.manager.Modem(imei); !ok {
+		modemError(w, device.ErrNoModem)
+		return
+	}
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		if _, ok := err.(websocket.HandshakeError); !ok {
+			log.Println(err)
+		}
+		return
+	}
+	defer func() { _ = ws.Close() }()
+	var mu sync.Mutex
+	send := func(v interface{}) {
+		mu.Lock()
+		_ = ws.WriteJSON(v)
+		mu.Unlock()
+	}
+	events, cancel := ww.manager.Subscribe()
+	defer cancel()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case ev := <-events:
+				if ev.Type == device.EventUSSD && ev.IMEI == imei && ev.USSD != nil {
+					send(ussdReplyOf(ev.USSD))
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	for {
+		var req ussdRequest
+		err := ws.ReadJSON(&req)
+		if err != nil {
+			if _, ok := err.(*websocket.CloseError); !ok {
+				log.Println(err)
+			}
+			return
+		}
+		if err := req.valid(); err != nil {
+			send(&errMSG{err.Error()})
+			continue
+		}
+		reply, err := ww.ussd(r, imei, req)
+		switch {
+		case err != nil:
+			send(&errMSG{err.Error()})
+		case reply == nil:
+			send(ussdReply{Status: 2})
+		}
+	}
+}
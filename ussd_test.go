@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/FarmRadioHangar/fessboxconfig/audit"
+	"github.com/FarmRadioHangar/fessboxconfig/device"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+func TestUSSD(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fconf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	l, err := audit.Open(filepath.Join(dir, "audit.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = l.Close() }()
+	e := device.NewEmulator("356789012345678", "640050123456789")
+	e.USSD = map[string]string{
+		"*149#":   "1. Salio\n2. Vifurushi",
+		"*149#>1": "Salio lako ni TZS 1,000",
+	}
+	m := device.New()
+	m.Open = e.Open
+	err = m.AddPort("/dev/ttyUSB0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = m.RemoveDevice("/dev/ttyUSB0") }()
+	ww := &web{cfg: defaultConfig(), manager: m, audit: l}
+	router := mux.NewRouter()
+	router.HandleFunc("/serial/{imei}/ussd", ww.USSD).Methods("POST")
+	router.HandleFunc("/serial/{imei}/ussd/ws", ww.USSDSocket).Methods("GET")
+	do := func(path, body string, out interface{}) int {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", path, strings.NewReader(body)))
+		_ = json.NewDecoder(w.Body).Decode(out)
+		return w.Code
+	}
+
+	var reply ussdReply
+	code := do("/serial/356789012345678/ussd", `{"code":"*149#"}`, &reply)
+	if code != http.StatusOK || !reply.Open || reply.Text != "1. Salio\n2. Vifurushi" {
+		t.Errorf("expected the menu got %d %+v", code, reply)
+	}
+	code = do("/serial/356789012345678/ussd", `{"code":"1"}`, &reply)
+	if code != http.StatusOK || reply.Open || reply.Text != "Salio lako ni TZS 1,000" {
+		t.Errorf("expected the balance got %d %+v", code, reply)
+	}
+	if code := do("/serial/356789012345678/ussd", `{"code":""}`, &reply); code != http.StatusBadRequest {
+		t.Errorf("expected an empty code to be refused got %d", code)
+	}
+	if code := do("/serial/356789012345670/ussd", `{"code":"*149#"}`, &reply); code != http.StatusNotFound {
+		t.Errorf("expected an unknown modem got %d", code)
+	}
+	entries, err := l.Query(&audit.Filter{Target: "356789012345678"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Action != audit.USSD || entries[1].Before != "1" || entries[1].After != "" {
+		t.Errorf("unexpected audit entries %+v", entries)
+	}
+
+	s := httptest.NewServer(router)
+	defer s.Close()
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http")+"/serial/356789012345678/ussd/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ws.Close() }()
+	_ = ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for _, v := range []struct {
+		req    string
+		expect ussdReply
+	}{
+		{`{"code":"*149#"}`, ussdReply{Status: 1, Text: "1. Salio\n2. Vifurushi", Open: true}},
+		{`{"cancel":true}`, ussdReply{Status: 2}},
+		{`{"code":"*149#"}`, ussdReply{Status: 1, Text: "1. Salio\n2. Vifurushi", Open: true}},
+		{`{"code":"1"}`, ussdReply{Status: 0, Text: "Salio lako ni TZS 1,000"}},
+	} {
+		err = ws.WriteMessage(websocket.TextMessage, []byte(v.req))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got ussdReply
+		err = ws.ReadJSON(&got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != v.expect {
+			t.Errorf("%s: expected %+v got %+v", v.req, v.expect, got)
+		}
+	}
+	err = ws.WriteMessage(websocket.TextMessage, []byte(`{"code":"*149#ж"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg errMSG
+	if err := ws.ReadJSON(&msg); err != nil || msg.Message == "" {
+		t.Errorf("expected an error got %v %+v", err, msg)
+	}
+}
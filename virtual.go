@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/FarmRadioHangar/fessboxconfig/device"
+)
+
+// defaultVirtualModems are the modems emulated in dev mode when none are set.
+var defaultVirtualModems = []string{
+	"356789012345678:640050123456789",
+	"354369047238739:640041122334455",
+}
+
+// parseVirtualModem splits the IMEI:IMSI form of a virtual modem.
+func parseVirtualModem(v string) (imei, imsi string, err error) {
+	i := strings.IndexRune(v, ':')
+	if i == -1 {
+		return "", "", fmt.Errorf("%q is not IMEI:IMSI", v)
+	}
+	imei, imsi = v[:i], v[i+1:]
+	if len(imei) != 15 || !isDigits(imei) {
+		return "", "", fmt.Errorf("%q: imei must be 15 digits", v)
+	}
+	if imsi != "" && (len(imsi) != 15 || !isDigits(imsi)) {
+		return "", "", fmt.Errorf("%q: imsi must be 15 digits", v)
+	}
+	return imei, imsi, nil
+}
+
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// virtualModems creates the virtual modems of cfg. The ones that can not be
+// created are logged and skipped.
+func virtualModems(cfg *Config) []*device.VirtualModem {
+	list := cfg.VirtualModems
+	if len(list) == 0 {
+		list = defaultVirtualModems
+	}
+	var modems []*device.VirtualModem
+	for _, v := range list {
+		imei, imsi, err := parseVirtualModem(v)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		m, err := device.NewVirtualModem(device.NewEmulator(imei, imsi))
+		if err != nil {
+			log.Printf("virtual modem %s: %v\n", imei, err)
+			continue
+		}
+		log.Printf("virtual modem imei=%s imsi=%s on %s\n", imei, imsi, m.Path())
+		modems = append(modems, m)
+	}
+	return modems
+}